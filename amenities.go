@@ -0,0 +1,518 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Other instances pick up catalogue changes within this time
+const AMENITY_CACHE_TTL = 5 * time.Minute
+
+// Amenity is an entry of the amenity catalogue. Key names it in forms and
+// search URLs and never changes, the rest can be edited by admins. Retired
+// amenities are no longer offered or shown but stay on their listings.
+type Amenity struct {
+	ID        int    `json:"-"`
+	Key       string `json:"key"`
+	Label     string `json:"label"`
+	Category  string `json:"category"`
+	Icon      string `json:"icon"`
+	SortOrder int    `json:"-"`
+	Active    bool   `json:"-"`
+
+	// Only counted for the admin page
+	ListingCount int `json:"-"`
+}
+
+// AmenityCategory groups amenities on the listing page and forms
+type AmenityCategory struct {
+	Name      string
+	Amenities []Amenity
+}
+
+var amenity_categories = []string{"Essentials", "Features", "Location", "Safety", "Policies"}
+
+// default_amenities seed the catalogue. Their keys are the columns of the
+// Amenities table they replace, and the query parameters of old search URLs.
+var default_amenities = []Amenity{
+	{Key: "wifi", Label: "Wifi", Category: "Essentials", Icon: "📶"},
+	{Key: "kitchen", Label: "Kitchen", Category: "Essentials", Icon: "🍳"},
+	{Key: "air_conditioning", Label: "Air conditioning", Category: "Essentials", Icon: "❄️"},
+	{Key: "parking", Label: "Free parking", Category: "Features", Icon: "🚗"},
+	{Key: "pool", Label: "Pool", Category: "Features", Icon: "🏊"},
+	{Key: "tv", Label: "TV", Category: "Essentials", Icon: "📺"},
+	{Key: "washer", Label: "Washer", Category: "Essentials", Icon: "👕"},
+	{Key: "dryer", Label: "Dryer", Category: "Essentials", Icon: "🌀"},
+	{Key: "heating", Label: "Heating", Category: "Essentials", Icon: "🔥"},
+	{Key: "balcony", Label: "Balcony", Category: "Features", Icon: "🌿"},
+	{Key: "pets_allowed", Label: "Pets allowed", Category: "Policies", Icon: "🐕"},
+}
+
+var amenity_key_pattern = regexp.MustCompile(`^[a-z][a-z0-9_]{1,39}$`)
+
+var (
+	amenity_mutex     sync.RWMutex
+	amenity_catalog   []Amenity
+	amenity_loaded_at time.Time
+)
+
+// load_amenity_catalog reads the whole catalogue into the cache
+func load_amenity_catalog() error {
+	rows, err := db.Query(`SELECT id, amenity_key, label, category, icon, sort_order, active
+		FROM AmenityCatalog ORDER BY sort_order, label`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var catalog []Amenity
+	for rows.Next() {
+		var a Amenity
+		if err := rows.Scan(&a.ID, &a.Key, &a.Label, &a.Category, &a.Icon, &a.SortOrder, &a.Active); err != nil {
+			log.Printf("Error scanning amenity: %v", err)
+			continue
+		}
+		catalog = append(catalog, a)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	amenity_mutex.Lock()
+	amenity_catalog = catalog
+	amenity_loaded_at = time.Now()
+	amenity_mutex.Unlock()
+	return nil
+}
+
+// get_amenity_catalog returns every amenity, retired ones included, in
+// display order
+func get_amenity_catalog() []Amenity {
+	amenity_mutex.RLock()
+	catalog, loadedAt := amenity_catalog, amenity_loaded_at
+	amenity_mutex.RUnlock()
+
+	if time.Since(loadedAt) > AMENITY_CACHE_TTL {
+		if err := load_amenity_catalog(); err != nil {
+			log.Printf("Error loading amenity catalogue: %v", err)
+			return catalog
+		}
+		amenity_mutex.RLock()
+		catalog = amenity_catalog
+		amenity_mutex.RUnlock()
+	}
+	return catalog
+}
+
+// get_active_amenities returns the amenities hosts can pick and guests can
+// filter on
+func get_active_amenities() []Amenity {
+	var active []Amenity
+	for _, a := range get_amenity_catalog() {
+		if a.Active {
+			active = append(active, a)
+		}
+	}
+	return active
+}
+
+func find_amenity(key string) (Amenity, bool) {
+	for _, a := range get_amenity_catalog() {
+		if a.Key == key {
+			return a, true
+		}
+	}
+	return Amenity{}, false
+}
+
+// group_amenities splits amenities by category, in the order of
+// amenity_categories and then of first appearance
+func group_amenities(amenities []Amenity) []AmenityCategory {
+	var groups []AmenityCategory
+	index := map[string]int{}
+	for _, name := range amenity_categories {
+		index[name] = len(groups)
+		groups = append(groups, AmenityCategory{Name: name})
+	}
+	for _, a := range amenities {
+		i, ok := index[a.Category]
+		if !ok {
+			i = len(groups)
+			index[a.Category] = i
+			groups = append(groups, AmenityCategory{Name: a.Category})
+		}
+		groups[i].Amenities = append(groups[i].Amenities, a)
+	}
+
+	var nonEmpty []AmenityCategory
+	for _, group := range groups {
+		if len(group.Amenities) > 0 {
+			nonEmpty = append(nonEmpty, group)
+		}
+	}
+	return nonEmpty
+}
+
+// normalize_amenity_keys keeps the known keys once each, in catalogue order
+func normalize_amenity_keys(keys []string) []string {
+	wanted := map[string]bool{}
+	for _, key := range keys {
+		wanted[key] = true
+	}
+	var normalized []string
+	for _, a := range get_amenity_catalog() {
+		if wanted[a.Key] {
+			normalized = append(normalized, a.Key)
+		}
+	}
+	return normalized
+}
+
+// listing_amenity_ids_sql selects the amenity ids of listing p as a comma
+// separated list, for amenities_from_ids
+const listing_amenity_ids_sql = `COALESCE((SELECT GROUP_CONCAT(la.amenity_id) FROM ListingAmenities la WHERE la.post_id = p.id), '')`
+
+// amenities_from_ids turns the ids selected by listing_amenity_ids_sql into
+// the listing's active amenities, in catalogue order
+func amenities_from_ids(ids string) []Amenity {
+	if ids == "" {
+		return nil
+	}
+	selected := map[int]bool{}
+	for _, raw := range strings.Split(ids, ",") {
+		if id, err := strconv.Atoi(raw); err == nil {
+			selected[id] = true
+		}
+	}
+	var amenities []Amenity
+	for _, a := range get_amenity_catalog() {
+		if a.Active && selected[a.ID] {
+			amenities = append(amenities, a)
+		}
+	}
+	return amenities
+}
+
+// HasAmenity reports whether the listing offers the amenity
+func (l Listing) HasAmenity(key string) bool {
+	for _, a := range l.Amenities {
+		if a.Key == key {
+			return true
+		}
+	}
+	return false
+}
+
+// TopAmenities are the first n amenities of the listing, for cards
+func (l Listing) TopAmenities(n int) []Amenity {
+	if len(l.Amenities) > n {
+		return l.Amenities[:n]
+	}
+	return l.Amenities
+}
+
+// set_listing_amenities replaces the active amenities of a listing with the
+// given keys. Unknown and retired keys are ignored.
+func set_listing_amenities(listingID int, keys []string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`DELETE la FROM ListingAmenities la
+		JOIN AmenityCatalog c ON c.id = la.amenity_id
+		WHERE la.post_id = ? AND c.active = true`, listingID)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range normalize_amenity_keys(keys) {
+		amenity, _ := find_amenity(key)
+		if !amenity.Active {
+			continue
+		}
+		_, err := tx.Exec(`INSERT IGNORE INTO ListingAmenities (post_id, amenity_id) VALUES (?, ?)`, listingID, amenity.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// parse_amenity_form reads the checked amenity boxes of the listing forms
+func parse_amenity_form(r *http.Request) []string {
+	return normalize_amenity_keys(r.Form["amenity"])
+}
+
+// get_amenity_usage returns the whole catalogue with how many listings offer
+// each amenity
+func get_amenity_usage() ([]Amenity, error) {
+	rows, err := db.Query(`SELECT amenity_id, COUNT(*) FROM ListingAmenities GROUP BY amenity_id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := map[int]int{}
+	for rows.Next() {
+		var id, count int
+		if err := rows.Scan(&id, &count); err == nil {
+			counts[id] = count
+		}
+	}
+
+	catalog := append([]Amenity{}, get_amenity_catalog()...)
+	for i := range catalog {
+		catalog[i].ListingCount = counts[catalog[i].ID]
+	}
+	return catalog, rows.Err()
+}
+
+// parse_amenity_admin_form validates the fields an admin can edit
+func parse_amenity_admin_form(r *http.Request) (Amenity, error) {
+	a := Amenity{
+		Label:    strings.TrimSpace(r.FormValue("label")),
+		Category: strings.TrimSpace(r.FormValue("category")),
+		Icon:     strings.TrimSpace(r.FormValue("icon")),
+		Active:   r.FormValue("active") == "on",
+	}
+	if a.Label == "" || len(a.Label) > 60 {
+		return a, fmt.Errorf("label must be 1 to 60 characters")
+	}
+	if !contains_string(amenity_categories, a.Category) {
+		return a, fmt.Errorf("unknown category")
+	}
+	if len(a.Icon) > 16 {
+		return a, fmt.Errorf("icon is too long")
+	}
+	sortOrder, err := strconv.Atoi(r.FormValue("sort_order"))
+	if err != nil {
+		return a, fmt.Errorf("invalid sort order")
+	}
+	a.SortOrder = sortOrder
+	return a, nil
+}
+
+// admin_amenities_handler lets admins add, edit, retire and delete catalogue
+// amenities
+func admin_amenities_handler(w http.ResponseWriter, r *http.Request) {
+	authenticated, userID := is_authenticated(r)
+	if !authenticated {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	if !is_admin_user(userID) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		amenities, err := get_amenity_usage()
+		if err != nil {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			log.Println("Error fetching amenity usage:", err)
+			return
+		}
+
+		templateData := struct {
+			Auth       AuthContext
+			Amenities  []Amenity
+			Categories []string
+		}{
+			Auth:       get_auth(r),
+			Amenities:  amenities,
+			Categories: amenity_categories,
+		}
+
+		tmpl := template.Must(template.ParseFiles("template/admin_amenities.html"))
+		err = tmpl.Execute(w, templateData)
+		if err != nil {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			log.Println("Error executing template:", err)
+		}
+
+	case http.MethodPost:
+		var err error
+		switch r.FormValue("action") {
+		case "create":
+			var a Amenity
+			a, err = parse_amenity_admin_form(r)
+			key := strings.TrimSpace(r.FormValue("key"))
+			if err == nil && !amenity_key_pattern.MatchString(key) {
+				err = fmt.Errorf("key must be lowercase letters, digits and underscores")
+			}
+			if err == nil {
+				if _, exists := find_amenity(key); exists {
+					err = fmt.Errorf("an amenity with this key already exists")
+				}
+			}
+			if err == nil {
+				_, err = db.Exec(`INSERT INTO AmenityCatalog (amenity_key, label, category, icon, sort_order, active)
+					VALUES (?, ?, ?, ?, ?, true)`, key, a.Label, a.Category, a.Icon, a.SortOrder)
+			}
+
+		case "update":
+			var a Amenity
+			a, err = parse_amenity_admin_form(r)
+			if err == nil {
+				_, err = db.Exec(`UPDATE AmenityCatalog SET label = ?, category = ?, icon = ?, sort_order = ?, active = ?
+					WHERE id = ?`, a.Label, a.Category, a.Icon, a.SortOrder, a.Active, r.FormValue("id"))
+			}
+
+		case "delete":
+			// Listings lose the amenity along with it
+			_, err = db.Exec(`DELETE FROM AmenityCatalog WHERE id = ?`, r.FormValue("id"))
+
+		default:
+			err = fmt.Errorf("unknown action")
+		}
+		if err != nil {
+			http.Error(w, "Error saving amenity: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := load_amenity_catalog(); err != nil {
+			log.Printf("Error reloading amenity catalogue: %v", err)
+		}
+		http.Redirect(w, r, "/admin/amenities", http.StatusSeeOther)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// seed_amenity_catalog adds the default amenities that are missing
+func seed_amenity_catalog() {
+	for i, a := range default_amenities {
+		_, err := db.Exec(`INSERT IGNORE INTO AmenityCatalog (amenity_key, label, category, icon, sort_order)
+			VALUES (?, ?, ?, ?, ?)`, a.Key, a.Label, a.Category, a.Icon, (i+1)*10)
+		if err != nil {
+			log.Printf("Error seeding amenity %s: %v", a.Key, err)
+		}
+	}
+}
+
+// migrate_legacy_amenities moves the boolean columns of the old Amenities
+// table to ListingAmenities. Once every amenity of every listing is found in
+// ListingAmenities the old table is renamed to Amenities_legacy, otherwise
+// it is left in place and the migration runs again on the next start.
+func migrate_legacy_amenities() {
+	var exists int
+	err := db.QueryRow(`SELECT COUNT(*) FROM information_schema.tables
+		WHERE table_schema = DATABASE() AND table_name = 'Amenities'`).Scan(&exists)
+	if err != nil || exists == 0 {
+		return
+	}
+
+	keys := make([]interface{}, len(default_amenities))
+	for i, a := range default_amenities {
+		keys[i] = a.Key
+	}
+	var seeded int
+	err = db.QueryRow(`SELECT COUNT(*) FROM AmenityCatalog WHERE amenity_key IN (?`+strings.Repeat(", ?", len(keys)-1)+`)`,
+		keys...).Scan(&seeded)
+	if err != nil || seeded != len(default_amenities) {
+		log.Printf("Not migrating amenities, the catalogue has %d of the %d default amenities: %v", seeded, len(default_amenities), err)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("Error migrating amenities: %v", err)
+		return
+	}
+	defer tx.Rollback()
+
+	legacy, migrated := 0, 0
+	for _, a := range default_amenities {
+		// The column names are the fixed default keys, never user input
+		_, err := tx.Exec(fmt.Sprintf(`INSERT IGNORE INTO ListingAmenities (post_id, amenity_id)
+			SELECT a.post_id, c.id FROM Amenities a
+			JOIN AmenityCatalog c ON c.amenity_key = ?
+			WHERE a.%s = true`, a.Key), a.Key)
+		if err != nil {
+			log.Printf("Error migrating amenity %s: %v", a.Key, err)
+			return
+		}
+
+		var legacyCount, migratedCount int
+		err = tx.QueryRow(fmt.Sprintf(`SELECT COUNT(DISTINCT post_id) FROM Amenities WHERE %s = true`, a.Key)).
+			Scan(&legacyCount)
+		if err != nil {
+			log.Printf("Error counting amenity %s: %v", a.Key, err)
+			return
+		}
+		err = tx.QueryRow(fmt.Sprintf(`SELECT COUNT(*) FROM ListingAmenities la
+			JOIN AmenityCatalog c ON c.id = la.amenity_id AND c.amenity_key = ?
+			WHERE la.post_id IN (SELECT post_id FROM Amenities WHERE %s = true)`, a.Key), a.Key).
+			Scan(&migratedCount)
+		if err != nil {
+			log.Printf("Error counting amenity %s: %v", a.Key, err)
+			return
+		}
+		legacy += legacyCount
+		migrated += migratedCount
+	}
+	if migrated != legacy {
+		log.Printf("Not migrating amenities, %d of %d listing amenities were copied", migrated, legacy)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error migrating amenities: %v", err)
+		return
+	}
+
+	if _, err := db.Exec(`RENAME TABLE Amenities TO Amenities_legacy`); err != nil {
+		log.Printf("Error renaming the old Amenities table: %v", err)
+		return
+	}
+	log.Printf("Migrated %d listing amenities to the amenity catalogue, the old table is kept as Amenities_legacy", migrated)
+}
+
+func update_tables_for_amenity_catalog() {
+	createQueries := []string{
+		`CREATE TABLE IF NOT EXISTS AmenityCatalog (
+			id INT AUTO_INCREMENT PRIMARY KEY,
+			amenity_key VARCHAR(40) NOT NULL UNIQUE,
+			label VARCHAR(60) NOT NULL,
+			category VARCHAR(40) NOT NULL,
+			icon VARCHAR(16) NOT NULL DEFAULT '',
+			sort_order INT NOT NULL DEFAULT 0,
+			active BOOLEAN NOT NULL DEFAULT TRUE,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		) DEFAULT CHARSET = utf8mb4`,
+		`CREATE TABLE IF NOT EXISTS ListingAmenities (
+			post_id INT NOT NULL,
+			amenity_id INT NOT NULL,
+			PRIMARY KEY (post_id, amenity_id),
+			INDEX idx_listing_amenities_amenity (amenity_id, post_id),
+			FOREIGN KEY (post_id) REFERENCES Posts(id) ON DELETE CASCADE,
+			FOREIGN KEY (amenity_id) REFERENCES AmenityCatalog(id) ON DELETE CASCADE
+		)`,
+	}
+
+	for _, query := range createQueries {
+		if _, err := db.Exec(query); err != nil {
+			log.Printf("Error creating amenity catalogue table: %v", err)
+		}
+	}
+
+	seed_amenity_catalog()
+	migrate_legacy_amenities()
+
+	if err := load_amenity_catalog(); err != nil {
+		log.Printf("Error loading amenity catalogue: %v", err)
+	}
+
+	log.Println("Tables updated for amenity catalogue")
+}
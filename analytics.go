@@ -0,0 +1,444 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Listing events, counted per day by the rollup_listing_stats job
+const (
+	EVENT_IMPRESSION    = "impression"
+	EVENT_VIEW          = "view"
+	EVENT_BOOKING_START = "booking_start"
+	EVENT_BOOKING       = "booking"
+)
+
+const (
+	DEFAULT_ANALYTICS_DAYS = 30
+	MAX_ANALYTICS_DAYS     = 366
+)
+
+// Raw events are kept this long, the daily rollups for good. Visitors are
+// counted from the raw views, so they go back as far as the longest period.
+const LISTING_EVENT_PURGE_DAYS = MAX_ANALYTICS_DAYS
+
+var analytics_periods = []int{7, 30, 90, 365}
+
+// viewer_key tells visitors apart without storing who they are: signed in
+// users by id, others by a hash of their address and browser
+func viewer_key(r *http.Request, userID int) string {
+	if userID > 0 {
+		return fmt.Sprintf("u%d", userID)
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	sum := sha256.Sum256([]byte(string(key) + "|" + host + "|" + r.UserAgent()))
+	return hex.EncodeToString(sum[:8])
+}
+
+func is_crawler(r *http.Request) bool {
+	agent := strings.ToLower(r.UserAgent())
+	if agent == "" {
+		return true
+	}
+	for _, marker := range []string{"bot", "crawl", "spider", "slurp"} {
+		if strings.Contains(agent, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+// record_listing_events stores one event of kind for each listing. Crawlers
+// and hosts looking at their own listings aren't counted.
+func record_listing_events(r *http.Request, kind string, listings []Listing) {
+	if len(listings) == 0 || is_crawler(r) {
+		return
+	}
+	_, userID := is_authenticated(r)
+	viewer := viewer_key(r, userID)
+
+	var placeholders []string
+	var args []interface{}
+	for _, listing := range listings {
+		if userID > 0 && listing.UserID == userID {
+			continue
+		}
+		placeholders = append(placeholders, "(?, ?, NULLIF(?, 0), ?)")
+		args = append(args, listing.ID, kind, userID, viewer)
+	}
+	if len(placeholders) == 0 {
+		return
+	}
+
+	_, err := db.Exec(`INSERT INTO ListingEvents (post_id, kind, user_id, viewer) VALUES `+strings.Join(placeholders, ", "), args...)
+	if err != nil {
+		log.Printf("Error recording %s events: %v", kind, err)
+	}
+}
+
+func record_listing_event(r *http.Request, kind string, listing *Listing) {
+	record_listing_events(r, kind, []Listing{*listing})
+}
+
+// record_booking_event counts a confirmed booking for its listing. It runs in
+// the transaction that confirms the booking, so only bookings that commit count.
+func record_booking_event(tx *sql.Tx, listingID, guestID int) error {
+	_, err := tx.Exec(`INSERT INTO ListingEvents (post_id, kind, user_id, viewer) VALUES (?, ?, ?, ?)`,
+		listingID, EVENT_BOOKING, guestID, viewer_key(nil, guestID))
+	return err
+}
+
+func register_analytics_jobs() {
+	register_job(Job{Name: "rollup_listing_stats", Interval: time.Hour, Run: rollup_listing_stats})
+}
+
+// rollup_listing_stats counts the events of each listing per day into
+// ListingDailyStats. Days from the last one rolled up on are counted again,
+// so a day stays complete however late the job runs.
+func rollup_listing_stats() error {
+	var lastDay sql.NullTime
+	if err := db.QueryRow(`SELECT MAX(day) FROM ListingDailyStats`).Scan(&lastDay); err != nil {
+		return err
+	}
+	from := time.Time{}
+	if lastDay.Valid {
+		from = lastDay.Time
+	}
+
+	result, err := db.Exec(`INSERT INTO ListingDailyStats (post_id, day, impressions, views, unique_viewers, booking_starts, bookings)
+		SELECT post_id, DATE(created_at),
+		       SUM(kind = ?), SUM(kind = ?), COUNT(DISTINCT CASE WHEN kind = ? THEN viewer END),
+		       SUM(kind = ?), SUM(kind = ?)
+		FROM ListingEvents
+		WHERE created_at >= ?
+		GROUP BY post_id, DATE(created_at)
+		ON DUPLICATE KEY UPDATE impressions = VALUES(impressions), views = VALUES(views),
+		       unique_viewers = VALUES(unique_viewers), booking_starts = VALUES(booking_starts), bookings = VALUES(bookings)`,
+		EVENT_IMPRESSION, EVENT_VIEW, EVENT_VIEW, EVENT_BOOKING_START, EVENT_BOOKING, from.Format("2006-01-02"))
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n > 0 {
+		log.Printf("Rolled up listing stats since %s", from.Format("2006-01-02"))
+	}
+	return nil
+}
+
+// ListingPerformance is how one listing did over an analytics period. Money
+// is in the listing's currency.
+type ListingPerformance struct {
+	ID       int
+	Title    string
+	City     string
+	Currency string
+	Symbol   string
+
+	Impressions   int
+	Views         int
+	UniqueViewers int
+	BookingStarts int
+	Bookings      int
+
+	// Nights booked within the period, out of those the listing was online
+	BookedNights    int
+	AvailableNights int
+	Revenue         float64
+}
+
+// ClickThroughRate is the share of search impressions that led to a view
+func (p ListingPerformance) ClickThroughRate() float64 {
+	return percentage(p.Views, p.Impressions)
+}
+
+// ConversionRate is the share of visitors who booked
+func (p ListingPerformance) ConversionRate() float64 {
+	return percentage(p.Bookings, p.UniqueViewers)
+}
+
+func (p ListingPerformance) Occupancy() float64 {
+	return percentage(p.BookedNights, p.AvailableNights)
+}
+
+// ADR is the average daily rate, revenue per booked night
+func (p ListingPerformance) ADR() float64 {
+	if p.BookedNights == 0 {
+		return 0
+	}
+	return p.Revenue / float64(p.BookedNights)
+}
+
+func percentage(part, whole int) float64 {
+	if whole == 0 {
+		return 0
+	}
+	return 100 * float64(part) / float64(whole)
+}
+
+// nights_between counts the nights of [start, end) that fall within [from, to)
+func nights_between(start, end, from, to time.Time) int {
+	if start.Before(from) {
+		start = from
+	}
+	if end.After(to) {
+		end = to
+	}
+	if !end.After(start) {
+		return 0
+	}
+	return int(end.Sub(start).Hours()/24 + 0.5)
+}
+
+// get_host_performance reports each of the host's listings for the days from
+// first to last, both included. Stay revenue is spread evenly over a stay's
+// nights, so a stay across the period's edge counts in part.
+func get_host_performance(hostID int, first, last time.Time) ([]ListingPerformance, error) {
+	from := first
+	to := last.AddDate(0, 0, 1)
+
+	rows, err := db.Query(`SELECT id, title, COALESCE(city, ''), currency, created_at FROM Posts WHERE user_id = ? ORDER BY created_at DESC`, hostID)
+	if err != nil {
+		return nil, err
+	}
+	var report []ListingPerformance
+	index := map[int]int{}
+	for rows.Next() {
+		var p ListingPerformance
+		var createdAt time.Time
+		if err := rows.Scan(&p.ID, &p.Title, &p.City, &p.Currency, &createdAt); err != nil {
+			log.Printf("Error scanning listing for analytics: %v", err)
+			continue
+		}
+		p.Symbol = currency_symbol(p.Currency)
+		online := time.Date(createdAt.Year(), createdAt.Month(), createdAt.Day(), 0, 0, 0, 0, time.UTC)
+		p.AvailableNights = nights_between(online, to, from, to)
+		index[p.ID] = len(report)
+		report = append(report, p)
+	}
+	rows.Close()
+	if len(report) == 0 {
+		return report, nil
+	}
+
+	rows, err = db.Query(`SELECT s.post_id, SUM(s.impressions), SUM(s.views), SUM(s.booking_starts), SUM(s.bookings)
+		FROM ListingDailyStats s
+		JOIN Posts p ON p.id = s.post_id
+		WHERE p.user_id = ? AND s.day BETWEEN ? AND ?
+		GROUP BY s.post_id`, hostID, first.Format("2006-01-02"), last.Format("2006-01-02"))
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var id, impressions, views, bookingStarts, bookings int
+		if err := rows.Scan(&id, &impressions, &views, &bookingStarts, &bookings); err != nil {
+			log.Printf("Error scanning listing stats: %v", err)
+			continue
+		}
+		if i, ok := index[id]; ok {
+			p := &report[i]
+			p.Impressions, p.Views, p.BookingStarts, p.Bookings = impressions, views, bookingStarts, bookings
+		}
+	}
+	rows.Close()
+
+	// The daily rollups count each visitor once per day, so a visitor who
+	// comes back on another day would count twice. Count the period's
+	// visitors from the raw views instead.
+	rows, err = db.Query(`SELECT e.post_id, COUNT(DISTINCT e.viewer)
+		FROM ListingEvents e
+		JOIN Posts p ON p.id = e.post_id
+		WHERE p.user_id = ? AND e.kind = ? AND e.created_at >= ? AND e.created_at < ?
+		GROUP BY e.post_id`, hostID, EVENT_VIEW, from.Format("2006-01-02"), to.Format("2006-01-02"))
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var id, uniqueViewers int
+		if err := rows.Scan(&id, &uniqueViewers); err != nil {
+			log.Printf("Error scanning listing visitors: %v", err)
+			continue
+		}
+		if i, ok := index[id]; ok {
+			report[i].UniqueViewers = uniqueViewers
+		}
+	}
+	rows.Close()
+
+	rows, err = db.Query(`SELECT b.post_id, b.start_date, b.end_date, b.total_price, COALESCE(b.currency, p.currency)
+		FROM Bookings b
+		JOIN Posts p ON p.id = b.post_id
+		WHERE p.user_id = ? AND COALESCE(b.status, 'confirmed') IN ('confirmed', 'completed')
+		  AND b.start_date < ? AND b.end_date > ?`, hostID, to.Format("2006-01-02"), from.Format("2006-01-02"))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		var start, end time.Time
+		var total float64
+		var currency string
+		if err := rows.Scan(&id, &start, &end, &total, &currency); err != nil {
+			log.Printf("Error scanning booking for analytics: %v", err)
+			continue
+		}
+		i, ok := index[id]
+		if !ok {
+			continue
+		}
+		p := &report[i]
+		stayNights := nights_between(start, end, start, end)
+		nights := nights_between(start, end, from, to)
+		if stayNights == 0 || nights == 0 {
+			continue
+		}
+		// A listing whose currency changed still reports in its current one
+		if currency != p.Currency {
+			if converted, _, err := convert_amount(total, currency, p.Currency); err == nil {
+				total = converted
+			}
+		}
+		p.BookedNights += nights
+		p.Revenue += total * float64(nights) / float64(stayNights)
+	}
+	return report, rows.Err()
+}
+
+// parse_analytics_period reads the from and to dates of the analytics page,
+// or a number of days up to today
+func parse_analytics_period(r *http.Request) (time.Time, time.Time) {
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	last := today
+	first := today.AddDate(0, 0, 1-DEFAULT_ANALYTICS_DAYS)
+
+	if days, err := strconv.Atoi(r.URL.Query().Get("days")); err == nil && days > 0 {
+		first = today.AddDate(0, 0, 1-min(days, MAX_ANALYTICS_DAYS))
+	}
+	if from, err := time.Parse("2006-01-02", r.URL.Query().Get("from")); err == nil {
+		first = from
+	}
+	if to, err := time.Parse("2006-01-02", r.URL.Query().Get("to")); err == nil {
+		last = to
+	}
+
+	if last.Before(first) {
+		first, last = last, first
+	}
+	if last.Sub(first) >= MAX_ANALYTICS_DAYS*24*time.Hour {
+		first = last.AddDate(0, 0, 1-MAX_ANALYTICS_DAYS)
+	}
+	return first, last
+}
+
+// analytics_handler shows hosts how their listings performed over a period
+func analytics_handler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	authenticated, userID := is_authenticated(r)
+	if !authenticated {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	first, last := parse_analytics_period(r)
+	report, err := get_host_performance(userID, first, last)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		log.Println("Error building host analytics:", err)
+		return
+	}
+
+	// Totals add up every listing's revenue in the viewer's currency
+	currency := get_display_currency(r)
+	total := ListingPerformance{Currency: currency, Symbol: currency_symbol(currency)}
+	for _, p := range report {
+		total.Impressions += p.Impressions
+		total.Views += p.Views
+		total.UniqueViewers += p.UniqueViewers
+		total.BookingStarts += p.BookingStarts
+		total.Bookings += p.Bookings
+		total.BookedNights += p.BookedNights
+		total.AvailableNights += p.AvailableNights
+		revenue, _, err := convert_amount(p.Revenue, p.Currency, currency)
+		if err != nil {
+			revenue = p.Revenue
+		}
+		total.Revenue += revenue
+	}
+
+	templateData := struct {
+		Auth     AuthContext
+		Report   []ListingPerformance
+		Total    ListingPerformance
+		From     string
+		To       string
+		Days     int
+		Periods  []int
+		Currency string
+	}{
+		Auth:     get_auth(r),
+		Report:   report,
+		Total:    total,
+		From:     first.Format("2006-01-02"),
+		To:       last.Format("2006-01-02"),
+		Days:     int(last.Sub(first).Hours()/24) + 1,
+		Periods:  analytics_periods,
+		Currency: currency,
+	}
+
+	tmpl := template.Must(template.ParseFiles("template/analytics.html"))
+	if err := tmpl.Execute(w, templateData); err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		log.Println("Error executing template:", err)
+	}
+}
+
+func update_tables_for_analytics() {
+	createQueries := []string{
+		`CREATE TABLE IF NOT EXISTS ListingEvents (
+			id BIGINT AUTO_INCREMENT PRIMARY KEY,
+			post_id INT NOT NULL,
+			kind VARCHAR(20) NOT NULL,
+			user_id INT NULL,
+			viewer VARCHAR(20) NOT NULL,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			INDEX idx_listing_events_created (created_at),
+			INDEX idx_listing_events_viewer (viewer, kind),
+			FOREIGN KEY (post_id) REFERENCES Posts(id) ON DELETE CASCADE
+		)`,
+		`CREATE TABLE IF NOT EXISTS ListingDailyStats (
+			post_id INT NOT NULL,
+			day DATE NOT NULL,
+			impressions INT NOT NULL DEFAULT 0,
+			views INT NOT NULL DEFAULT 0,
+			unique_viewers INT NOT NULL DEFAULT 0,
+			booking_starts INT NOT NULL DEFAULT 0,
+			bookings INT NOT NULL DEFAULT 0,
+			PRIMARY KEY (post_id, day),
+			INDEX idx_listing_daily_stats_day (day),
+			FOREIGN KEY (post_id) REFERENCES Posts(id) ON DELETE CASCADE
+		)`,
+	}
+
+	for _, query := range createQueries {
+		if _, err := db.Exec(query); err != nil {
+			log.Printf("Error creating analytics table: %v", err)
+		}
+	}
+
+	log.Println("Tables updated for analytics")
+}
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CancellationTier gives the percentage of the booking total refunded when a
+// guest cancels at least DaysBefore days before check-in
+type CancellationTier struct {
+	DaysBefore    int
+	RefundPercent int
+}
+
+type CancellationPolicy struct {
+	Name  string
+	Tiers []CancellationTier
+}
+
+var cancellation_policies = map[string][]CancellationTier{
+	"flexible": {{DaysBefore: 1, RefundPercent: 100}},
+	"moderate": {{DaysBefore: 5, RefundPercent: 100}, {DaysBefore: 1, RefundPercent: 50}},
+	"strict":   {{DaysBefore: 14, RefundPercent: 100}, {DaysBefore: 7, RefundPercent: 50}},
+}
+
+const DEFAULT_CANCELLATION_POLICY = "moderate"
+
+// get_cancellation_policy builds a policy from the values stored on a listing
+// or booking. Custom policies carry their own tiers, the others use the
+// predefined ones.
+func get_cancellation_policy(name, customTiers string) (*CancellationPolicy, error) {
+	if name == "" {
+		name = DEFAULT_CANCELLATION_POLICY
+	}
+
+	if name == "custom" {
+		tiers, err := parse_cancellation_tiers(customTiers)
+		if err != nil {
+			return nil, err
+		}
+		return &CancellationPolicy{Name: name, Tiers: tiers}, nil
+	}
+
+	tiers, ok := cancellation_policies[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown cancellation policy: %s", name)
+	}
+
+	return &CancellationPolicy{Name: name, Tiers: tiers}, nil
+}
+
+// parse_cancellation_tiers reads tiers written as "days:percent" pairs separated
+// by commas, e.g. "30:100,7:50"
+func parse_cancellation_tiers(value string) ([]CancellationTier, error) {
+	var tiers []CancellationTier
+
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		fields := strings.Split(part, ":")
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid cancellation tier: %s", part)
+		}
+
+		days, err := strconv.Atoi(strings.TrimSpace(fields[0]))
+		if err != nil || days < 0 {
+			return nil, fmt.Errorf("invalid number of days in tier: %s", part)
+		}
+
+		percent, err := strconv.Atoi(strings.TrimSpace(fields[1]))
+		if err != nil || percent < 0 || percent > 100 {
+			return nil, fmt.Errorf("refund percent must be between 0 and 100: %s", part)
+		}
+
+		tiers = append(tiers, CancellationTier{DaysBefore: days, RefundPercent: percent})
+	}
+
+	if len(tiers) == 0 {
+		return nil, fmt.Errorf("custom policy needs at least one tier")
+	}
+
+	// Largest notice period first so the first matching tier wins
+	sort.Slice(tiers, func(i, j int) bool {
+		return tiers[i].DaysBefore > tiers[j].DaysBefore
+	})
+
+	return tiers, nil
+}
+
+func format_cancellation_tiers(tiers []CancellationTier) string {
+	parts := make([]string, 0, len(tiers))
+	for _, tier := range tiers {
+		parts = append(parts, fmt.Sprintf("%d:%d", tier.DaysBefore, tier.RefundPercent))
+	}
+	return strings.Join(parts, ",")
+}
+
+// RefundPercent returns the share of the total refunded for a cancellation
+// made on cancelDate for a stay starting on checkIn
+func (p *CancellationPolicy) RefundPercent(checkIn, cancelDate time.Time) int {
+	checkIn = truncate_to_day(checkIn)
+	cancelDate = truncate_to_day(cancelDate)
+
+	if !cancelDate.Before(checkIn) {
+		return 0
+	}
+
+	daysBefore := int(checkIn.Sub(cancelDate).Hours() / 24)
+	for _, tier := range p.Tiers {
+		if daysBefore >= tier.DaysBefore {
+			return tier.RefundPercent
+		}
+	}
+
+	return 0
+}
+
+// CalculateRefund returns how much of totalPrice goes back to the guest
+func (p *CancellationPolicy) CalculateRefund(totalPrice float64, checkIn, cancelDate time.Time) float64 {
+	percent := p.RefundPercent(checkIn, cancelDate)
+	return math.Round(totalPrice*float64(percent)) / 100
+}
+
+// Describe returns one human readable line per tier for the property page
+func (p *CancellationPolicy) Describe() []string {
+	var lines []string
+	for _, tier := range p.Tiers {
+		switch {
+		case tier.DaysBefore == 0:
+			lines = append(lines, fmt.Sprintf("%d%% refund for cancellations before check-in", tier.RefundPercent))
+		case tier.DaysBefore == 1:
+			lines = append(lines, fmt.Sprintf("%d%% refund for cancellations at least 1 day before check-in", tier.RefundPercent))
+		default:
+			lines = append(lines, fmt.Sprintf("%d%% refund for cancellations at least %d days before check-in", tier.RefundPercent, tier.DaysBefore))
+		}
+	}
+	lines = append(lines, "No refund for later cancellations")
+	return lines
+}
+
+func truncate_to_day(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+func get_listing_cancellation_policy(listingID int) *CancellationPolicy {
+	query := `SELECT COALESCE(cancellation_policy, ''), COALESCE(cancellation_tiers, '') FROM Posts WHERE id = ?`
+
+	var name, tiers string
+	err := db.QueryRow(query, listingID).Scan(&name, &tiers)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("Error querying cancellation policy: %v", err)
+	}
+
+	policy, err := get_cancellation_policy(name, tiers)
+	if err != nil {
+		log.Printf("Invalid cancellation policy for listing %d: %v", listingID, err)
+		policy, _ = get_cancellation_policy(DEFAULT_CANCELLATION_POLICY, "")
+	}
+
+	return policy
+}
+
+func update_listing_cancellation_policy(listingID int, name, customTiers string) error {
+	policy, err := get_cancellation_policy(name, customTiers)
+	if err != nil {
+		return err
+	}
+
+	tiers := ""
+	if policy.Name == "custom" {
+		tiers = format_cancellation_tiers(policy.Tiers)
+	}
+
+	query := "UPDATE Posts SET cancellation_policy = ?, cancellation_tiers = ? WHERE id = ?"
+	_, err = db.Exec(query, policy.Name, tiers, listingID)
+	if err != nil {
+		log.Printf("Error updating cancellation policy: %v", err)
+		return err
+	}
+
+	log.Printf("Cancellation policy for listing %d set to %s", listingID, policy.Name)
+	return nil
+}
+
+// get_booking_cancellation_policy returns the policy snapshotted on the booking
+// together with its check-in date and total
+func get_booking_cancellation_policy(bookingID int) (*CancellationPolicy, time.Time, float64, error) {
+	query := `SELECT start_date, total_price, COALESCE(cancellation_policy, ''), COALESCE(cancellation_tiers, '')
+			  FROM Bookings WHERE id = ?`
+
+	var checkIn time.Time
+	var total float64
+	var name, tiers string
+	err := db.QueryRow(query, bookingID).Scan(&checkIn, &total, &name, &tiers)
+	if err != nil {
+		return nil, checkIn, 0, err
+	}
+
+	policy, err := get_cancellation_policy(name, tiers)
+	if err != nil {
+		return nil, checkIn, 0, err
+	}
+
+	return policy, checkIn, total, nil
+}
+
+// get_booking_parties returns the guest and the host of a booking
+func get_booking_parties(bookingID int) (int, int, error) {
+	var guestID, hostID int
+	err := db.QueryRow(`SELECT user_id, host_id FROM Bookings WHERE id = ?`, bookingID).Scan(&guestID, &hostID)
+	return guestID, hostID, err
+}
+
+func preview_booking_refund(bookingID int) (float64, error) {
+	policy, checkIn, total, err := get_booking_cancellation_policy(bookingID)
+	if err != nil {
+		return 0, err
+	}
+	return policy.CalculateRefund(total, checkIn, time.Now()), nil
+}
+
+// cancel_booking cancels a booking on behalf of the guest or the host, up to
+// check-in. A guest is refunded according to the snapshotted policy, a host
+// cancellation always refunds the guest in full.
+func cancel_booking(bookingID, userID int) (float64, error) {
+	var guestID, hostID int
+	var status, currency string
+	query := `SELECT user_id, host_id, COALESCE(status, 'confirmed'), currency FROM Bookings WHERE id = ?`
+	err := db.QueryRow(query, bookingID).Scan(&guestID, &hostID, &status, &currency)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return 0, fmt.Errorf("booking not found")
+		}
+		return 0, err
+	}
+
+	if userID != guestID && userID != hostID {
+		return 0, fmt.Errorf("you are not part of this booking")
+	}
+	if status == "cancelled" {
+		return 0, fmt.Errorf("booking is already cancelled")
+	}
+	if status == "completed" {
+		return 0, fmt.Errorf("completed stays cannot be cancelled")
+	}
+
+	policy, checkIn, total, err := get_booking_cancellation_policy(bookingID)
+	if err != nil {
+		return 0, err
+	}
+
+	if !time.Now().Before(checkIn) {
+		return 0, fmt.Errorf("stays that already started cannot be cancelled")
+	}
+
+	refund := total
+	if userID == guestID {
+		refund = policy.CalculateRefund(total, checkIn, time.Now())
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	updateQuery := `UPDATE Bookings SET status = 'cancelled', cancelled_at = NOW(), cancelled_by = ?, refund_amount = ?
+					WHERE id = ? AND COALESCE(status, 'confirmed') NOT IN ('cancelled', 'completed')`
+	result, err := tx.Exec(updateQuery, userID, refund, bookingID)
+	if err != nil {
+		log.Printf("Error cancelling booking: %v", err)
+		return 0, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if rowsAffected == 0 {
+		return 0, fmt.Errorf("booking can no longer be cancelled")
+	}
+
+	// Both sides hear about a cancellation
+	emailData, err := booking_email_data(tx, bookingID)
+	if err != nil {
+		return 0, err
+	}
+	emailData["Refund"] = fmt.Sprintf("%.2f", refund)
+	emailData["CancelledBy"] = "host"
+	if userID == guestID {
+		emailData["CancelledBy"] = "guest"
+	}
+	for _, recipient := range []int{guestID, hostID} {
+		if err := enqueue_email(tx, recipient, EMAIL_BOOKING_CANCELLED, emailData); err != nil {
+			log.Printf("Error queueing cancellation email: %v", err)
+			return 0, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	log.Printf("Booking %d cancelled by user %d, refund %.2f", bookingID, userID, refund)
+
+	link := fmt.Sprintf("/bookings/%d", bookingID)
+	if userID == guestID {
+		notify(hostID, NOTIFICATION_BOOKING_CANCELLED, "Booking cancelled",
+			fmt.Sprintf("The guest cancelled booking #%d", bookingID), link)
+	} else {
+		notify(guestID, NOTIFICATION_BOOKING_CANCELLED, "Booking cancelled",
+			fmt.Sprintf("Your host cancelled booking #%d, you'll be refunded %s", bookingID, format_money(refund, currency)), link)
+	}
+
+	return refund, nil
+}
+
+func cancel_booking_handler(w http.ResponseWriter, r *http.Request) {
+	authenticated, userID := is_authenticated(r)
+	if !authenticated {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	bookingIDStr := r.FormValue("booking_id")
+	if bookingIDStr == "" {
+		http.Error(w, "Booking ID is required", http.StatusBadRequest)
+		return
+	}
+
+	bookingID, err := strconv.Atoi(bookingIDStr)
+	if err != nil {
+		http.Error(w, "Invalid booking ID", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		// Refund preview shown to the guest before confirming, only to the
+		// guest and the host
+		guestID, hostID, err := get_booking_parties(bookingID)
+		if err != nil || (userID != guestID && userID != hostID) {
+			http.Error(w, "Booking not found", http.StatusNotFound)
+			return
+		}
+		refund, err := preview_booking_refund(bookingID)
+		if err != nil {
+			http.Error(w, "Booking not found", http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(fmt.Sprintf("%.2f", refund)))
+
+	case http.MethodPost:
+		refund, err := cancel_booking(bookingID, userID)
+		if err != nil {
+			http.Error(w, "Error cancelling booking: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		currency := BASE_CURRENCY
+		if err := db.QueryRow(`SELECT currency FROM Bookings WHERE id = ?`, bookingID).Scan(&currency); err != nil {
+			log.Printf("Error reading booking currency: %v", err)
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("Booking cancelled, refund: " + format_money(refund, currency)))
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func update_tables_for_cancellation() {
+	alterQueries := []string{
+		`ALTER TABLE Posts ADD COLUMN cancellation_policy ENUM('flexible', 'moderate', 'strict', 'custom') NOT NULL DEFAULT 'moderate'`,
+		`ALTER TABLE Posts ADD COLUMN cancellation_tiers VARCHAR(255) NULL`,
+		`ALTER TABLE Bookings ADD COLUMN status ENUM('confirmed', 'cancelled', 'completed') NOT NULL DEFAULT 'confirmed'`,
+		`ALTER TABLE Bookings ADD COLUMN cancellation_policy VARCHAR(20) NULL`,
+		`ALTER TABLE Bookings ADD COLUMN cancellation_tiers VARCHAR(255) NULL`,
+		`ALTER TABLE Bookings ADD COLUMN cancelled_at DATETIME NULL`,
+		`ALTER TABLE Bookings ADD COLUMN cancelled_by INT NULL`,
+		`ALTER TABLE Bookings ADD COLUMN refund_amount DECIMAL(10, 2) NULL`,
+	}
+
+	for _, query := range alterQueries {
+		_, err := db.Exec(query)
+		if err != nil {
+			log.Printf("Note: column might already exist: %v", err)
+		}
+	}
+
+	log.Println("Tables updated for cancellation policies")
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Limits of the capacity fields of the listing forms
+const (
+	MAX_LISTING_GUESTS = 16
+	MAX_LISTING_ROOMS  = 50
+	MAX_BEDS_PER_TYPE  = 20
+)
+
+// BedType is a kind of bed hosts can list. Key names it in forms and in the
+// ListingBeds table.
+type BedType struct {
+	Key   string
+	Label string
+}
+
+var bed_types = []BedType{
+	{"king", "King bed"},
+	{"queen", "Queen bed"},
+	{"double", "Double bed"},
+	{"single", "Single bed"},
+	{"sofa_bed", "Sofa bed"},
+	{"bunk_bed", "Bunk bed"},
+	{"crib", "Crib"},
+}
+
+// Minimum bedrooms, beds and bathrooms offered by the search filters
+var search_room_options = []int{1, 2, 3, 4, 5}
+
+// ListingBed is how many beds of one type a listing has
+type ListingBed struct {
+	Type  string
+	Label string
+	Count int
+}
+
+// ListingCapacity is who and what a listing sleeps, as entered by the host
+type ListingCapacity struct {
+	MaxGuests int
+	Bedrooms  int
+	Bathrooms float64
+	Beds      []ListingBed
+}
+
+// TotalBeds counts the beds of every type
+func (c ListingCapacity) TotalBeds() int {
+	total := 0
+	for _, bed := range c.Beds {
+		total += bed.Count
+	}
+	return total
+}
+
+func plural(count int, singular, pluralForm string) string {
+	if count == 1 {
+		return "1 " + singular
+	}
+	return fmt.Sprintf("%d %s", count, pluralForm)
+}
+
+// CapacitySummary lists guests, bedrooms, beds and bathrooms for the
+// property page, e.g. "4 guests", "Studio", "3 beds", "1.5 bathrooms"
+func (l Listing) CapacitySummary() []string {
+	parts := []string{plural(l.MaxGuests, "guest", "guests")}
+	if l.Bedrooms == 0 {
+		parts = append(parts, "Studio")
+	} else {
+		parts = append(parts, plural(l.Bedrooms, "bedroom", "bedrooms"))
+	}
+	parts = append(parts, plural(l.Beds, "bed", "beds"))
+	if l.Bathrooms == 1 {
+		parts = append(parts, "1 bathroom")
+	} else {
+		parts = append(parts, strconv.FormatFloat(l.Bathrooms, 'f', -1, 64)+" bathrooms")
+	}
+	return parts
+}
+
+// GuestOptions are the guest counts the booking form offers
+func (l Listing) GuestOptions() []int {
+	options := make([]int, max(l.MaxGuests, 1))
+	for i := range options {
+		options[i] = i + 1
+	}
+	return options
+}
+
+// BedCount is how many beds of a type the listing has. BedTypes must have
+// been loaded.
+func (l Listing) BedCount(bedType string) int {
+	for _, bed := range l.BedTypes {
+		if bed.Type == bedType {
+			return bed.Count
+		}
+	}
+	return 0
+}
+
+// get_listing_beds returns the beds of a listing, in bed_types order
+func get_listing_beds(listingID int) []ListingBed {
+	rows, err := db.Query(`SELECT bed_type, quantity FROM ListingBeds WHERE post_id = ? AND quantity > 0`, listingID)
+	if err != nil {
+		log.Printf("Error fetching beds of listing %d: %v", listingID, err)
+		return nil
+	}
+	defer rows.Close()
+
+	counts := map[string]int{}
+	for rows.Next() {
+		var bedType string
+		var count int
+		if err := rows.Scan(&bedType, &count); err == nil {
+			counts[bedType] = count
+		}
+	}
+
+	var beds []ListingBed
+	for _, bedType := range bed_types {
+		if counts[bedType.Key] > 0 {
+			beds = append(beds, ListingBed{Type: bedType.Key, Label: bedType.Label, Count: counts[bedType.Key]})
+		}
+	}
+	return beds
+}
+
+// parse_capacity_form reads and validates the capacity fields of the listing
+// forms: max_guests, bedrooms, bathrooms and a bed_<type> count per bed type
+func parse_capacity_form(r *http.Request) (ListingCapacity, error) {
+	var capacity ListingCapacity
+
+	maxGuests, err := strconv.Atoi(r.FormValue("max_guests"))
+	if err != nil || maxGuests < 1 || maxGuests > MAX_LISTING_GUESTS {
+		return capacity, fmt.Errorf("guests must be between 1 and %d", MAX_LISTING_GUESTS)
+	}
+	capacity.MaxGuests = maxGuests
+
+	bedrooms, err := strconv.Atoi(r.FormValue("bedrooms"))
+	if err != nil || bedrooms < 0 || bedrooms > MAX_LISTING_ROOMS {
+		return capacity, fmt.Errorf("bedrooms must be between 0 and %d", MAX_LISTING_ROOMS)
+	}
+	capacity.Bedrooms = bedrooms
+
+	// Half bathrooms have a toilet but no shower
+	bathrooms, err := strconv.ParseFloat(r.FormValue("bathrooms"), 64)
+	if err != nil || bathrooms < 0 || bathrooms > MAX_LISTING_ROOMS || bathrooms*2 != math.Floor(bathrooms*2) {
+		return capacity, fmt.Errorf("bathrooms must be between 0 and %d, in halves", MAX_LISTING_ROOMS)
+	}
+	capacity.Bathrooms = bathrooms
+
+	for _, bedType := range bed_types {
+		value := strings.TrimSpace(r.FormValue("bed_" + bedType.Key))
+		if value == "" {
+			continue
+		}
+		count, err := strconv.Atoi(value)
+		if err != nil || count < 0 || count > MAX_BEDS_PER_TYPE {
+			return capacity, fmt.Errorf("%s count must be between 0 and %d", strings.ToLower(bedType.Label), MAX_BEDS_PER_TYPE)
+		}
+		if count > 0 {
+			capacity.Beds = append(capacity.Beds, ListingBed{Type: bedType.Key, Label: bedType.Label, Count: count})
+		}
+	}
+	if capacity.TotalBeds() == 0 {
+		return capacity, fmt.Errorf("add at least one bed")
+	}
+
+	return capacity, nil
+}
+
+// set_listing_capacity saves the capacity of a listing and replaces its beds,
+// in the transaction that writes the listing. Posts.beds keeps the total for
+// search.
+func set_listing_capacity(tx *sql.Tx, listingID int, capacity ListingCapacity) error {
+	_, err := tx.Exec(`UPDATE Posts SET max_guests = ?, bedrooms = ?, beds = ?, bathrooms = ? WHERE id = ?`,
+		capacity.MaxGuests, capacity.Bedrooms, capacity.TotalBeds(), capacity.Bathrooms, listingID)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM ListingBeds WHERE post_id = ?`, listingID); err != nil {
+		return err
+	}
+	for _, bed := range capacity.Beds {
+		_, err := tx.Exec(`INSERT INTO ListingBeds (post_id, bed_type, quantity) VALUES (?, ?, ?)`,
+			listingID, bed.Type, bed.Count)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func update_tables_for_capacity() {
+	// Existing listings get what the property page showed for every listing
+	// until now: 2 guests, 1 bedroom, 1 bed and 1 bathroom
+	columns := []string{
+		`ALTER TABLE Posts ADD COLUMN max_guests INT NOT NULL DEFAULT 2`,
+		`ALTER TABLE Posts ADD COLUMN bedrooms INT NOT NULL DEFAULT 1`,
+		`ALTER TABLE Posts ADD COLUMN beds INT NOT NULL DEFAULT 1`,
+		`ALTER TABLE Posts ADD COLUMN bathrooms DECIMAL(3,1) NOT NULL DEFAULT 1`,
+	}
+	for i, query := range columns {
+		if _, err := db.Exec(query); err != nil {
+			log.Printf("Note: column might already exist: %v", err)
+			continue
+		}
+		if i == 0 {
+			// Listings already booked for more guests keep taking that many
+			_, err := db.Exec(`UPDATE Posts p
+				JOIN (SELECT post_id, MAX(guests) AS guests FROM Bookings GROUP BY post_id) b ON b.post_id = p.id
+				SET p.max_guests = LEAST(GREATEST(p.max_guests, b.guests), ?)`, MAX_LISTING_GUESTS)
+			if err != nil {
+				log.Printf("Error backfilling max guests: %v", err)
+			}
+		}
+	}
+
+	_, err := db.Exec(`ALTER TABLE Posts ADD INDEX idx_posts_capacity (max_guests, bedrooms, beds)`)
+	if err != nil {
+		log.Printf("Note: index might already exist: %v", err)
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS ListingBeds (
+		post_id INT NOT NULL,
+		bed_type VARCHAR(20) NOT NULL,
+		quantity INT NOT NULL,
+		PRIMARY KEY (post_id, bed_type),
+		FOREIGN KEY (post_id) REFERENCES Posts(id) ON DELETE CASCADE
+	)`)
+	if err != nil {
+		log.Printf("Error creating ListingBeds table: %v", err)
+	}
+
+	log.Println("Tables updated for listing capacity")
+}
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const BASE_CURRENCY = "USD"
+const EXCHANGE_RATES_FILE = "data/exchange_rates.json"
+
+var currency_symbols = map[string]string{
+	"USD": "$",
+	"EUR": "€",
+	"GBP": "£",
+	"JPY": "¥",
+	"AED": "AED ",
+	"IDR": "Rp ",
+}
+
+// country_currencies are the local currencies of listing countries, used to
+// price listings created before listings had a currency
+var country_currencies = map[string]string{
+	"UK":             "GBP",
+	"United Kingdom": "GBP",
+	"France":         "EUR",
+	"Germany":        "EUR",
+	"Italy":          "EUR",
+	"Spain":          "EUR",
+	"Netherlands":    "EUR",
+	"Austria":        "EUR",
+	"Belgium":        "EUR",
+	"Portugal":       "EUR",
+	"Greece":         "EUR",
+	"Japan":          "JPY",
+	"UAE":            "AED",
+	"Indonesia":      "IDR",
+}
+
+// RatesFile is the format of both the bundled rates file and the rates
+// service response. Rates are units of each currency per one unit of Base.
+type RatesFile struct {
+	Base  string             `json:"base"`
+	Rates map[string]float64 `json:"rates"`
+}
+
+// RateSource provides the latest exchange rates
+type RateSource interface {
+	FetchRates() (map[string]float64, error)
+}
+
+// FileRateSource reads rates from a JSON file on disk
+type FileRateSource struct {
+	Path string
+}
+
+func (s FileRateSource) FetchRates() (map[string]float64, error) {
+	content, err := os.ReadFile(s.Path)
+	if err != nil {
+		return nil, err
+	}
+	return parse_rates(content)
+}
+
+// HTTPRateSource fetches rates from a service returning the RatesFile format
+type HTTPRateSource struct {
+	URL string
+}
+
+func (s HTTPRateSource) FetchRates() (map[string]float64, error) {
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(s.URL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("rates service returned %s", resp.Status)
+	}
+
+	var file RatesFile
+	if err := json.NewDecoder(resp.Body).Decode(&file); err != nil {
+		return nil, err
+	}
+	return normalize_rates(file)
+}
+
+func parse_rates(content []byte) (map[string]float64, error) {
+	var file RatesFile
+	if err := json.Unmarshal(content, &file); err != nil {
+		return nil, err
+	}
+	return normalize_rates(file)
+}
+
+// normalize_rates rebases the rates on BASE_CURRENCY
+func normalize_rates(file RatesFile) (map[string]float64, error) {
+	base := strings.ToUpper(file.Base)
+	if base == "" {
+		base = BASE_CURRENCY
+	}
+
+	usdRate, ok := file.Rates[BASE_CURRENCY]
+	if !ok {
+		if base != BASE_CURRENCY {
+			return nil, fmt.Errorf("rates do not include %s", BASE_CURRENCY)
+		}
+		usdRate = 1
+	}
+
+	rates := make(map[string]float64)
+	for code, rate := range file.Rates {
+		if rate <= 0 {
+			return nil, fmt.Errorf("invalid rate for %s", code)
+		}
+		rates[strings.ToUpper(code)] = rate / usdRate
+	}
+	rates[BASE_CURRENCY] = 1
+
+	return rates, nil
+}
+
+// get_rate_source picks the rates service when EXCHANGE_RATES_URL is set and
+// falls back to the bundled file otherwise
+func get_rate_source() RateSource {
+	if url := os.Getenv("EXCHANGE_RATES_URL"); url != "" {
+		return HTTPRateSource{URL: url}
+	}
+	return FileRateSource{Path: EXCHANGE_RATES_FILE}
+}
+
+var (
+	rates_mutex sync.RWMutex
+	rates_cache = map[string]float64{BASE_CURRENCY: 1}
+)
+
+// load_exchange_rates stores the rates from source in the ExchangeRates table
+// and refreshes the in-memory cache
+func load_exchange_rates(source RateSource) error {
+	rates, err := source.FetchRates()
+	if err != nil {
+		log.Printf("Error fetching exchange rates: %v", err)
+		return err
+	}
+
+	query := `INSERT INTO ExchangeRates (currency, rate, updated_at) VALUES (?, ?, NOW())
+			  ON DUPLICATE KEY UPDATE rate = VALUES(rate), updated_at = NOW()`
+	for code, rate := range rates {
+		_, err := db.Exec(query, code, rate)
+		if err != nil {
+			log.Printf("Error saving exchange rate for %s: %v", code, err)
+			return err
+		}
+	}
+
+	return refresh_exchange_rates()
+}
+
+func refresh_exchange_rates() error {
+	rows, err := db.Query("SELECT currency, rate FROM ExchangeRates")
+	if err != nil {
+		log.Printf("Error querying exchange rates: %v", err)
+		return err
+	}
+	defer rows.Close()
+
+	rates := map[string]float64{BASE_CURRENCY: 1}
+	for rows.Next() {
+		var code string
+		var rate float64
+		if err := rows.Scan(&code, &rate); err != nil {
+			log.Printf("Error scanning exchange rate: %v", err)
+			continue
+		}
+		rates[code] = rate
+	}
+
+	rates_mutex.Lock()
+	rates_cache = rates
+	rates_mutex.Unlock()
+
+	log.Printf("Loaded %d exchange rates", len(rates))
+	return nil
+}
+
+func get_supported_currencies() []string {
+	rates_mutex.RLock()
+	defer rates_mutex.RUnlock()
+
+	currencies := make([]string, 0, len(rates_cache))
+	for code := range rates_cache {
+		currencies = append(currencies, code)
+	}
+	sort.Strings(currencies)
+	return currencies
+}
+
+func is_supported_currency(code string) bool {
+	rates_mutex.RLock()
+	defer rates_mutex.RUnlock()
+
+	_, ok := rates_cache[code]
+	return ok
+}
+
+// get_exchange_rate returns how many units of "to" one unit of "from" buys
+func get_exchange_rate(from, to string) (float64, error) {
+	if from == to {
+		return 1, nil
+	}
+
+	rates_mutex.RLock()
+	defer rates_mutex.RUnlock()
+
+	fromRate, ok := rates_cache[from]
+	if !ok {
+		return 0, fmt.Errorf("unsupported currency: %s", from)
+	}
+	toRate, ok := rates_cache[to]
+	if !ok {
+		return 0, fmt.Errorf("unsupported currency: %s", to)
+	}
+
+	return toRate / fromRate, nil
+}
+
+// convert_amount converts amount between currencies, rounding to cents, and
+// returns the rate that was applied
+func convert_amount(amount float64, from, to string) (float64, float64, error) {
+	rate, err := get_exchange_rate(from, to)
+	if err != nil {
+		return 0, 0, err
+	}
+	return round_money(amount * rate), rate, nil
+}
+
+func round_money(amount float64) float64 {
+	return math.Round(amount*100) / 100
+}
+
+func currency_symbol(code string) string {
+	if symbol, ok := currency_symbols[code]; ok {
+		return symbol
+	}
+	return code + " "
+}
+
+func format_money(amount float64, code string) string {
+	return fmt.Sprintf("%s%.2f", currency_symbol(code), amount)
+}
+
+// apply_display_currency fills DisplayPrice and DisplayCurrency on each listing
+func apply_display_currency(listings []Listing, currency string) {
+	for i := range listings {
+		set_listing_display_price(&listings[i], currency)
+	}
+}
+
+func set_listing_display_price(listing *Listing, currency string) {
+	price, _, err := convert_amount(listing.Price, listing.Currency, currency)
+	if err != nil {
+		// Fall back to the listing's own currency
+		listing.DisplayPrice = listing.Price
+		listing.DisplayCurrency = listing.Currency
+		listing.DisplaySymbol = currency_symbol(listing.Currency)
+		return
+	}
+	listing.DisplayPrice = price
+	listing.DisplayCurrency = currency
+	listing.DisplaySymbol = currency_symbol(currency)
+}
+
+// get_display_currency returns the currency chosen by the guest, stored in the session
+func get_display_currency(r *http.Request) string {
+	session, _ := store.Get(r, "cookie-name")
+
+	currency, ok := session.Values["currency"].(string)
+	if !ok || !is_supported_currency(currency) {
+		return BASE_CURRENCY
+	}
+	return currency
+}
+
+func set_currency_handler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	currency := strings.ToUpper(r.FormValue("currency"))
+	if !is_supported_currency(currency) {
+		http.Error(w, "Unsupported currency", http.StatusBadRequest)
+		return
+	}
+
+	session, _ := store.Get(r, "cookie-name")
+	session.Values["currency"] = currency
+	err := session.Save(r, w)
+	if err != nil {
+		log.Println("Error saving session:", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, local_redirect_path(r, "/listings"), http.StatusSeeOther)
+}
+
+// local_redirect_path returns the path and query of the page that sent the
+// request when it is on this site, so a forged Referer can't send the user
+// elsewhere
+func local_redirect_path(r *http.Request, fallback string) string {
+	referer, err := url.Parse(r.Referer())
+	if err != nil || referer.Host != r.Host || (referer.Scheme != "http" && referer.Scheme != "https") {
+		return fallback
+	}
+	path := referer.EscapedPath()
+	if !strings.HasPrefix(path, "/") || strings.HasPrefix(path, "//") || strings.HasPrefix(path, "/\\") {
+		return fallback
+	}
+	if referer.RawQuery != "" {
+		path += "?" + referer.RawQuery
+	}
+	return path
+}
+
+// exchange_rates_handler serves the current rates in the RatesFile format. It
+// doubles as the local stand-in for an external rates service.
+func exchange_rates_handler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	rates_mutex.RLock()
+	file := RatesFile{Base: BASE_CURRENCY, Rates: make(map[string]float64, len(rates_cache))}
+	for code, rate := range rates_cache {
+		file.Rates[code] = rate
+	}
+	rates_mutex.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(file)
+}
+
+func update_tables_for_currency() {
+	createRates := `CREATE TABLE IF NOT EXISTS ExchangeRates (
+		currency CHAR(3) PRIMARY KEY,
+		rate DECIMAL(18, 8) NOT NULL,
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	)`
+	_, err := db.Exec(createRates)
+	if err != nil {
+		log.Printf("Error creating ExchangeRates table: %v", err)
+	}
+
+	alterQueries := []string{
+		`ALTER TABLE Posts ADD COLUMN currency CHAR(3) NOT NULL DEFAULT 'USD'`,
+		`ALTER TABLE Bookings ADD COLUMN currency CHAR(3) NOT NULL DEFAULT 'USD'`,
+		`ALTER TABLE Bookings ADD COLUMN display_currency CHAR(3) NOT NULL DEFAULT 'USD'`,
+		`ALTER TABLE Bookings ADD COLUMN exchange_rate DECIMAL(18, 8) NOT NULL DEFAULT 1`,
+	}
+
+	for i, query := range alterQueries {
+		_, err := db.Exec(query)
+		if err != nil {
+			log.Printf("Note: column might already exist: %v", err)
+			continue
+		}
+		if i == 0 {
+			migrate_listing_currencies()
+		}
+	}
+
+	log.Println("Tables updated for multi-currency support")
+}
+
+// migrate_listing_currencies moves listings that were priced in dollars to the
+// currency of their country. Prices are converted with the bundled rates so
+// guests keep paying the same.
+func migrate_listing_currencies() {
+	rates, err := FileRateSource{Path: EXCHANGE_RATES_FILE}.FetchRates()
+	if err != nil {
+		log.Printf("Error reading exchange rates, listings stay in %s: %v", BASE_CURRENCY, err)
+		return
+	}
+
+	for country, currency := range country_currencies {
+		rate, ok := rates[currency]
+		if !ok {
+			continue
+		}
+		_, err := db.Exec(`UPDATE Posts SET currency = ?, price = ROUND(price * ?, 2) WHERE country = ? AND currency = ?`,
+			currency, rate, country, BASE_CURRENCY)
+		if err != nil {
+			log.Printf("Error moving %s listings to %s: %v", country, currency, err)
+		}
+	}
+}
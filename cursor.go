@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Offset pages only reach this deep, further results need a cursor
+const SEARCH_RESULT_WINDOW = 1000
+
+// Counts stop here, larger result sets report an approximate total
+const SEARCH_COUNT_LIMIT = 1000
+
+const SEARCH_COUNT_CACHE_TTL = time.Minute
+
+const MAX_API_PAGE_SIZE = 50
+
+// SortColumn is one key of a search's sort order. Every order ends with
+// p.id so rows never tie and a cursor can resume after any of them.
+type SortColumn struct {
+	Expr string
+	Args []interface{}
+	Desc bool
+}
+
+// keyset_condition matches the rows sorted after the row whose sort keys are
+// values: (a, b, id) > (x, y, z) spelled out for mixed directions
+func keyset_condition(columns []SortColumn, values []interface{}) (string, []interface{}) {
+	var alternatives []string
+	var args []interface{}
+	for i, column := range columns {
+		var parts []string
+		for j := 0; j < i; j++ {
+			parts = append(parts, columns[j].Expr+" = ?")
+			args = append(args, columns[j].Args...)
+			args = append(args, values[j])
+		}
+		operator := ">"
+		if column.Desc {
+			operator = "<"
+		}
+		parts = append(parts, column.Expr+" "+operator+" ?")
+		args = append(args, column.Args...)
+		args = append(args, values[i])
+		alternatives = append(alternatives, "("+strings.Join(parts, " AND ")+")")
+	}
+	return "(" + strings.Join(alternatives, " OR ") + ")", args
+}
+
+// Cursors are signed with CURSOR_SECRET. Without it each process signs with
+// a random key of its own, so cursors stop working across restarts.
+var cursor_secret_key = load_cursor_secret()
+
+func load_cursor_secret() []byte {
+	if secret := os.Getenv("CURSOR_SECRET"); secret != "" {
+		return []byte(secret)
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		log.Fatalf("Error generating cursor secret: %v", err)
+	}
+	log.Println("CURSOR_SECRET is not set, search cursors are signed with a random key")
+	return secret
+}
+
+func cursor_secret() []byte {
+	return cursor_secret_key
+}
+
+// search_fingerprint identifies the filters and sort of a search, so a cursor
+// can't be replayed against another one
+func search_fingerprint(params SearchParams) string {
+	sum := sha256.Sum256([]byte(buildPaginationQuery(params) + "&currency=" + params.Currency))
+	return hex.EncodeToString(sum[:8])
+}
+
+type searchCursor struct {
+	Search string        `json:"s"`
+	Keys   []interface{} `json:"k"`
+}
+
+// encode_search_cursor signs the sort keys of the last row of a page. Times
+// and decimals are sent back to MySQL as strings.
+func encode_search_cursor(params SearchParams, keys []interface{}) string {
+	values := make([]interface{}, len(keys))
+	for i, value := range keys {
+		switch v := value.(type) {
+		case []byte:
+			values[i] = string(v)
+		case time.Time:
+			values[i] = v.Format("2006-01-02 15:04:05.999999")
+		default:
+			values[i] = v
+		}
+	}
+
+	payload, err := json.Marshal(searchCursor{Search: search_fingerprint(params), Keys: values})
+	if err != nil {
+		log.Printf("Error encoding search cursor: %v", err)
+		return ""
+	}
+
+	mac := hmac.New(sha256.New, cursor_secret())
+	mac.Write(payload)
+	return base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// decode_search_cursor checks a cursor's signature and that it belongs to the
+// same search, and returns its sort keys
+func decode_search_cursor(params SearchParams, token string) ([]interface{}, error) {
+	encodedPayload, encodedMAC, found := strings.Cut(token, ".")
+	if !found {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encodedPayload)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(encodedMAC)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+
+	mac := hmac.New(sha256.New, cursor_secret())
+	mac.Write(payload)
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+
+	var cursor searchCursor
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.UseNumber()
+	if err := decoder.Decode(&cursor); err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	if cursor.Search != search_fingerprint(params) {
+		return nil, fmt.Errorf("cursor belongs to another search")
+	}
+	if len(cursor.Keys) != len(search_sort_columns(params, SearchFilters{})) {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+
+	for i, value := range cursor.Keys {
+		if number, ok := value.(json.Number); ok {
+			cursor.Keys[i] = number.String()
+		}
+	}
+	return cursor.Keys, nil
+}
+
+var (
+	search_count_mutex sync.Mutex
+	search_count_cache = map[string]searchCount{}
+)
+
+type searchCount struct {
+	total       int
+	approximate bool
+	countedAt   time.Time
+}
+
+// count_search_results counts the results of the filters up to
+// SEARCH_COUNT_LIMIT. Counts are cached briefly as every page, scroll and
+// facet change of a search asks for the same total.
+func count_search_results(filters SearchFilters) (int, bool, error) {
+	cacheKey := filters.Joins + "|" + filters.Where + "|" + fmt.Sprint(filters.Args...)
+
+	search_count_mutex.Lock()
+	cached, ok := search_count_cache[cacheKey]
+	search_count_mutex.Unlock()
+	if ok && time.Since(cached.countedAt) < SEARCH_COUNT_CACHE_TTL {
+		return cached.total, cached.approximate, nil
+	}
+
+	query := fmt.Sprintf(`SELECT COUNT(*) FROM (
+			SELECT DISTINCT p.id FROM Posts p %s WHERE %s LIMIT ?
+		) counted`, filters.Joins, filters.Where)
+
+	var total int
+	err := db.QueryRow(query, append(append([]interface{}{}, filters.Args...), SEARCH_COUNT_LIMIT+1)...).Scan(&total)
+	if err != nil {
+		log.Printf("Error counting listings: %v", err)
+		return 0, false, err
+	}
+
+	approximate := total > SEARCH_COUNT_LIMIT
+	if approximate {
+		total = SEARCH_COUNT_LIMIT
+	}
+
+	search_count_mutex.Lock()
+	// Expired entries are dropped as they are replaced, or all at once when
+	// the cache has grown large
+	if len(search_count_cache) > 1000 {
+		search_count_cache = map[string]searchCount{}
+	}
+	search_count_cache[cacheKey] = searchCount{total, approximate, time.Now()}
+	search_count_mutex.Unlock()
+
+	return total, approximate, nil
+}
+
+// ListingSummary is a listing as returned by the listings API
+type ListingSummary struct {
+	ID             int       `json:"id"`
+	Title          string    `json:"title"`
+	City           string    `json:"city"`
+	Country        string    `json:"country"`
+	Type           string    `json:"type"`
+	ImageURL       string    `json:"image_url"`
+	Price          float64   `json:"price"`
+	Currency       string    `json:"currency"`
+	CurrencySymbol string    `json:"currency_symbol"`
+	Rating         float64   `json:"rating"`
+	ReviewCount    int       `json:"review_count"`
+	InstantBook    bool      `json:"instant_book"`
+	Amenities      []Amenity `json:"amenities"`
+	MaxGuests      int       `json:"max_guests"`
+	Bedrooms       int       `json:"bedrooms"`
+	Beds           int       `json:"beds"`
+	Bathrooms      float64   `json:"bathrooms"`
+	DistanceKm     *float64  `json:"distance_km,omitempty"`
+	URL            string    `json:"url"`
+}
+
+// api_listings_handler pages through search results with a cursor. It takes
+// the /listings query parameters plus cursor and limit, and returns the
+// next_cursor to pass back until it is empty.
+func api_listings_handler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		write_json_error(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	params := parse_search_params(r.URL.Query())
+	params.Currency = get_display_currency(r)
+	if limit, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && limit > 0 {
+		params.Limit = min(limit, MAX_API_PAGE_SIZE)
+	}
+
+	if err := resolve_search_location(&params); err != nil {
+		write_json_error(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if token := r.URL.Query().Get("cursor"); token != "" {
+		keys, err := decode_search_cursor(params, token)
+		if err != nil {
+			write_json_error(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		params.After = keys
+	}
+
+	result, err := search_listings(params)
+	if err != nil {
+		write_json_error(w, http.StatusInternalServerError, "Error searching listings")
+		return
+	}
+	record_listing_events(r, EVENT_IMPRESSION, result.Listings)
+
+	listings := []ListingSummary{}
+	for _, listing := range result.Listings {
+		summary := ListingSummary{
+			ID:             listing.ID,
+			Title:          listing.Title,
+			City:           listing.City,
+			Country:        listing.Country,
+			Type:           listing.Type,
+			ImageURL:       listing.ImageURL,
+			Price:          listing.DisplayPrice,
+			Currency:       listing.DisplayCurrency,
+			CurrencySymbol: listing.DisplaySymbol,
+			Rating:         listing.RatingAvg,
+			ReviewCount:    listing.ReviewCount,
+			InstantBook:    listing.InstantBook,
+			Amenities:      listing.Amenities,
+			MaxGuests:      listing.MaxGuests,
+			Bedrooms:       listing.Bedrooms,
+			Beds:           listing.Beds,
+			Bathrooms:      listing.Bathrooms,
+			URL:            fmt.Sprintf("/property/%d", listing.ID),
+		}
+		if params.Center != nil && listing.HasLocation {
+			distance := listing.DistanceKm
+			summary.DistanceKm = &distance
+		}
+		listings = append(listings, summary)
+	}
+
+	write_json(w, http.StatusOK, map[string]interface{}{
+		"listings":          listings,
+		"next_cursor":       result.NextCursor,
+		"total":             result.TotalResults,
+		"total_approximate": result.TotalApproximate,
+	})
+}
@@ -38,37 +38,85 @@ type Listing struct {
 	Address     string
 	Description string
 	Price       float64
+	Currency    string
 	Type        string
 	ImageURL    string
-	HasWifi     bool
-	HasKitchen  bool
-	HasAC       bool
-	HasParking  bool
+	InstantBook bool
 	CreatedAt   string
+
+	// Active catalogue amenities, in catalogue order
+	Amenities []Amenity
+
+	// Who and what the listing sleeps. Beds is the total of BedTypes, which
+	// is only loaded for a single listing.
+	MaxGuests int
+	Bedrooms  int
+	Beds      int
+	Bathrooms float64
+	BedTypes  []ListingBed
+
+	// Aggregated from the listing's visible reviews
+	RatingAvg   float64
+	ReviewCount int
+
+	// How well the listing matches the searched destination
+	Relevance float64
+
+	// Geocoded from the address, HasLocation is false until it is found
+	Latitude    float64
+	Longitude   float64
+	HasLocation bool
+
+	// Distance from the searched location
+	DistanceKm float64
+
+	// Price converted to the currency chosen by the viewer
+	DisplayPrice    float64
+	DisplayCurrency string
+	DisplaySymbol   string
 }
 
 type SearchParams struct {
-	Destination  string
-	CheckIn      string
-	CheckOut     string
-	Guests       string
-	MinPrice     float64
-	MaxPrice     float64
-	PropertyType string
-	Page         int
-	Limit        int
-
-	Wifi            bool
-	Kitchen         bool
-	AirConditioning bool
-	Parking         bool
-	Pool            bool
-	TV              bool
-	Washer          bool
-	Dryer           bool
-	Heating         bool
-	Balcony         bool
-	PetsAllowed     bool
+	Destination   string
+	Country       string
+	CheckIn       string
+	CheckOut      string
+	Guests        int
+	MinPrice      float64
+	MaxPrice      float64
+	PropertyTypes []string
+	Currency      string
+	Page          int
+	Limit         int
+
+	MinRating   float64
+	InstantBook bool
+
+	// Listings within RadiusKm of Center, which is given directly or
+	// geocoded from Near, and listings inside the map Bounds
+	Near     string
+	Center   *GeoPoint
+	RadiusKm float64
+	Bounds   *GeoBounds
+
+	// Also count the facets of the results
+	WithFacets bool
+
+	// Sort keys of the last listing already seen, decoded from a cursor.
+	// When set, Page is ignored and results continue after that listing.
+	After []interface{}
+
+	// One of search_sort_options, empty means relevance when searching a
+	// destination and newest otherwise
+	Sort string
+
+	// Keys of the amenities every result must have, in catalogue order
+	Amenities []string
+
+	// Rooms and beds the results must have at least
+	MinBedrooms  int
+	MinBeds      int
+	MinBathrooms float64
 }
 
 type ListingsResult struct {
@@ -76,21 +124,15 @@ type ListingsResult struct {
 	TotalResults int
 	TotalPages   int
 	CurrentPage  int
-}
 
-type PropertyAmenities struct {
-	PostID          int
-	Wifi            bool
-	AirConditioning bool
-	Kitchen         bool
-	Parking         bool
-	PetsAllowed     bool
-	Pool            bool
-	Washer          bool
-	Dryer           bool
-	TV              bool
-	Heating         bool
-	Balcony         bool
+	// Only counted when SearchParams.WithFacets is set
+	Facets *SearchFacets
+
+	// Cursor of the following results, empty on the last page
+	NextCursor string
+
+	// TotalResults stops at SEARCH_COUNT_LIMIT
+	TotalApproximate bool
 }
 
 type Review struct {
@@ -101,13 +143,18 @@ type Review struct {
 	Rating    int
 	Comment   string
 	CreatedAt string
+
+	// Public reply from the host, at most one per review
+	HostReply     string
+	HostRepliedAt string
 }
 
 type PropertyDetail struct {
-	Property  *Listing
-	Host      *UserData
-	Amenities *PropertyAmenities
-	Reviews   []Review
+	Property     *Listing
+	Host         *UserData
+	Reviews      []Review
+	Rating       *ListingRating
+	Cancellation *CancellationPolicy
 }
 
 type Booking struct {
@@ -124,12 +171,45 @@ type Booking struct {
 	PropertyTitle string
 	PropertyCity  string
 	UserName      string
+
+	CancellationPolicy string
+	RefundAmount       float64
+
+	// TotalPrice is in the listing currency, DisplayTotal in the guest's
+	// currency converted with ExchangeRate at booking time
+	Currency        string
+	DisplayCurrency string
+	ExchangeRate    float64
+	DisplayTotal    float64
+
+	Subtotal       float64
+	DiscountAmount float64
+	PromotionCode  string
+
+	Nights int
+
+	// Last day the guest can review the stay
+	ReviewClosesAt string
+
+	// Double-blind review state. Reviews stay hidden until both sides have
+	// written theirs or the review window closes.
+	ReviewPublished bool
+	HostReviewed    bool
+	CanReviewGuest  bool
 }
 
-func create_listing(user_id int, title string, country string, city string, address string, description string, price float64, postType string) (int, error) {
-	query := "INSERT INTO Posts (user_id, title, country, city, address, description, price, type) VALUES (?, ?, ?, ?, ?, ?, ?, ?)"
+// create_listing stores a listing and its capacity in one transaction, so a
+// listing never takes bookings with the default capacity
+func create_listing(user_id int, title string, country string, city string, address string, description string, price float64, currency string, postType string, capacity ListingCapacity) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
 
-	result, err := db.Exec(query, user_id, title, country, city, address, description, price, postType)
+	query := "INSERT INTO Posts (user_id, title, country, city, address, description, price, currency, type) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)"
+
+	result, err := tx.Exec(query, user_id, title, country, city, address, description, price, currency, postType)
 	if err != nil {
 		log.Printf("Error creating listing: %v", err)
 		return 0, err
@@ -142,37 +222,112 @@ func create_listing(user_id int, title string, country string, city string, addr
 		return 0, err
 	}
 
+	if err := set_listing_capacity(tx, int(listingID), capacity); err != nil {
+		log.Printf("Error setting capacity: %v", err)
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
 	log.Printf("Listing created successfully with ID: %d", listingID)
 	return int(listingID), nil
 }
 
-func create_booking(postID, userID, hostID, guests int, startDate, endDate string, totalPrice float64) error {
+// create_booking stores a booking for subtotal less discount and returns its ID.
+// When promo is set the redemption is recorded in the same transaction.
+func create_booking(postID, userID, hostID, guests int, startDate, endDate string, subtotal float64, currency, displayCurrency string, exchangeRate float64, promo *Promotion, discount float64) (int, error) {
 	// First check if dates are available
 	available, err := check_availability(postID, startDate, endDate)
 	if err != nil {
-		return err
+		return 0, err
 	}
 	if !available {
-		return fmt.Errorf("dates are not available")
+		return 0, fmt.Errorf("dates are not available")
+	}
+
+	// Snapshot the listing's cancellation policy so later changes don't affect this booking
+	policy := get_listing_cancellation_policy(postID)
+	policyTiers := ""
+	if policy.Name == "custom" {
+		policyTiers = format_cancellation_tiers(policy.Tiers)
+	}
+
+	promotionCode := ""
+	if promo != nil {
+		promotionCode = promo.Code
+	}
+	totalPrice := round_money(subtotal - discount)
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
 	}
+	defer tx.Rollback()
 
-	query := `INSERT INTO Bookings (post_id, user_id, host_id, start_date, end_date, guests, total_price) 
-			  VALUES (?, ?, ?, ?, ?, ?, ?)`
+	query := `INSERT INTO Bookings (post_id, user_id, host_id, start_date, end_date, guests, total_price, 
+			  cancellation_policy, cancellation_tiers, currency, display_currency, exchange_rate,
+			  subtotal, discount_amount, promotion_code) 
+			  VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, NULLIF(?, ''))`
 
-	_, err = db.Exec(query, postID, userID, hostID, startDate, endDate, guests, totalPrice)
+	result, err := tx.Exec(query, postID, userID, hostID, startDate, endDate, guests, totalPrice,
+		policy.Name, policyTiers, currency, displayCurrency, exchangeRate,
+		subtotal, discount, promotionCode)
 	if err != nil {
 		log.Printf("Error creating booking: %v", err)
-		return err
+		return 0, err
 	}
 
-	log.Printf("Booking created successfully for user %d, property %d", userID, postID)
-	return nil
+	bookingID, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	if promo != nil {
+		err = redeem_promotion(tx, promo, int(bookingID), userID, discount, currency)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	// Queue the emails in the same transaction so they only go out if the booking commits
+	emailData, err := booking_email_data(tx, int(bookingID))
+	if err != nil {
+		return 0, err
+	}
+	if err := enqueue_email(tx, userID, EMAIL_BOOKING_CONFIRMATION, emailData); err != nil {
+		log.Printf("Error queueing booking confirmation: %v", err)
+		return 0, err
+	}
+	if err := enqueue_email(tx, hostID, EMAIL_HOST_BOOKING_ALERT, emailData); err != nil {
+		log.Printf("Error queueing host booking alert: %v", err)
+		return 0, err
+	}
+	if err := record_booking_event(tx, postID, userID); err != nil {
+		log.Printf("Error recording booking event: %v", err)
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing booking: %v", err)
+		return 0, err
+	}
+
+	log.Printf("Booking %d created successfully for user %d, property %d", bookingID, userID, postID)
+
+	notify(hostID, NOTIFICATION_NEW_BOOKING, "New booking",
+		fmt.Sprintf("%s to %s for %d guests", startDate, endDate, guests),
+		fmt.Sprintf("/bookings/%d", bookingID))
+
+	return int(bookingID), nil
 }
 
 func check_availability(postID int, startDate, endDate string) (bool, error) {
 	query := `
 		SELECT COUNT(*) FROM Bookings 
 		WHERE post_id = ? 
+		AND COALESCE(status, 'confirmed') != 'cancelled'
 		AND (
 			(start_date <= ? AND end_date > ?) OR
 			(start_date < ? AND end_date >= ?) OR
@@ -189,12 +344,96 @@ func check_availability(postID int, startDate, endDate string) (bool, error) {
 	return count == 0, nil
 }
 
+// get_booked_listings returns which of the listings are booked on some of
+// the nights from startDate to endDate, with the overlap rule of check_availability
+func get_booked_listings(postIDs []int, startDate, endDate string) (map[int]bool, error) {
+	booked := map[int]bool{}
+	if len(postIDs) == 0 {
+		return booked, nil
+	}
+
+	placeholders := make([]string, len(postIDs))
+	args := make([]interface{}, 0, len(postIDs)+6)
+	for i, id := range postIDs {
+		placeholders[i] = "?"
+		args = append(args, id)
+	}
+	args = append(args, startDate, startDate, endDate, endDate, startDate, endDate)
+
+	rows, err := db.Query(`
+		SELECT DISTINCT post_id FROM Bookings
+		WHERE post_id IN (`+strings.Join(placeholders, ", ")+`)
+		AND COALESCE(status, 'confirmed') != 'cancelled'
+		AND (
+			(start_date <= ? AND end_date > ?) OR
+			(start_date < ? AND end_date >= ?) OR
+			(start_date >= ? AND end_date <= ?)
+		)`, args...)
+	if err != nil {
+		log.Printf("Error checking availability: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err == nil {
+			booked[id] = true
+		}
+	}
+	return booked, rows.Err()
+}
+
+func get_booking_by_id(bookingID int) (*Booking, error) {
+	query := `
+		SELECT b.id, b.post_id, b.user_id, b.host_id,
+		       DATE_FORMAT(b.start_date, '%Y-%m-%d'), DATE_FORMAT(b.end_date, '%Y-%m-%d'),
+		       b.guests, b.total_price, b.created_at, p.title, p.city, u.username,
+		       COALESCE(b.status, 'confirmed'), COALESCE(b.cancellation_policy, ''),
+		       COALESCE(b.refund_amount, 0), b.currency, b.display_currency, b.exchange_rate,
+		       COALESCE(b.subtotal, b.total_price), b.discount_amount, COALESCE(b.promotion_code, '')
+		FROM Bookings b
+		JOIN Posts p ON b.post_id = p.id
+		JOIN Users u ON b.user_id = u.id
+		WHERE b.id = ?`
+
+	var booking Booking
+	err := db.QueryRow(query, bookingID).Scan(
+		&booking.ID, &booking.PostID, &booking.UserID, &booking.HostID,
+		&booking.StartDate, &booking.EndDate, &booking.Guests, &booking.TotalPrice,
+		&booking.CreatedAt, &booking.PropertyTitle, &booking.PropertyCity, &booking.UserName,
+		&booking.Status, &booking.CancellationPolicy, &booking.RefundAmount,
+		&booking.Currency, &booking.DisplayCurrency, &booking.ExchangeRate,
+		&booking.Subtotal, &booking.DiscountAmount, &booking.PromotionCode,
+	)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		log.Printf("Error querying booking by ID: %v", err)
+		return nil, err
+	}
+
+	booking.DisplayTotal = round_money(booking.TotalPrice * booking.ExchangeRate)
+
+	start, startErr := time.Parse("2006-01-02", booking.StartDate)
+	end, endErr := time.Parse("2006-01-02", booking.EndDate)
+	if startErr == nil && endErr == nil {
+		booking.Nights = int(end.Sub(start).Hours() / 24)
+	}
+
+	return &booking, nil
+}
+
 func get_user_bookings(userID int) ([]Booking, error) {
 	var bookings []Booking
 
 	query := `
 		SELECT b.id, b.post_id, b.user_id, b.host_id, b.start_date, b.end_date, 
-		       b.guests, b.total_price, b.created_at, p.title, p.city
+		       b.guests, b.total_price, b.created_at, p.title, p.city,
+		       COALESCE(b.status, 'confirmed'), COALESCE(b.cancellation_policy, ''),
+		       COALESCE(b.refund_amount, 0), b.currency, b.display_currency, b.exchange_rate,
+		       COALESCE(b.subtotal, b.total_price), b.discount_amount, COALESCE(b.promotion_code, '')
 		FROM Bookings b
 		JOIN Posts p ON b.post_id = p.id
 		WHERE b.user_id = ?
@@ -213,11 +452,24 @@ func get_user_bookings(userID int) ([]Booking, error) {
 			&booking.ID, &booking.PostID, &booking.UserID, &booking.HostID,
 			&booking.StartDate, &booking.EndDate, &booking.Guests, &booking.TotalPrice,
 			&booking.CreatedAt, &booking.PropertyTitle, &booking.PropertyCity,
+			&booking.Status, &booking.CancellationPolicy, &booking.RefundAmount,
+			&booking.Currency, &booking.DisplayCurrency, &booking.ExchangeRate,
+			&booking.Subtotal, &booking.DiscountAmount, &booking.PromotionCode,
 		)
 		if err != nil {
 			log.Printf("Error scanning booking: %v", err)
 			continue
 		}
+
+		booking.DisplayTotal = round_money(booking.TotalPrice * booking.ExchangeRate)
+
+		// Show what the guest would get back if they cancelled today
+		if booking.Status == "confirmed" {
+			if refund, err := preview_booking_refund(booking.ID); err == nil {
+				booking.RefundAmount = refund
+			}
+		}
+
 		bookings = append(bookings, booking)
 	}
 
@@ -252,15 +504,12 @@ func calculate_booking_price(propertyID int, startDate, endDate string) (float64
 	return totalPrice, nights, nil
 }
 
-func create_amenities(post_id int, wifi, ac, kitchen, parking, pets, pool, washer, dryer, tv, heating, balcony bool) {
-	query := `INSERT INTO Amenities (post_id, wifi, air_conditioning, kitchen, parking, pets_allowed, pool, washer, dryer, tv, heating, balcony) 
-			  VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
-
-	_, err := db.Exec(query, post_id, wifi, ac, kitchen, parking, pets, pool, washer, dryer, tv, heating, balcony)
-	if err != nil {
+func create_amenities(post_id int, keys ...string) {
+	if err := set_listing_amenities(post_id, keys); err != nil {
 		log.Printf("Error creating amenities: %v", err)
 	}
 }
+
 func create_review(post_id, user_id, rating int, comment string) {
 	query := `INSERT INTO Reviews (post_id, user_id, rating, comment) VALUES (?, ?, ?, ?)`
 
@@ -276,6 +525,7 @@ func get_property_detail(propertyID int) (*PropertyDetail, error) {
 	if err != nil || property == nil {
 		return nil, err
 	}
+	property.BedTypes = get_listing_beds(propertyID)
 
 	// Get host information
 	host := get_user_data(property.UserID)
@@ -283,28 +533,13 @@ func get_property_detail(propertyID int) (*PropertyDetail, error) {
 		host = &UserData{Username: "Unknown Host"}
 	}
 
-	// Get amenities
-	amenitiesQuery := `
-		SELECT wifi, air_conditioning, kitchen, parking, pets_allowed, pool, washer, dryer, tv, heating, balcony
-		FROM Amenities WHERE post_id = ?`
-
-	var amenities PropertyAmenities
-	err = db.QueryRow(amenitiesQuery, propertyID).Scan(
-		&amenities.Wifi, &amenities.AirConditioning, &amenities.Kitchen, &amenities.Parking,
-		&amenities.PetsAllowed, &amenities.Pool, &amenities.Washer, &amenities.Dryer,
-		&amenities.TV, &amenities.Heating, &amenities.Balcony,
-	)
-
-	if err != nil && err != sql.ErrNoRows {
-		log.Printf("Error fetching amenities: %v", err)
-	}
-
-	// Get reviews
+	// Get reviews, leaving out unpublished ones and those hidden by moderators
 	reviewsQuery := `
-		SELECT r.id, r.post_id, r.user_id, u.username, r.rating, r.comment, r.created_at
+		SELECT r.id, r.post_id, r.user_id, u.username, r.rating, r.comment, r.created_at,
+		       COALESCE(r.host_reply, ''), COALESCE(DATE_FORMAT(r.host_replied_at, '%Y-%m-%d'), '')
 		FROM Reviews r
 		JOIN Users u ON r.user_id = u.id
-		WHERE r.post_id = ?
+		WHERE r.post_id = ? AND r.published_at IS NOT NULL AND r.hidden_at IS NULL
 		ORDER BY r.created_at DESC`
 
 	rows, err := db.Query(reviewsQuery, propertyID)
@@ -318,7 +553,7 @@ func get_property_detail(propertyID int) (*PropertyDetail, error) {
 	for rows.Next() {
 		var review Review
 		err := rows.Scan(&review.ID, &review.PostID, &review.UserID, &review.Username,
-			&review.Rating, &review.Comment, &review.CreatedAt)
+			&review.Rating, &review.Comment, &review.CreatedAt, &review.HostReply, &review.HostRepliedAt)
 		if err != nil {
 			log.Printf("Error scanning review: %v", err)
 			continue
@@ -327,10 +562,11 @@ func get_property_detail(propertyID int) (*PropertyDetail, error) {
 	}
 
 	return &PropertyDetail{
-		Property:  property,
-		Host:      host,
-		Amenities: &amenities,
-		Reviews:   reviews,
+		Property:     property,
+		Host:         host,
+		Reviews:      reviews,
+		Rating:       get_listing_rating(propertyID),
+		Cancellation: get_listing_cancellation_policy(propertyID),
 	}, nil
 }
 
@@ -439,31 +675,6 @@ func update_personal_data(userID int, firstName, lastName, birthDate string) err
 	return nil
 }
 
-func get_listing_amenities(listingID int) *PropertyAmenities {
-	query := `SELECT post_id, wifi, air_conditioning, kitchen, parking, pets_allowed, 
-			  pool, washer, dryer, tv, heating, balcony 
-			  FROM Amenities WHERE post_id = ?`
-
-	var amenities PropertyAmenities
-	err := db.QueryRow(query, listingID).Scan(
-		&amenities.PostID, &amenities.Wifi, &amenities.AirConditioning,
-		&amenities.Kitchen, &amenities.Parking, &amenities.PetsAllowed,
-		&amenities.Pool, &amenities.Washer, &amenities.Dryer,
-		&amenities.TV, &amenities.Heating, &amenities.Balcony,
-	)
-
-	if err != nil {
-		if err == sql.ErrNoRows {
-			// Return empty amenities if none exist
-			return &PropertyAmenities{PostID: listingID}
-		}
-		log.Printf("Error querying amenities: %v", err)
-		return &PropertyAmenities{PostID: listingID}
-	}
-
-	return &amenities
-}
-
 func get_listing_images(listingID int) []PropertyImage {
 	var images []PropertyImage
 
@@ -488,50 +699,33 @@ func get_listing_images(listingID int) []PropertyImage {
 	return images
 }
 
-func update_listing(listingID int, title, country, city, address, description string, price float64, propertyType string) error {
-	query := `UPDATE Posts SET title = ?, country = ?, city = ?, address = ?, 
-			  description = ?, price = ?, type = ? WHERE id = ?`
-
-	_, err := db.Exec(query, title, country, city, address, description, price, propertyType, listingID)
+// update_listing saves a listing and its capacity in one transaction
+func update_listing(listingID int, title, country, city, address, description string, price float64, currency, propertyType string, capacity ListingCapacity) error {
+	tx, err := db.Begin()
 	if err != nil {
-		log.Printf("Error updating listing: %v", err)
 		return err
 	}
+	defer tx.Rollback()
 
-	log.Printf("Listing %d updated successfully", listingID)
-	return nil
-}
+	query := `UPDATE Posts SET title = ?, country = ?, city = ?, address = ?, 
+			  description = ?, price = ?, currency = ?, type = ? WHERE id = ?`
 
-func update_listing_amenities(listingID int, wifi, ac, kitchen, parking, pets, pool, washer, dryer, tv, heating, balcony bool) error {
-	// Check if amenities exist
-	var count int
-	checkQuery := "SELECT COUNT(*) FROM Amenities WHERE post_id = ?"
-	err := db.QueryRow(checkQuery, listingID).Scan(&count)
+	_, err = tx.Exec(query, title, country, city, address, description, price, currency, propertyType, listingID)
 	if err != nil {
+		log.Printf("Error updating listing: %v", err)
 		return err
 	}
 
-	var query string
-	if count > 0 {
-		// Update existing amenities
-		query = `UPDATE Amenities SET wifi = ?, air_conditioning = ?, kitchen = ?, 
-				 parking = ?, pets_allowed = ?, pool = ?, washer = ?, dryer = ?, 
-				 tv = ?, heating = ?, balcony = ? WHERE post_id = ?`
-		_, err = db.Exec(query, wifi, ac, kitchen, parking, pets, pool, washer, dryer, tv, heating, balcony, listingID)
-	} else {
-		// Insert new amenities
-		query = `INSERT INTO Amenities (post_id, wifi, air_conditioning, kitchen, parking, 
-				 pets_allowed, pool, washer, dryer, tv, heating, balcony) 
-				 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
-		_, err = db.Exec(query, listingID, wifi, ac, kitchen, parking, pets, pool, washer, dryer, tv, heating, balcony)
+	if err := set_listing_capacity(tx, listingID, capacity); err != nil {
+		log.Printf("Error updating capacity: %v", err)
+		return err
 	}
 
-	if err != nil {
-		log.Printf("Error updating amenities: %v", err)
+	if err := tx.Commit(); err != nil {
 		return err
 	}
 
-	log.Printf("Amenities updated for listing %d", listingID)
+	log.Printf("Listing %d updated successfully", listingID)
 	return nil
 }
 
@@ -602,6 +796,12 @@ func delete_listing_by_owner(listingID, userID int) error {
 		delete_listing_image(image.ID, listingID)
 	}
 
+	// Remove it from everyone's wishlists, votes go with the items
+	if _, err := db.Exec(`DELETE FROM WishlistItems WHERE post_id = ?`, listingID); err != nil {
+		log.Printf("Error removing listing from wishlists: %v", err)
+		return err
+	}
+
 	// Delete the listing (this will cascade delete related records due to foreign key constraints)
 	deleteQuery := "DELETE FROM Posts WHERE id = ? AND user_id = ?"
 	result, err := db.Exec(deleteQuery, listingID, userID)
@@ -623,99 +823,147 @@ func delete_listing_by_owner(listingID, userID int) error {
 	return nil
 }
 
-func search_listings(params SearchParams) (*ListingsResult, error) {
-	var listings []Listing
-	var totalCount int
+// SearchFilters is the SQL of a search's filters over Posts p, shared by the
+// result, count and facet queries. Relevance and Distance are the SELECT
+// expressions ranking the results.
+type SearchFilters struct {
+	Joins         string
+	Where         string
+	Args          []interface{}
+	Relevance     string
+	RelevanceArgs []interface{}
+	Distance      string
+	DistanceArgs  []interface{}
+}
 
+// build_search_filters turns params into SQL. Prices are compared in the
+// base currency, so params.Currency must be set.
+func build_search_filters(params SearchParams) SearchFilters {
 	whereConditions := []string{"1=1"}
 	args := []interface{}{}
-	countArgs := []interface{}{}
+
+	filters := SearchFilters{Relevance: "0", Distance: "NULL"}
 
 	// Basic search filters
 	if params.Destination != "" {
-		whereConditions = append(whereConditions, "(p.city LIKE ? OR p.country LIKE ? OR p.title LIKE ?)")
-		searchTerm := "%" + params.Destination + "%"
-		args = append(args, searchTerm, searchTerm, searchTerm)
-		countArgs = append(countArgs, searchTerm, searchTerm, searchTerm)
+		match := match_destination(params.Destination)
+		whereConditions = append(whereConditions, match.Condition)
+		args = append(args, match.ConditionArgs...)
+		filters.Relevance, filters.RelevanceArgs = match.Relevance, match.RelevanceArgs
 	}
 
+	// Price filters are given in the viewer's currency, compare them in the base currency
 	if params.MinPrice > 0 {
-		whereConditions = append(whereConditions, "p.price >= ?")
-		args = append(args, params.MinPrice)
-		countArgs = append(countArgs, params.MinPrice)
+		minPrice, _, err := convert_amount(params.MinPrice, params.Currency, BASE_CURRENCY)
+		if err != nil {
+			minPrice = params.MinPrice
+		}
+		whereConditions = append(whereConditions, "p.price / COALESCE(er.rate, 1) >= ?")
+		args = append(args, minPrice)
 	}
 
 	if params.MaxPrice > 0 {
-		whereConditions = append(whereConditions, "p.price <= ?")
-		args = append(args, params.MaxPrice)
-		countArgs = append(countArgs, params.MaxPrice)
+		maxPrice, _, err := convert_amount(params.MaxPrice, params.Currency, BASE_CURRENCY)
+		if err != nil {
+			maxPrice = params.MaxPrice
+		}
+		whereConditions = append(whereConditions, "p.price / COALESCE(er.rate, 1) <= ?")
+		args = append(args, maxPrice)
 	}
 
-	if params.PropertyType != "" {
-		whereConditions = append(whereConditions, "p.type = ?")
-		args = append(args, params.PropertyType)
-		countArgs = append(countArgs, params.PropertyType)
+	if params.Country != "" {
+		whereConditions = append(whereConditions, "p.country = ?")
+		args = append(args, params.Country)
 	}
 
-	// Amenity filters - only add conditions if amenities are requested
-	amenityConditions := []string{}
-
-	if params.Wifi {
-		amenityConditions = append(amenityConditions, "a.wifi = true")
-	}
-	if params.Kitchen {
-		amenityConditions = append(amenityConditions, "a.kitchen = true")
+	if len(params.PropertyTypes) > 0 {
+		placeholders := make([]string, len(params.PropertyTypes))
+		for i, propertyType := range params.PropertyTypes {
+			placeholders[i] = "?"
+			args = append(args, propertyType)
+		}
+		whereConditions = append(whereConditions, "p.type IN ("+strings.Join(placeholders, ", ")+")")
 	}
-	if params.AirConditioning {
-		amenityConditions = append(amenityConditions, "a.air_conditioning = true")
+
+	if params.InstantBook {
+		whereConditions = append(whereConditions, "p.instant_book = true")
 	}
-	if params.Parking {
-		amenityConditions = append(amenityConditions, "a.parking = true")
+
+	if params.Guests > 0 {
+		whereConditions = append(whereConditions, "p.max_guests >= ?")
+		args = append(args, params.Guests)
 	}
-	if params.Pool {
-		amenityConditions = append(amenityConditions, "a.pool = true")
+	if params.MinBedrooms > 0 {
+		whereConditions = append(whereConditions, "p.bedrooms >= ?")
+		args = append(args, params.MinBedrooms)
 	}
-	if params.TV {
-		amenityConditions = append(amenityConditions, "a.tv = true")
+	if params.MinBeds > 0 {
+		whereConditions = append(whereConditions, "p.beds >= ?")
+		args = append(args, params.MinBeds)
 	}
-	if params.Washer {
-		amenityConditions = append(amenityConditions, "a.washer = true")
+	if params.MinBathrooms > 0 {
+		whereConditions = append(whereConditions, "p.bathrooms >= ?")
+		args = append(args, params.MinBathrooms)
 	}
-	if params.Dryer {
-		amenityConditions = append(amenityConditions, "a.dryer = true")
+
+	if params.MinRating > 0 {
+		whereConditions = append(whereConditions, "COALESCE(lr.rating_avg, 0) >= ?")
+		args = append(args, params.MinRating)
 	}
-	if params.Heating {
-		amenityConditions = append(amenityConditions, "a.heating = true")
+
+	if params.Center != nil {
+		radius := params.RadiusKm
+		if radius <= 0 {
+			radius = DEFAULT_SEARCH_RADIUS_KM
+		}
+		condition, conditionArgs := radius_condition(*params.Center, radius)
+		whereConditions = append(whereConditions, condition)
+		args = append(args, conditionArgs...)
+		filters.Distance, filters.DistanceArgs = distance_km_sql(*params.Center)
 	}
-	if params.Balcony {
-		amenityConditions = append(amenityConditions, "a.balcony = true")
+
+	if params.Bounds != nil {
+		condition, conditionArgs := params.Bounds.condition()
+		whereConditions = append(whereConditions, condition)
+		args = append(args, conditionArgs...)
 	}
-	if params.PetsAllowed {
-		amenityConditions = append(amenityConditions, "a.pets_allowed = true")
+
+	// Amenity filters, resolved to catalogue ids
+	for _, key := range params.Amenities {
+		amenity, ok := find_amenity(key)
+		if !ok {
+			continue
+		}
+		whereConditions = append(whereConditions,
+			"EXISTS (SELECT 1 FROM ListingAmenities la WHERE la.post_id = p.id AND la.amenity_id = ?)")
+		args = append(args, amenity.ID)
 	}
 
 	// Build the complete WHERE clause
 	whereClause := strings.Join(whereConditions, " AND ")
 
-	// Determine if we need to JOIN with amenities table
-	joinClause := ""
-	if len(amenityConditions) > 0 {
-		joinClause = "INNER JOIN Amenities a ON p.id = a.post_id"
-		whereClause += " AND " + strings.Join(amenityConditions, " AND ")
-	} else {
-		joinClause = "LEFT JOIN Amenities a ON p.id = a.post_id"
+	joinClause := "LEFT JOIN ExchangeRates er ON p.currency = er.currency"
+	joinClause += " LEFT JOIN ListingRatings lr ON p.id = lr.post_id"
+
+	filters.Joins = joinClause
+	filters.Where = whereClause
+	filters.Args = args
+	return filters
+}
+
+func search_listings(params SearchParams) (*ListingsResult, error) {
+	var listings []Listing
+
+	if params.Currency == "" {
+		params.Currency = BASE_CURRENCY
 	}
 
-	// Count query
-	countQuery := fmt.Sprintf(`
-		SELECT COUNT(DISTINCT p.id) 
-		FROM Posts p
-		%s
-		WHERE %s`, joinClause, whereClause)
+	filters := build_search_filters(params)
+	joinClause, whereClause := filters.Joins, filters.Where
+	args := append([]interface{}{}, filters.Args...)
 
-	err := db.QueryRow(countQuery, countArgs...).Scan(&totalCount)
+	totalCount, approximate, err := count_search_results(filters)
 	if err != nil {
-		log.Printf("Error counting listings: %v", err)
 		return nil, err
 	}
 
@@ -726,27 +974,58 @@ func search_listings(params SearchParams) (*ListingsResult, error) {
 		params.Page = 1
 	}
 
-	offset := (params.Page - 1) * params.Limit
+	// Page numbers only reach SEARCH_RESULT_WINDOW deep, a cursor goes further
 	totalPages := (totalCount + params.Limit - 1) / params.Limit
+	totalPages = min(totalPages, max(1, SEARCH_RESULT_WINDOW/params.Limit))
+	params.Page = min(params.Page, max(1, totalPages))
+	offset := (params.Page - 1) * params.Limit
+
+	columns := search_sort_columns(params, filters)
+	var sortKeys, orderBy []string
+	var sortArgs []interface{}
+	for i, column := range columns {
+		sortKeys = append(sortKeys, fmt.Sprintf("%s AS sort_key_%d", column.Expr, i))
+		sortArgs = append(sortArgs, column.Args...)
+		direction := "ASC"
+		if column.Desc {
+			direction = "DESC"
+		}
+		orderBy = append(orderBy, fmt.Sprintf("sort_key_%d %s", i, direction))
+	}
+
+	if params.After != nil {
+		condition, conditionArgs := keyset_condition(columns, params.After)
+		whereClause += " AND " + condition
+		args = append(args, conditionArgs...)
+		offset = 0
+	}
 
-	// Main query
+	// Main query, one listing more than the page to know whether there is a next one
 	query := fmt.Sprintf(`
 		SELECT p.id, p.user_id, p.title, p.country, p.city, p.address, 
-		       p.description, p.price, p.type, p.created_at,
+		       p.description, p.price, p.currency, p.type, p.created_at,
 		       COALESCE(MIN(i.image_url), '') as image_url,
-		       COALESCE(MAX(a.wifi), false) as has_wifi,
-		       COALESCE(MAX(a.kitchen), false) as has_kitchen,
-		       COALESCE(MAX(a.air_conditioning), false) as has_ac,
-		       COALESCE(MAX(a.parking), false) as has_parking
+		       %s AS amenity_ids,
+		       p.instant_book, COALESCE(lr.rating_avg, 0), COALESCE(lr.review_count, 0),
+		       p.latitude, p.longitude, p.max_guests, p.bedrooms, p.beds, p.bathrooms,
+		       %s AS relevance,
+		       %s AS distance_km,
+		       %s
 		FROM Posts p
 		LEFT JOIN Images i ON p.id = i.post_id
 		%s
 		WHERE %s
-		GROUP BY p.id, p.user_id, p.title, p.country, p.city, p.address, p.description, p.price, p.type, p.created_at
-		ORDER BY p.created_at DESC
-		LIMIT ? OFFSET ?`, joinClause, whereClause)
-
-	args = append(args, params.Limit, offset)
+		GROUP BY p.id, p.user_id, p.title, p.country, p.city, p.address, p.description, p.price, p.currency, p.type, p.created_at,
+		         p.instant_book, p.latitude, p.longitude, p.max_guests, p.bedrooms, p.beds, p.bathrooms,
+		         lr.rating_avg, lr.review_count, er.rate
+		ORDER BY %s
+		LIMIT ? OFFSET ?`, listing_amenity_ids_sql, filters.Relevance, filters.Distance, strings.Join(sortKeys, ", "),
+		joinClause, whereClause, strings.Join(orderBy, ", "))
+
+	// The relevance, distance and sort key arguments come first as they are part of the SELECT
+	selectArgs := append(append(append([]interface{}{}, filters.RelevanceArgs...), filters.DistanceArgs...), sortArgs...)
+	args = append(selectArgs, args...)
+	args = append(args, params.Limit+1, offset)
 
 	rows, err := db.Query(query, args...)
 	if err != nil {
@@ -755,54 +1034,89 @@ func search_listings(params SearchParams) (*ListingsResult, error) {
 	}
 	defer rows.Close()
 
+	var lastKeys []interface{}
+	hasMore := false
 	for rows.Next() {
+		if len(listings) == params.Limit {
+			hasMore = true
+			break
+		}
+
 		var listing Listing
-		err := rows.Scan(
+		var amenityIDs string
+		var latitude, longitude, distanceKm sql.NullFloat64
+		keys := make([]interface{}, len(columns))
+		dest := []interface{}{
 			&listing.ID, &listing.UserID, &listing.Title, &listing.Country,
 			&listing.City, &listing.Address, &listing.Description,
-			&listing.Price, &listing.Type, &listing.CreatedAt,
-			&listing.ImageURL, &listing.HasWifi, &listing.HasKitchen,
-			&listing.HasAC, &listing.HasParking,
-		)
-		if err != nil {
+			&listing.Price, &listing.Currency, &listing.Type, &listing.CreatedAt,
+			&listing.ImageURL, &amenityIDs, &listing.InstantBook, &listing.RatingAvg, &listing.ReviewCount,
+			&latitude, &longitude, &listing.MaxGuests, &listing.Bedrooms, &listing.Beds, &listing.Bathrooms,
+			&listing.Relevance, &distanceKm,
+		}
+		for i := range keys {
+			dest = append(dest, &keys[i])
+		}
+		if err := rows.Scan(dest...); err != nil {
 			log.Printf("Error scanning listing: %v", err)
 			continue
 		}
+		scan_listing_location(&listing, latitude, longitude, distanceKm)
+		listing.Amenities = amenities_from_ids(amenityIDs)
 
+		set_listing_display_price(&listing, params.Currency)
 		listings = append(listings, listing)
+		lastKeys = keys
 	}
 
-	return &ListingsResult{
-		Listings:     listings,
-		TotalResults: totalCount,
-		TotalPages:   totalPages,
-		CurrentPage:  params.Page,
-	}, nil
+	result := &ListingsResult{
+		Listings:         listings,
+		TotalResults:     totalCount,
+		TotalPages:       totalPages,
+		CurrentPage:      params.Page,
+		TotalApproximate: approximate,
+	}
+	if hasMore && lastKeys != nil {
+		result.NextCursor = encode_search_cursor(params, lastKeys)
+	}
+
+	if params.WithFacets {
+		// Facets are a nice to have, the results are still worth showing
+		result.Facets, err = get_search_facets(params)
+		if err != nil {
+			result.Facets = new_search_facets(params)
+		}
+	}
+
+	return result, nil
 }
 
 func get_listing_by_id(listingID int) (*Listing, error) {
 	query := `
 		SELECT p.id, p.user_id, p.title, p.country, p.city, p.address,
-		       p.description, p.price, p.type, p.created_at,
+		       p.description, p.price, p.currency, p.type, p.created_at,
 		       COALESCE(MIN(i.image_url), '') as image_url,
-		       COALESCE(MAX(a.wifi), false) as has_wifi,
-		       COALESCE(MAX(a.kitchen), false) as has_kitchen,
-		       COALESCE(MAX(a.air_conditioning), false) as has_ac,
-		       COALESCE(MAX(a.parking), false) as has_parking
+		       ` + listing_amenity_ids_sql + ` as amenity_ids,
+		       p.instant_book, COALESCE(lr.rating_avg, 0), COALESCE(lr.review_count, 0),
+		       p.latitude, p.longitude, p.max_guests, p.bedrooms, p.beds, p.bathrooms
 		FROM Posts p
 		LEFT JOIN Images i ON p.id = i.post_id
-		LEFT JOIN Amenities a ON p.id = a.post_id
+		LEFT JOIN ListingRatings lr ON p.id = lr.post_id
 		WHERE p.id = ?
-		GROUP BY p.id, p.user_id, p.title, p.country, p.city, p.address, p.description, p.price, p.type, p.created_at
+		GROUP BY p.id, p.user_id, p.title, p.country, p.city, p.address, p.description, p.price, p.currency, p.type, p.created_at,
+		         p.instant_book, p.latitude, p.longitude, p.max_guests, p.bedrooms, p.beds, p.bathrooms,
+		         lr.rating_avg, lr.review_count
 		LIMIT 1`
 
 	var listing Listing
+	var amenityIDs string
+	var latitude, longitude sql.NullFloat64
 	err := db.QueryRow(query, listingID).Scan(
 		&listing.ID, &listing.UserID, &listing.Title, &listing.Country,
 		&listing.City, &listing.Address, &listing.Description,
-		&listing.Price, &listing.Type, &listing.CreatedAt,
-		&listing.ImageURL, &listing.HasWifi, &listing.HasKitchen,
-		&listing.HasAC, &listing.HasParking,
+		&listing.Price, &listing.Currency, &listing.Type, &listing.CreatedAt,
+		&listing.ImageURL, &amenityIDs, &listing.InstantBook, &listing.RatingAvg, &listing.ReviewCount,
+		&latitude, &longitude, &listing.MaxGuests, &listing.Bedrooms, &listing.Beds, &listing.Bathrooms,
 	)
 
 	if err != nil {
@@ -812,23 +1126,12 @@ func get_listing_by_id(listingID int) (*Listing, error) {
 		log.Printf("Error querying listing by ID: %v", err)
 		return nil, err
 	}
+	scan_listing_location(&listing, latitude, longitude, sql.NullFloat64{})
+	listing.Amenities = amenities_from_ids(amenityIDs)
 
 	return &listing, nil
 }
 
-func get_post_count_by_city(city string) int {
-	query := `SELECT COUNT(*) FROM Posts WHERE city = ?`
-	var count int
-	err := db.QueryRow(query, city).Scan(&count)
-
-	if err != nil {
-		log.Printf("Error querying post count for city %s: %v", city, err)
-		return 0
-	}
-
-	return count
-}
-
 func get_user_data(user_id int) *UserData {
 	query := `
 		SELECT u.id, u.username, u.email, u.phone_number, u.role, u.created_at,
@@ -904,37 +1207,73 @@ func create_post(user_id int, title string, country string, city string, address
 	log.Println("Post created successfully")
 }
 
-func enable_review_for_booking(bookingID int, hostID int) error {
-	query := `SELECT COUNT(*) FROM Bookings WHERE id = ? AND host_id = ?`
-	var count int
-	err := db.QueryRow(query, bookingID, hostID).Scan(&count)
+// open_review_for_booking invites the guest to review their stay by email and
+// notification, flagging the booking with review_enabled. It returns false if
+// the guest was already invited.
+func open_review_for_booking(bookingID int) (bool, error) {
+	query := `SELECT b.user_id, b.post_id, p.title FROM Bookings b JOIN Posts p ON b.post_id = p.id WHERE b.id = ?`
+	var guestID, postID int
+	var title string
+	err := db.QueryRow(query, bookingID).Scan(&guestID, &postID, &title)
 	if err != nil {
-		return err
+		if err == sql.ErrNoRows {
+			return false, fmt.Errorf("booking not found")
+		}
+		return false, err
 	}
-	if count == 0 {
-		return fmt.Errorf("booking not found or you're not the host")
+
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
 	}
+	defer tx.Rollback()
 
-	updateQuery := `UPDATE Bookings SET review_enabled = true WHERE id = ? AND host_id = ?`
-	_, err = db.Exec(updateQuery, bookingID, hostID)
+	updateQuery := `UPDATE Bookings SET review_enabled = true WHERE id = ? AND COALESCE(review_enabled, false) = false`
+	result, err := tx.Exec(updateQuery, bookingID)
 	if err != nil {
 		log.Printf("Error enabling review: %v", err)
-		return err
+		return false, err
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return false, err
 	}
 
-	log.Printf("Review enabled for booking %d by host %d", bookingID, hostID)
-	return nil
+	emailData, err := booking_email_data(tx, bookingID)
+	if err != nil {
+		return false, err
+	}
+	emailData["ReviewLink"] = fmt.Sprintf("%s/property/%d", get_base_url(), postID)
+	if err := enqueue_email(tx, guestID, EMAIL_REVIEW_INVITATION, emailData); err != nil {
+		log.Printf("Error queueing review invitation: %v", err)
+		return false, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+
+	notify(guestID, NOTIFICATION_REVIEW_ENABLED, "You can review your stay",
+		fmt.Sprintf("Share how your stay at %s went", title), fmt.Sprintf("/property/%d", postID))
+
+	var hostID int
+	if err := db.QueryRow(`SELECT host_id FROM Bookings WHERE id = ?`, bookingID).Scan(&hostID); err == nil {
+		notify(hostID, NOTIFICATION_REVIEW_ENABLED, "You can review your guest",
+			fmt.Sprintf("Let other hosts know how booking #%d at %s went", bookingID, title), "/my-profile")
+	}
+
+	return true, nil
 }
 
 func can_user_review_property(userID, propertyID int) (bool, int, error) {
 	query := `
-		SELECT id FROM Bookings 
-		WHERE user_id = ? AND post_id = ? AND review_enabled = true
-		AND id NOT IN (SELECT COALESCE(booking_id, 0) FROM Reviews WHERE user_id = ? AND post_id = ?)
+		SELECT b.id FROM Bookings b
+		WHERE b.user_id = ? AND b.post_id = ? AND ` + review_window_open_sql + `
+		AND NOT EXISTS (SELECT 1 FROM Reviews r WHERE r.booking_id = b.id)
+		ORDER BY b.end_date DESC
 		LIMIT 1`
 
 	var bookingID int
-	err := db.QueryRow(query, userID, propertyID, userID, propertyID).Scan(&bookingID)
+	err := db.QueryRow(query, userID, propertyID, get_review_window_days()).Scan(&bookingID)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return false, 0, nil
@@ -945,42 +1284,91 @@ func can_user_review_property(userID, propertyID int) (bool, int, error) {
 	return true, bookingID, nil
 }
 
-func create_review_with_booking(postID, userID, bookingID, rating int, comment string) error {
-	canReview, _, err := can_user_review_property(userID, postID)
+func create_review_with_booking(postID, userID, bookingID, rating int, subRatings map[string]int, comment string) error {
+	canReview, err := can_user_review_booking(userID, postID, bookingID)
 	if err != nil {
 		return err
 	}
 	if !canReview {
-		return fmt.Errorf("you don't have permission to review this property")
+		return fmt.Errorf("this stay can't be reviewed, the review window opens after checkout and closes %d days later", get_review_window_days())
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// The review stays hidden until the host has reviewed the guest too, the
+	// listing's aggregates are refreshed when it is published
+	columns := []string{"post_id", "user_id", "booking_id", "rating", "comment", "published_at"}
+	placeholders := []string{"?", "?", "?", "?", "?", "NULL"}
+	args := []interface{}{postID, userID, bookingID, rating, comment}
+	for _, category := range review_categories {
+		columns = append(columns, category.Key+"_rating")
+		placeholders = append(placeholders, "?")
+		args = append(args, subRatings[category.Key])
 	}
 
-	query := `INSERT INTO Reviews (post_id, user_id, booking_id, rating, comment) VALUES (?, ?, ?, ?, ?)`
-	_, err = db.Exec(query, postID, userID, bookingID, rating, comment)
+	query := `INSERT INTO Reviews (` + strings.Join(columns, ", ") + `) VALUES (` + strings.Join(placeholders, ", ") + `)`
+	_, err = tx.Exec(query, args...)
 	if err != nil {
 		log.Printf("Error creating review: %v", err)
 		return err
 	}
 
+	published, err := publish_reviews_if_complete(tx, bookingID)
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
 	log.Printf("Review created for property %d by user %d", postID, userID)
+
+	if published {
+		notify_reviews_published(bookingID)
+		return nil
+	}
+
+	var hostID int
+	var title string
+	err = db.QueryRow(`SELECT user_id, title FROM Posts WHERE id = ?`, postID).Scan(&hostID, &title)
+	if err == nil {
+		notify(hostID, NOTIFICATION_REVIEW_RECEIVED, "Your guest left a review",
+			fmt.Sprintf("Review your guest from %s to see it, or it's published when the review window closes", title), "/my-profile")
+	}
+
 	return nil
 }
 
 func get_host_bookings_for_review_management(hostID int) ([]Booking, error) {
 	var bookings []Booking
 
+	// Review status is derived from the automatic review window
 	query := `
 		SELECT b.id, b.post_id, b.user_id, b.host_id, b.start_date, b.end_date, 
-		       b.guests, b.total_price, b.created_at, p.title, p.city, u.username,
-		       COALESCE(b.review_enabled, false) as review_enabled,
-		       CASE WHEN r.id IS NOT NULL THEN true ELSE false END as has_review
+		       b.guests, b.total_price, b.currency, b.created_at, p.title, p.city, u.username,
+		       CASE
+		           WHEN EXISTS (SELECT 1 FROM Reviews r WHERE r.booking_id = b.id) THEN 'reviewed'
+		           WHEN COALESCE(b.status, 'confirmed') = 'cancelled' THEN 'cancelled'
+		           WHEN ` + review_window_open_sql + ` THEN 'review_open'
+		           WHEN b.end_date >= CURDATE() THEN 'upcoming'
+		           ELSE 'review_closed'
+		       END as review_status,
+		       ` + review_closes_sql + ` as review_closes_at,
+		       ` + review_window_open_sql + ` as review_open,
+		       EXISTS (SELECT 1 FROM GuestReviews gr WHERE gr.booking_id = b.id) as host_reviewed
 		FROM Bookings b
 		JOIN Posts p ON b.post_id = p.id
 		JOIN Users u ON b.user_id = u.id
-		LEFT JOIN Reviews r ON b.id = r.booking_id
 		WHERE b.host_id = ?
 		ORDER BY b.created_at DESC`
 
-	rows, err := db.Query(query, hostID)
+	days := get_review_window_days()
+	rows, err := db.Query(query, days, days, days, hostID)
 	if err != nil {
 		log.Printf("Error fetching host bookings for review management: %v", err)
 		return bookings, err
@@ -989,24 +1377,20 @@ func get_host_bookings_for_review_management(hostID int) ([]Booking, error) {
 
 	for rows.Next() {
 		var booking Booking
-		var reviewEnabled, hasReview bool
+		var reviewOpen bool
 		err := rows.Scan(
 			&booking.ID, &booking.PostID, &booking.UserID, &booking.HostID,
-			&booking.StartDate, &booking.EndDate, &booking.Guests, &booking.TotalPrice,
+			&booking.StartDate, &booking.EndDate, &booking.Guests, &booking.TotalPrice, &booking.Currency,
 			&booking.CreatedAt, &booking.PropertyTitle, &booking.PropertyCity, &booking.UserName,
-			&reviewEnabled, &hasReview,
+			&booking.Status, &booking.ReviewClosesAt, &reviewOpen, &booking.HostReviewed,
 		)
 		if err != nil {
 			log.Printf("Error scanning host booking: %v", err)
 			continue
 		}
 
-		// Add custom fields for review management
-		if reviewEnabled {
-			booking.Status = "review_enabled"
-		} else {
-			booking.Status = "completed"
-		}
+		// The host's own review window matches the guest's
+		booking.CanReviewGuest = reviewOpen && !booking.HostReviewed
 
 		bookings = append(bookings, booking)
 	}
@@ -1014,20 +1398,25 @@ func get_host_bookings_for_review_management(hostID int) ([]Booking, error) {
 	return bookings, nil
 }
 
+// get_user_reviewable_bookings returns stays the user can review now and the
+// ones they already reviewed
 func get_user_reviewable_bookings(userID int) ([]Booking, error) {
 	var bookings []Booking
 
 	query := `
 		SELECT b.id, b.post_id, b.user_id, b.host_id, b.start_date, b.end_date, 
 		       b.guests, b.total_price, b.created_at, p.title, p.city,
-		       CASE WHEN r.id IS NOT NULL THEN true ELSE false END as has_review
+		       CASE WHEN r.id IS NOT NULL THEN true ELSE false END as has_review,
+		       ` + review_closes_sql + ` as review_closes_at,
+		       COALESCE(r.published_at IS NOT NULL, false) as review_published
 		FROM Bookings b
 		JOIN Posts p ON b.post_id = p.id
 		LEFT JOIN Reviews r ON b.id = r.booking_id
-		WHERE b.user_id = ? AND COALESCE(b.review_enabled, false) = true
-		ORDER BY b.created_at DESC`
+		WHERE b.user_id = ? AND (r.id IS NOT NULL OR ` + review_window_open_sql + `)
+		ORDER BY b.end_date DESC`
 
-	rows, err := db.Query(query, userID)
+	days := get_review_window_days()
+	rows, err := db.Query(query, days, userID, days)
 	if err != nil {
 		log.Printf("Error fetching user reviewable bookings: %v", err)
 		return bookings, err
@@ -1041,6 +1430,7 @@ func get_user_reviewable_bookings(userID int) ([]Booking, error) {
 			&booking.ID, &booking.PostID, &booking.UserID, &booking.HostID,
 			&booking.StartDate, &booking.EndDate, &booking.Guests, &booking.TotalPrice,
 			&booking.CreatedAt, &booking.PropertyTitle, &booking.PropertyCity, &hasReview,
+			&booking.ReviewClosesAt, &booking.ReviewPublished,
 		)
 		if err != nil {
 			log.Printf("Error scanning reviewable booking: %v", err)
@@ -1083,45 +1473,48 @@ func update_tables_for_reviews() {
 }
 
 func create_posts_test_data() {
+	// The schema file doesn't create the amenity catalogue the listings link to
+	update_tables_for_amenity_catalog()
+
 	create_post(1, "Cozy Apartment", "USA", "New York", "123 Broadway St", "A cozy apartment in the city center with modern amenities and great city views.", 100.0, "apartment")
-	create_amenities(1, true, true, true, false, false, false, true, true, true, true, false)
+	create_amenities(1, "wifi", "kitchen", "air_conditioning", "tv", "washer", "dryer", "heating")
 	create_review(1, 1, 5, "Amazing apartment! Perfect location and very clean. The host was super responsive and helpful.")
 	create_review(1, 1, 4, "Great place to stay in NYC. Kitchen was well-equipped and the bed was comfortable. Would recommend!")
 
 	create_post(1, "Luxury Loft", "Indonesia", "Bali", "456 Beach Road", "A luxury loft with stunning ocean views, private balcony, and modern tropical design.", 150.0, "apartment")
-	create_amenities(2, true, true, true, true, false, true, true, false, true, false, true)
+	create_amenities(2, "wifi", "kitchen", "air_conditioning", "parking", "pool", "tv", "washer", "balcony")
 	create_review(2, 1, 5, "Absolutely stunning! The ocean view is breathtaking and the loft is beautifully designed. Perfect for a romantic getaway.")
 	create_review(2, 1, 5, "Best vacation rental we've ever stayed at. The pool area is amazing and the location is unbeatable.")
 
 	create_post(1, "Beach House", "Spain", "Barcelona", "789 Coastal Ave", "A beautiful beach house with direct ocean access, perfect for families and groups.", 250.0, "house")
-	create_amenities(3, true, false, true, true, true, false, true, true, true, false, true)
+	create_amenities(3, "wifi", "kitchen", "parking", "tv", "washer", "dryer", "balcony", "pets_allowed")
 	create_review(3, 1, 4, "Perfect family vacation spot! Kids loved being so close to the beach. House has everything you need.")
 
 	create_post(1, "Mountain Retreat", "Japan", "Tokyo", "321 Mountain Path", "A unique mountain retreat just outside Tokyo, offering peace and tranquility with city access.", 200.0, "house")
-	create_amenities(4, true, false, true, true, false, false, false, false, true, true, false)
+	create_amenities(4, "wifi", "kitchen", "parking", "tv", "heating")
 	create_review(4, 1, 5, "What a unique find! Perfect escape from the city while still being accessible. Very peaceful and well-maintained.")
 	create_review(4, 1, 4, "Great for a digital detox. Beautiful surroundings and the host provided excellent local recommendations.")
 
 	create_post(1, "Luxury Villa", "France", "Paris", "654 Champs Elysees", "An elegant Parisian villa with private pool, garden, and classic French architecture.", 500.0, "house")
-	create_amenities(5, true, true, true, true, false, true, true, true, true, true, true)
+	create_amenities(5, "wifi", "kitchen", "air_conditioning", "parking", "pool", "tv", "washer", "dryer", "heating", "balcony")
 	create_review(5, 1, 5, "Pure luxury! Felt like staying in a high-end hotel. The pool and garden are magnificent. Worth every euro!")
 
 	create_post(1, "Modern City Loft", "UK", "London", "987 Thames St", "A sleek modern loft in the heart of London with industrial design and city views.", 300.0, "apartment")
-	create_amenities(6, true, true, true, false, false, false, true, true, true, true, false)
+	create_amenities(6, "wifi", "kitchen", "air_conditioning", "tv", "washer", "dryer", "heating")
 	create_review(6, 1, 4, "Fantastic location and beautiful modern design. Walking distance to all major attractions. Highly recommend!")
 	create_review(6, 1, 5, "Stylish and comfortable. The loft has a great vibe and the host was incredibly welcoming.")
 
 	create_post(1, "Tuscan-Style Cottage", "Italy", "Rome", "147 Villa Road", "A charming cottage with authentic Italian character, beautiful gardens, and peaceful countryside views.", 180.0, "house")
-	create_amenities(7, true, false, true, true, true, false, false, false, true, true, true)
+	create_amenities(7, "wifi", "kitchen", "parking", "tv", "heating", "balcony", "pets_allowed")
 	create_review(7, 1, 5, "Like staying in a fairytale! The cottage is beautifully decorated and the garden is perfect for morning coffee.")
 
 	create_post(1, "Sky-High Penthouse", "UAE", "Dubai", "258 Burj St", "A luxurious penthouse suite with panoramic city views, premium amenities, and world-class service.", 400.0, "apartment")
-	create_amenities(8, true, true, true, true, false, true, true, true, true, true, true)
+	create_amenities(8, "wifi", "kitchen", "air_conditioning", "parking", "pool", "tv", "washer", "dryer", "heating", "balcony")
 	create_review(8, 1, 5, "Absolutely incredible! The views are out of this world. Felt like a VIP the entire stay. Perfect for special occasions.")
 	create_review(8, 1, 4, "Stunning apartment with amazing amenities. The infinity pool on the rooftop is unforgettable.")
 
 	create_post(1, "Historic Mansion", "France", "Paris", "369 Historic Blvd", "A beautifully restored 18th-century mansion with original details, elegant furnishings, and rich history.", 600.0, "house")
-	create_amenities(9, true, true, true, true, false, false, true, true, true, true, true)
+	create_amenities(9, "wifi", "kitchen", "air_conditioning", "parking", "tv", "washer", "dryer", "heating", "balcony")
 	create_review(9, 1, 5, "Staying here is like living in a museum! Incredible history and the restoration is flawless. A truly unique experience.")
 
 	log.Println("Created test posts and amenities successfully")
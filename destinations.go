@@ -0,0 +1,278 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Bookings and searches of this many days count towards popularity
+const DESTINATION_POPULARITY_DAYS = 90
+
+// Popularity weights: a booking says more about demand than a search
+const (
+	DESTINATION_LISTING_WEIGHT = 1.0
+	DESTINATION_BOOKING_WEIGHT = 3.0
+	DESTINATION_SEARCH_WEIGHT  = 0.5
+)
+
+const DESTINATIONS_CACHE_TTL = 5 * time.Minute
+
+const (
+	POPULAR_DESTINATIONS_SHOWN = 8
+	DESTINATION_SUGGESTIONS    = 8
+)
+
+// Destination is a city or a country that has listings
+type Destination struct {
+	Name         string  `json:"name"`
+	Kind         string  `json:"kind"`
+	City         string  `json:"city,omitempty"`
+	Country      string  `json:"country"`
+	ListingCount int     `json:"listing_count"`
+	BookingCount int     `json:"booking_count"`
+	SearchCount  int     `json:"search_count"`
+	Score        float64 `json:"score"`
+	ImageURL     string  `json:"image_url"`
+}
+
+// Label is how the destination is shown in suggestions
+func (d Destination) Label() string {
+	if d.Kind == "city" {
+		return d.City + ", " + d.Country
+	}
+	return d.Country
+}
+
+var (
+	destinations_mutex sync.Mutex
+	destinations_cache []Destination
+	destinations_built time.Time
+)
+
+// destinations_query derives cities and countries from Posts with their
+// listing, recent booking and recent search counts
+const destinations_query = `
+	SELECT d.kind, d.city, d.country, d.listings,
+	       COALESCE(bc.bookings, bn.bookings, 0), COALESCE(s.searches, 0), d.image_url
+	FROM (
+		SELECT 'city' AS kind, p.city, p.country, COUNT(*) AS listings,
+		       COALESCE(MIN(i.image_url), '') AS image_url
+		FROM Posts p
+		LEFT JOIN (SELECT post_id, MIN(image_url) AS image_url FROM Images GROUP BY post_id) i ON i.post_id = p.id
+		WHERE p.city IS NOT NULL AND p.city != ''
+		GROUP BY p.city, p.country
+		UNION ALL
+		SELECT 'country', '', p.country, COUNT(*), COALESCE(MIN(i.image_url), '')
+		FROM Posts p
+		LEFT JOIN (SELECT post_id, MIN(image_url) AS image_url FROM Images GROUP BY post_id) i ON i.post_id = p.id
+		GROUP BY p.country
+	) d
+	LEFT JOIN (
+		SELECT p.city, p.country, COUNT(*) AS bookings
+		FROM Bookings b JOIN Posts p ON b.post_id = p.id
+		WHERE b.created_at >= NOW() - INTERVAL ? DAY AND COALESCE(b.status, 'confirmed') != 'cancelled'
+		GROUP BY p.city, p.country
+	) bc ON d.kind = 'city' AND bc.city = d.city AND bc.country = d.country
+	LEFT JOIN (
+		SELECT p.country, COUNT(*) AS bookings
+		FROM Bookings b JOIN Posts p ON b.post_id = p.id
+		WHERE b.created_at >= NOW() - INTERVAL ? DAY AND COALESCE(b.status, 'confirmed') != 'cancelled'
+		GROUP BY p.country
+	) bn ON d.kind = 'country' AND bn.country = d.country
+	LEFT JOIN (
+		SELECT term, COUNT(*) AS searches
+		FROM DestinationSearches
+		WHERE searched_at >= NOW() - INTERVAL ? DAY
+		GROUP BY term
+	) s ON s.term = LOWER(CASE WHEN d.kind = 'city' THEN d.city ELSE d.country END)`
+
+// get_destinations returns every destination ranked by popularity. It is
+// cached for DESTINATIONS_CACHE_TTL as autocomplete asks on every keystroke.
+func get_destinations() []Destination {
+	destinations_mutex.Lock()
+	defer destinations_mutex.Unlock()
+
+	if destinations_cache != nil && time.Since(destinations_built) < DESTINATIONS_CACHE_TTL {
+		return destinations_cache
+	}
+
+	days := DESTINATION_POPULARITY_DAYS
+	rows, err := db.Query(destinations_query, days, days, days)
+	if err != nil {
+		log.Printf("Error fetching destinations: %v", err)
+		return destinations_cache
+	}
+	defer rows.Close()
+
+	destinations := []Destination{}
+	for rows.Next() {
+		var d Destination
+		var listingImage string
+		err := rows.Scan(&d.Kind, &d.City, &d.Country, &d.ListingCount, &d.BookingCount, &d.SearchCount, &listingImage)
+		if err != nil {
+			log.Printf("Error scanning destination: %v", err)
+			continue
+		}
+
+		d.Name = d.Country
+		if d.Kind == "city" {
+			d.Name = d.City
+		}
+		d.Score = float64(d.ListingCount)*DESTINATION_LISTING_WEIGHT +
+			float64(d.BookingCount)*DESTINATION_BOOKING_WEIGHT +
+			float64(d.SearchCount)*DESTINATION_SEARCH_WEIGHT
+		d.ImageURL = destination_image(d.Name, listingImage)
+		destinations = append(destinations, d)
+	}
+
+	sort.SliceStable(destinations, func(i, j int) bool {
+		if destinations[i].Score != destinations[j].Score {
+			return destinations[i].Score > destinations[j].Score
+		}
+		return destinations[i].ListingCount > destinations[j].ListingCount
+	})
+
+	destinations_cache = destinations
+	destinations_built = time.Now()
+	return destinations_cache
+}
+
+// destination_image prefers a bundled picture of the place, e.g.
+// static/images/new_york.jpg, over a photo of one of its listings
+func destination_image(name, listingImage string) string {
+	file := "static/images/" + strings.Join(search_tokens(name), "_") + ".jpg"
+	if _, err := os.Stat(file); err == nil {
+		return "/" + file
+	}
+	return listingImage
+}
+
+// get_popular_destinations returns the most popular cities
+func get_popular_destinations(limit int) []Destination {
+	var popular []Destination
+	for _, d := range get_destinations() {
+		if d.Kind == "city" {
+			popular = append(popular, d)
+			if len(popular) == limit {
+				break
+			}
+		}
+	}
+	return popular
+}
+
+// autocomplete_destinations suggests destinations whose name, or a word of it,
+// starts with the typed prefix. Synonyms such as "NYC" suggest their
+// destination too. Whole-name prefix matches come first, then popularity.
+func autocomplete_destinations(prefix string, limit int) []Destination {
+	prefix = strings.Join(search_tokens(prefix), " ")
+	if prefix == "" {
+		return get_popular_destinations(limit)
+	}
+	synonyms := get_search_synonyms(prefix)
+
+	type suggestion struct {
+		destination Destination
+		rank        int
+	}
+	var suggestions []suggestion
+
+	for _, d := range get_destinations() {
+		name := strings.Join(search_tokens(d.Name), " ")
+		rank := 0
+		switch {
+		case strings.HasPrefix(name, prefix):
+			rank = 3
+		case contains_string(synonyms, name):
+			rank = 2
+		case strings.Contains(" "+name, " "+prefix):
+			rank = 1
+		}
+		if rank > 0 {
+			suggestions = append(suggestions, suggestion{d, rank})
+		}
+	}
+
+	// get_destinations is ordered by popularity, keep that order within a rank
+	sort.SliceStable(suggestions, func(i, j int) bool {
+		return suggestions[i].rank > suggestions[j].rank
+	})
+
+	destinations := []Destination{}
+	for _, s := range suggestions {
+		if len(destinations) == limit {
+			break
+		}
+		destinations = append(destinations, s.destination)
+	}
+	return destinations
+}
+
+func contains_string(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// record_destination_search counts a search towards the popularity of the
+// destination searched for
+func record_destination_search(destination string) {
+	term := strings.Join(search_tokens(destination), " ")
+	if term == "" || len(term) > 100 {
+		return
+	}
+	_, err := db.Exec(`INSERT INTO DestinationSearches (term) VALUES (?)`, term)
+	if err != nil {
+		log.Printf("Error recording destination search: %v", err)
+	}
+}
+
+// api_destinations_handler serves destination suggestions for the search box,
+// or the popular destinations when no prefix is given
+func api_destinations_handler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		write_json_error(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	limit := DESTINATION_SUGGESTIONS
+	if n, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && n > 0 && n <= 20 {
+		limit = n
+	}
+
+	type suggestion struct {
+		Destination
+		Label string `json:"label"`
+	}
+	suggestions := []suggestion{}
+	for _, d := range autocomplete_destinations(r.URL.Query().Get("q"), limit) {
+		suggestions = append(suggestions, suggestion{d, d.Label()})
+	}
+
+	write_json(w, http.StatusOK, suggestions)
+}
+
+func update_tables_for_destinations() {
+	createQuery := `CREATE TABLE IF NOT EXISTS DestinationSearches (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		term VARCHAR(100) NOT NULL,
+		searched_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		INDEX idx_searched_term (searched_at, term)
+	)`
+
+	_, err := db.Exec(createQuery)
+	if err != nil {
+		log.Printf("Error creating destination searches table: %v", err)
+	}
+
+	log.Println("Tables updated for destinations")
+}
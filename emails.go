@@ -0,0 +1,467 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html"
+	"html/template"
+	"log"
+	"math"
+	"mime"
+	"net/http"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	EMAIL_BOOKING_CONFIRMATION = "booking_confirmation"
+	EMAIL_HOST_BOOKING_ALERT   = "host_booking_alert"
+	EMAIL_REVIEW_INVITATION    = "review_invitation"
+	EMAIL_BOOKING_CANCELLED    = "booking_cancelled"
+	EMAIL_CHECKIN_REMINDER     = "checkin_reminder"
+	EMAIL_REVIEW_REMINDER      = "review_reminder"
+)
+
+const EMAIL_FROM = "AirBnB Clone <no-reply@airbnb-clone.local>"
+const EMAIL_MAIL_DIR = "data/mail"
+const EMAIL_MAX_ATTEMPTS = 6
+const EMAIL_BATCH_SIZE = 20
+const EMAIL_POLL_INTERVAL = 10 * time.Second
+
+// How long a claimed email stays hidden from other workers while it is sent
+const EMAIL_CLAIM_TIMEOUT = 10 * time.Minute
+
+// email_preference_columns maps each email kind to the preference column that
+// lets the user turn it off
+var email_preference_columns = map[string]string{
+	EMAIL_BOOKING_CONFIRMATION: "booking_confirmations",
+	EMAIL_HOST_BOOKING_ALERT:   "host_alerts",
+	EMAIL_REVIEW_INVITATION:    "review_invitations",
+	EMAIL_BOOKING_CANCELLED:    "cancellations",
+	EMAIL_CHECKIN_REMINDER:     "booking_confirmations",
+	EMAIL_REVIEW_REMINDER:      "review_invitations",
+	EMAIL_SAVED_SEARCH_ALERT:   "saved_search_alerts",
+}
+
+type EmailMessage struct {
+	To       string
+	Subject  string
+	HTMLBody string
+}
+
+// Mailer delivers a rendered email
+type Mailer interface {
+	Send(message EmailMessage) error
+}
+
+// FileMailer writes each email to a file for local development
+type FileMailer struct {
+	Dir string
+}
+
+func (m FileMailer) Send(message EmailMessage) error {
+	if err := os.MkdirAll(m.Dir, 0755); err != nil {
+		return err
+	}
+
+	name := fmt.Sprintf("%s_%s.eml", time.Now().Format("20060102-150405.000000"), sanitize_filename(message.To))
+	return os.WriteFile(filepath.Join(m.Dir, name), build_mime_message(message), 0644)
+}
+
+// SMTPMailer sends through an SMTP server such as a local mail sink
+type SMTPMailer struct {
+	Addr     string
+	Username string
+	Password string
+}
+
+func (m SMTPMailer) Send(message EmailMessage) error {
+	var auth smtp.Auth
+	if m.Username != "" {
+		host := strings.Split(m.Addr, ":")[0]
+		auth = smtp.PlainAuth("", m.Username, m.Password, host)
+	}
+	return smtp.SendMail(m.Addr, auth, "no-reply@airbnb-clone.local", []string{header_value(message.To)}, build_mime_message(message))
+}
+
+// header_value keeps a value on one header line. Subjects contain listing
+// titles and search names, a line break there would start a new header.
+func header_value(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+func build_mime_message(message EmailMessage) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", EMAIL_FROM)
+	fmt.Fprintf(&b, "To: %s\r\n", header_value(message.To))
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", header_value(message.Subject)))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/html; charset=UTF-8\r\n\r\n")
+	b.WriteString(message.HTMLBody)
+	return b.Bytes()
+}
+
+func sanitize_filename(s string) string {
+	return strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '.' || r == '-' {
+			return r
+		}
+		return '_'
+	}, s)
+}
+
+// get_mailer uses SMTP when SMTP_ADDR is set and writes files otherwise
+func get_mailer() Mailer {
+	if addr := os.Getenv("SMTP_ADDR"); addr != "" {
+		return SMTPMailer{Addr: addr, Username: os.Getenv("SMTP_USERNAME"), Password: os.Getenv("SMTP_PASSWORD")}
+	}
+	return FileMailer{Dir: EMAIL_MAIL_DIR}
+}
+
+// get_base_url is used for absolute links in emails
+func get_base_url() string {
+	if url := os.Getenv("BASE_URL"); url != "" {
+		return strings.TrimSuffix(url, "/")
+	}
+	return "http://localhost:8080"
+}
+
+// booking_email_data loads what booking emails show, reading through the
+// caller's transaction so uncommitted bookings are visible
+func booking_email_data(q interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}, bookingID int) (map[string]interface{}, error) {
+	var title, city, startDate, endDate, currency, guestName, hostName string
+	var guests int
+	var total float64
+	query := `SELECT p.title, p.city, DATE_FORMAT(b.start_date, '%Y-%m-%d'), DATE_FORMAT(b.end_date, '%Y-%m-%d'),
+		       b.guests, b.total_price, COALESCE(b.currency, 'USD'), g.username, h.username
+		FROM Bookings b
+		JOIN Posts p ON b.post_id = p.id
+		JOIN Users g ON b.user_id = g.id
+		JOIN Users h ON b.host_id = h.id
+		WHERE b.id = ?`
+	err := q.QueryRow(query, bookingID).Scan(&title, &city, &startDate, &endDate, &guests, &total, &currency, &guestName, &hostName)
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{
+		"BookingID":     bookingID,
+		"PropertyTitle": title,
+		"City":          city,
+		"StartDate":     startDate,
+		"EndDate":       endDate,
+		"Guests":        guests,
+		"Total":         fmt.Sprintf("%.2f", total),
+		"Currency":      currency,
+		"GuestName":     guestName,
+		"HostName":      hostName,
+		"Link":          fmt.Sprintf("%s/bookings/%d", get_base_url(), bookingID),
+	}, nil
+}
+
+// enqueue_email adds an email to the outbox. Pass the transaction of the
+// change that triggers it so the email is only sent if that change commits.
+// Users who turned the kind off in their preferences are skipped.
+func enqueue_email(q interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}, userID int, kind string, data map[string]interface{}) error {
+	column, ok := email_preference_columns[kind]
+	if !ok {
+		return fmt.Errorf("unknown email kind %q", kind)
+	}
+
+	var email string
+	enabled := true
+	query := `SELECT u.email, COALESCE(p.` + column + `, true)
+		FROM Users u
+		LEFT JOIN EmailPreferences p ON p.user_id = u.id
+		WHERE u.id = ?`
+	err := q.QueryRow(query, userID).Scan(&email, &enabled)
+	if err != nil {
+		return err
+	}
+	if !enabled || email == "" {
+		return nil
+	}
+
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	_, err = q.Exec(`INSERT INTO EmailOutbox (user_id, to_address, kind, payload) VALUES (?, ?, ?, ?)`,
+		userID, email, kind, string(payload))
+	return err
+}
+
+// render_email executes template/emails/{kind}.html, which defines a
+// "subject" and a "body" template
+func render_email(kind string, payload string) (string, string, error) {
+	var data map[string]interface{}
+	if err := json.Unmarshal([]byte(payload), &data); err != nil {
+		return "", "", err
+	}
+
+	tmpl, err := template.ParseFiles("template/emails/layout.html", "template/emails/"+kind+".html")
+	if err != nil {
+		return "", "", err
+	}
+
+	var subject, body bytes.Buffer
+	if err := tmpl.ExecuteTemplate(&subject, "subject", data); err != nil {
+		return "", "", err
+	}
+	if err := tmpl.ExecuteTemplate(&body, "layout", data); err != nil {
+		return "", "", err
+	}
+
+	// The subject is plain text on a single line, undo the HTML escaping
+	return header_value(html.UnescapeString(subject.String())), body.String(), nil
+}
+
+func truncate_error(err error) string {
+	message := err.Error()
+	if utf8.RuneCountInString(message) > 500 {
+		message = string([]rune(message)[:500])
+	}
+	return message
+}
+
+type outbox_email struct {
+	ID       int
+	To       string
+	Kind     string
+	Payload  string
+	Attempts int
+}
+
+// claim_outbox_emails reserves due emails for this worker. Each row is claimed
+// with a conditional update so concurrent workers never send the same email;
+// a claim expires if the worker dies before finishing.
+func claim_outbox_emails(limit int) ([]outbox_email, error) {
+	rows, err := db.Query(`SELECT id, to_address, kind, payload, attempts FROM EmailOutbox
+		WHERE status IN ('pending', 'sending') AND next_attempt_at <= NOW()
+		ORDER BY next_attempt_at LIMIT ?`, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	var candidates []outbox_email
+	for rows.Next() {
+		var email outbox_email
+		if err := rows.Scan(&email.ID, &email.To, &email.Kind, &email.Payload, &email.Attempts); err != nil {
+			log.Printf("Error scanning outbox email: %v", err)
+			continue
+		}
+		candidates = append(candidates, email)
+	}
+	rows.Close()
+
+	var claimed []outbox_email
+	for _, email := range candidates {
+		result, err := db.Exec(`UPDATE EmailOutbox SET status = 'sending', next_attempt_at = NOW() + INTERVAL ? SECOND
+			WHERE id = ? AND status IN ('pending', 'sending') AND next_attempt_at <= NOW()`,
+			int(EMAIL_CLAIM_TIMEOUT.Seconds()), email.ID)
+		if err != nil {
+			return claimed, err
+		}
+		if n, _ := result.RowsAffected(); n == 1 {
+			claimed = append(claimed, email)
+		}
+	}
+
+	return claimed, nil
+}
+
+// email_retry_delay backs off exponentially from one minute up to four hours
+func email_retry_delay(attempts int) time.Duration {
+	delay := time.Minute * time.Duration(math.Pow(2, float64(attempts-1)))
+	if delay > 4*time.Hour {
+		delay = 4 * time.Hour
+	}
+	return delay
+}
+
+func deliver_outbox_email(mailer Mailer, email outbox_email) {
+	subject, body, err := render_email(email.Kind, email.Payload)
+	if err == nil {
+		err = mailer.Send(EmailMessage{To: email.To, Subject: subject, HTMLBody: body})
+	}
+
+	if err == nil {
+		_, err = db.Exec(`UPDATE EmailOutbox SET status = 'sent', attempts = attempts + 1, sent_at = NOW(), last_error = NULL
+			WHERE id = ?`, email.ID)
+		if err != nil {
+			log.Printf("Error marking email %d sent: %v", email.ID, err)
+		}
+		return
+	}
+
+	attempts := email.Attempts + 1
+	log.Printf("Error sending email %d (attempt %d): %v", email.ID, attempts, err)
+
+	status := "pending"
+	if attempts >= EMAIL_MAX_ATTEMPTS {
+		status = "failed"
+	}
+	_, dbErr := db.Exec(`UPDATE EmailOutbox SET status = ?, attempts = ?, last_error = ?, next_attempt_at = NOW() + INTERVAL ? SECOND
+		WHERE id = ?`, status, attempts, truncate_error(err), int(email_retry_delay(attempts).Seconds()), email.ID)
+	if dbErr != nil {
+		log.Printf("Error rescheduling email %d: %v", email.ID, dbErr)
+	}
+}
+
+// process_email_outbox sends one batch of due emails and returns how many it handled
+func process_email_outbox(mailer Mailer) (int, error) {
+	emails, err := claim_outbox_emails(EMAIL_BATCH_SIZE)
+	for _, email := range emails {
+		deliver_outbox_email(mailer, email)
+	}
+	return len(emails), err
+}
+
+// start_email_worker polls the outbox in the background
+func start_email_worker(mailer Mailer) {
+	go func() {
+		ticker := time.NewTicker(EMAIL_POLL_INTERVAL)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			// Keep going while full batches come back
+			for {
+				handled, err := process_email_outbox(mailer)
+				if err != nil {
+					log.Printf("Error processing email outbox: %v", err)
+					break
+				}
+				if handled < EMAIL_BATCH_SIZE {
+					break
+				}
+			}
+		}
+	}()
+}
+
+type EmailPreferences struct {
+	BookingConfirmations bool
+	HostAlerts           bool
+	ReviewInvitations    bool
+	Cancellations        bool
+	SavedSearchAlerts    bool
+}
+
+func get_email_preferences(userID int) EmailPreferences {
+	prefs := EmailPreferences{true, true, true, true, true}
+	query := `SELECT booking_confirmations, host_alerts, review_invitations, cancellations, saved_search_alerts
+		FROM EmailPreferences WHERE user_id = ?`
+	err := db.QueryRow(query, userID).Scan(&prefs.BookingConfirmations, &prefs.HostAlerts,
+		&prefs.ReviewInvitations, &prefs.Cancellations, &prefs.SavedSearchAlerts)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("Error fetching email preferences: %v", err)
+	}
+	return prefs
+}
+
+func update_email_preferences(userID int, prefs EmailPreferences) error {
+	query := `INSERT INTO EmailPreferences (user_id, booking_confirmations, host_alerts, review_invitations, cancellations, saved_search_alerts)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE booking_confirmations = VALUES(booking_confirmations), host_alerts = VALUES(host_alerts),
+			review_invitations = VALUES(review_invitations), cancellations = VALUES(cancellations),
+			saved_search_alerts = VALUES(saved_search_alerts)`
+	_, err := db.Exec(query, userID, prefs.BookingConfirmations, prefs.HostAlerts, prefs.ReviewInvitations, prefs.Cancellations,
+		prefs.SavedSearchAlerts)
+	return err
+}
+
+func email_preferences_handler(w http.ResponseWriter, r *http.Request) {
+	authenticated, userID := is_authenticated(r)
+	if !authenticated {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		templateData := struct {
+			Auth        AuthContext
+			Preferences EmailPreferences
+			Saved       bool
+		}{
+			Auth:        get_auth(r),
+			Preferences: get_email_preferences(userID),
+			Saved:       r.URL.Query().Get("saved") == "1",
+		}
+
+		tmpl := template.Must(template.ParseFiles("template/email_preferences.html"))
+		err := tmpl.Execute(w, templateData)
+		if err != nil {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			log.Println("Error executing template:", err)
+		}
+
+	case http.MethodPost:
+		prefs := EmailPreferences{
+			BookingConfirmations: r.FormValue("booking_confirmations") == "on",
+			HostAlerts:           r.FormValue("host_alerts") == "on",
+			ReviewInvitations:    r.FormValue("review_invitations") == "on",
+			Cancellations:        r.FormValue("cancellations") == "on",
+			SavedSearchAlerts:    r.FormValue("saved_search_alerts") == "on",
+		}
+		if err := update_email_preferences(userID, prefs); err != nil {
+			http.Error(w, "Error saving preferences", http.StatusInternalServerError)
+			log.Println("Error saving email preferences:", err)
+			return
+		}
+		http.Redirect(w, r, "/email-preferences?saved=1", http.StatusSeeOther)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func update_tables_for_emails() {
+	createQueries := []string{
+		`CREATE TABLE IF NOT EXISTS EmailOutbox (
+			id INT AUTO_INCREMENT PRIMARY KEY,
+			user_id INT NOT NULL,
+			to_address VARCHAR(255) NOT NULL,
+			kind VARCHAR(40) NOT NULL,
+			payload TEXT NOT NULL,
+			status ENUM('pending', 'sending', 'sent', 'failed') NOT NULL DEFAULT 'pending',
+			attempts INT NOT NULL DEFAULT 0,
+			last_error VARCHAR(500) NULL,
+			next_attempt_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			sent_at DATETIME NULL,
+			INDEX idx_due (status, next_attempt_at),
+			FOREIGN KEY (user_id) REFERENCES Users(id) ON DELETE CASCADE ON UPDATE CASCADE
+		)`,
+		`CREATE TABLE IF NOT EXISTS EmailPreferences (
+			user_id INT PRIMARY KEY,
+			booking_confirmations BOOLEAN NOT NULL DEFAULT TRUE,
+			host_alerts BOOLEAN NOT NULL DEFAULT TRUE,
+			review_invitations BOOLEAN NOT NULL DEFAULT TRUE,
+			cancellations BOOLEAN NOT NULL DEFAULT TRUE,
+			FOREIGN KEY (user_id) REFERENCES Users(id) ON DELETE CASCADE ON UPDATE CASCADE
+		)`,
+	}
+
+	for _, query := range createQueries {
+		_, err := db.Exec(query)
+		if err != nil {
+			log.Printf("Error creating email tables: %v", err)
+		}
+	}
+
+	log.Println("Tables updated for email notifications")
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"math"
+	"strings"
+)
+
+// Number of bars of the price histogram and cities listed
+const (
+	PRICE_BUCKETS = 10
+	FACET_CITIES  = 8
+)
+
+var property_type_icons = map[string]string{
+	"apartment": "🏢",
+	"house":     "🏡",
+	"room":      "🛏️",
+	"other":     "🏕️",
+}
+
+// HasAmenity reports whether the search filters on the amenity
+func (params SearchParams) HasAmenity(key string) bool {
+	return contains_string(params.Amenities, key)
+}
+
+// FacetCount is how many results a filter value would leave
+type FacetCount struct {
+	Value    string
+	Label    string
+	Icon     string
+	Count    int
+	Selected bool
+}
+
+// PriceBucket is a bar of the price histogram, in the viewer's currency.
+// Height is relative to the tallest bar.
+type PriceBucket struct {
+	Min    float64
+	Max    float64
+	Count  int
+	Height float64
+}
+
+// SearchFacets are counted over the current filters. The property types and
+// price histogram ignore their own filter so other values stay visible.
+type SearchFacets struct {
+	Amenities     []FacetCount
+	PropertyTypes []FacetCount
+	Cities        []FacetCount
+	PriceBuckets  []PriceBucket
+	Currency      string
+}
+
+// new_search_facets lists every active amenity and property type with no
+// results
+func new_search_facets(params SearchParams) *SearchFacets {
+	facets := &SearchFacets{Currency: params.Currency}
+	for _, amenity := range get_active_amenities() {
+		facets.Amenities = append(facets.Amenities, FacetCount{
+			Value:    amenity.Key,
+			Label:    amenity.Label,
+			Icon:     amenity.Icon,
+			Selected: params.HasAmenity(amenity.Key),
+		})
+	}
+	for _, propertyType := range listing_property_types {
+		facets.PropertyTypes = append(facets.PropertyTypes, FacetCount{
+			Value:    propertyType,
+			Label:    strings.ToUpper(propertyType[:1]) + propertyType[1:],
+			Icon:     property_type_icons[propertyType],
+			Selected: params.HasPropertyType(propertyType),
+		})
+	}
+	return facets
+}
+
+// get_search_facets counts the facets of a search. params.Currency must be set.
+func get_search_facets(params SearchParams) (*SearchFacets, error) {
+	facets := new_search_facets(params)
+	filters := build_search_filters(params)
+
+	// Amenities: results that also have each amenity
+	query := fmt.Sprintf(`SELECT fa.amenity_id, COUNT(DISTINCT p.id) FROM Posts p %s
+		JOIN ListingAmenities fa ON fa.post_id = p.id
+		WHERE %s GROUP BY fa.amenity_id`, filters.Joins, filters.Where)
+	rows, err := db.Query(query, filters.Args...)
+	if err != nil {
+		log.Printf("Error counting amenity facets: %v", err)
+		return nil, err
+	}
+	amenityCounts := make(map[int]int)
+	for rows.Next() {
+		var amenityID, count int
+		if err := rows.Scan(&amenityID, &count); err == nil {
+			amenityCounts[amenityID] = count
+		}
+	}
+	rows.Close()
+	for i := range facets.Amenities {
+		if amenity, ok := find_amenity(facets.Amenities[i].Value); ok {
+			facets.Amenities[i].Count = amenityCounts[amenity.ID]
+		}
+	}
+
+	// Property types, whichever types are selected
+	typeParams := params
+	typeParams.PropertyTypes = nil
+	typeFilters := build_search_filters(typeParams)
+	query = fmt.Sprintf(`SELECT p.type, COUNT(DISTINCT p.id) FROM Posts p %s WHERE %s GROUP BY p.type`,
+		typeFilters.Joins, typeFilters.Where)
+	rows, err = db.Query(query, typeFilters.Args...)
+	if err != nil {
+		log.Printf("Error counting property type facets: %v", err)
+		return nil, err
+	}
+	typeCounts := make(map[string]int)
+	for rows.Next() {
+		var propertyType string
+		var count int
+		if err := rows.Scan(&propertyType, &count); err == nil {
+			typeCounts[propertyType] = count
+		}
+	}
+	rows.Close()
+	for i := range facets.PropertyTypes {
+		facets.PropertyTypes[i].Count = typeCounts[facets.PropertyTypes[i].Value]
+	}
+
+	// Top cities of the results
+	query = fmt.Sprintf(`SELECT p.city, COUNT(DISTINCT p.id) AS listings FROM Posts p %s
+		WHERE %s AND p.city IS NOT NULL AND p.city != ''
+		GROUP BY p.city ORDER BY listings DESC, p.city LIMIT ?`, filters.Joins, filters.Where)
+	rows, err = db.Query(query, append(append([]interface{}{}, filters.Args...), FACET_CITIES)...)
+	if err != nil {
+		log.Printf("Error counting city facets: %v", err)
+		return nil, err
+	}
+	for rows.Next() {
+		var facet FacetCount
+		if err := rows.Scan(&facet.Value, &facet.Count); err == nil {
+			facet.Label = facet.Value
+			facet.Selected = strings.EqualFold(facet.Value, params.Destination)
+			facets.Cities = append(facets.Cities, facet)
+		}
+	}
+	rows.Close()
+
+	facets.PriceBuckets, err = get_price_histogram(params)
+	if err != nil {
+		return nil, err
+	}
+
+	return facets, nil
+}
+
+// get_price_histogram buckets the nightly prices of the results, whatever the
+// price filter, in the viewer's currency
+func get_price_histogram(params SearchParams) ([]PriceBucket, error) {
+	priceParams := params
+	priceParams.MinPrice, priceParams.MaxPrice = 0, 0
+	filters := build_search_filters(priceParams)
+
+	rate, err := get_exchange_rate(BASE_CURRENCY, params.Currency)
+	if err != nil {
+		rate = 1
+	}
+	price := "p.price / COALESCE(er.rate, 1) * ?"
+
+	var minPrice, maxPrice sql.NullFloat64
+	query := fmt.Sprintf(`SELECT MIN(%s), MAX(%s) FROM Posts p %s WHERE %s`, price, price, filters.Joins, filters.Where)
+	args := append([]interface{}{rate, rate}, filters.Args...)
+	if err := db.QueryRow(query, args...).Scan(&minPrice, &maxPrice); err != nil {
+		log.Printf("Error fetching price range: %v", err)
+		return nil, err
+	}
+	if !minPrice.Valid || !maxPrice.Valid {
+		return nil, nil
+	}
+
+	width := price_bucket_width((maxPrice.Float64 - minPrice.Float64) / PRICE_BUCKETS)
+	start := math.Floor(minPrice.Float64/width) * width
+	bucketCount := max(1, int(math.Floor((maxPrice.Float64-start)/width))+1)
+
+	buckets := make([]PriceBucket, bucketCount)
+	for i := range buckets {
+		buckets[i].Min = start + float64(i)*width
+		buckets[i].Max = buckets[i].Min + width
+	}
+
+	query = fmt.Sprintf(`SELECT CAST(LEAST(FLOOR((%s - ?) / ?), ?) AS SIGNED) AS bucket, COUNT(DISTINCT p.id)
+		FROM Posts p %s WHERE %s GROUP BY bucket`, price, filters.Joins, filters.Where)
+	args = append([]interface{}{rate, start, width, bucketCount - 1}, filters.Args...)
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		log.Printf("Error counting price buckets: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	tallest := 0
+	for rows.Next() {
+		var bucket, count int
+		if err := rows.Scan(&bucket, &count); err != nil || bucket < 0 || bucket >= bucketCount {
+			continue
+		}
+		buckets[bucket].Count = count
+		tallest = max(tallest, count)
+	}
+	for i := range buckets {
+		if tallest > 0 {
+			buckets[i].Height = float64(buckets[i].Count) * 100 / float64(tallest)
+		}
+	}
+
+	return buckets, nil
+}
+
+// price_bucket_width rounds a width up to 1, 2 or 5 times a power of ten so
+// bucket edges are round prices
+func price_bucket_width(raw float64) float64 {
+	if raw <= 1 {
+		return 1
+	}
+	magnitude := math.Pow(10, math.Floor(math.Log10(raw)))
+	for _, step := range []float64{1, 2, 5, 10} {
+		if step*magnitude >= raw {
+			return step * magnitude
+		}
+	}
+	return 10 * magnitude
+}
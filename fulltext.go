@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+const SEARCH_SYNONYMS_FILE = "data/search_synonyms.json"
+
+// Words shorter than this aren't in the FULLTEXT index (innodb_ft_min_token_size)
+const FULLTEXT_MIN_WORD_LENGTH = 3
+
+// New listings become typo-correctable once the vocabulary is rebuilt
+const SEARCH_VOCABULARY_TTL = 10 * time.Minute
+
+const listing_fulltext_columns = "p.title, p.description, p.city, p.country"
+
+// Common words that would only make every listing match
+var search_stopwords = map[string]bool{
+	"the": true, "and": true, "for": true, "with": true, "near": true, "from": true,
+}
+
+var (
+	search_synonyms_mutex sync.RWMutex
+	search_synonyms       = map[string][]string{}
+
+	search_vocabulary_mutex sync.Mutex
+	search_vocabulary       map[string]bool
+	search_vocabulary_built time.Time
+)
+
+// load_search_synonyms reads the search synonyms, a JSON object mapping a
+// lowercase word to the phrases it also stands for
+func load_search_synonyms(path string) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var file map[string][]string
+	if err := json.Unmarshal(content, &file); err != nil {
+		return err
+	}
+
+	synonyms := make(map[string][]string)
+	for word, phrases := range file {
+		for _, phrase := range phrases {
+			if phrase = strings.Join(search_tokens(phrase), " "); phrase != "" {
+				synonyms[strings.ToLower(word)] = append(synonyms[strings.ToLower(word)], phrase)
+			}
+		}
+	}
+
+	search_synonyms_mutex.Lock()
+	search_synonyms = synonyms
+	search_synonyms_mutex.Unlock()
+
+	log.Printf("Loaded %d search synonyms", len(synonyms))
+	return nil
+}
+
+func get_search_synonyms(word string) []string {
+	search_synonyms_mutex.RLock()
+	defer search_synonyms_mutex.RUnlock()
+	return search_synonyms[word]
+}
+
+// search_tokens splits text into lowercase words
+func search_tokens(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// get_search_vocabulary returns every indexed word of the listings, used to
+// correct misspelled search words. It is rebuilt when older than
+// SEARCH_VOCABULARY_TTL.
+func get_search_vocabulary() map[string]bool {
+	search_vocabulary_mutex.Lock()
+	defer search_vocabulary_mutex.Unlock()
+
+	if search_vocabulary != nil && time.Since(search_vocabulary_built) < SEARCH_VOCABULARY_TTL {
+		return search_vocabulary
+	}
+
+	rows, err := db.Query(`SELECT title, description, COALESCE(city, ''), country FROM Posts`)
+	if err != nil {
+		log.Printf("Error building search vocabulary: %v", err)
+		return search_vocabulary
+	}
+	defer rows.Close()
+
+	vocabulary := make(map[string]bool)
+	for rows.Next() {
+		var title, description, city, country string
+		if err := rows.Scan(&title, &description, &city, &country); err != nil {
+			continue
+		}
+		for _, word := range search_tokens(strings.Join([]string{title, description, city, country}, " ")) {
+			if len([]rune(word)) >= FULLTEXT_MIN_WORD_LENGTH {
+				vocabulary[word] = true
+			}
+		}
+	}
+
+	search_vocabulary = vocabulary
+	search_vocabulary_built = time.Now()
+	return search_vocabulary
+}
+
+// edit_distance is the number of insertions, deletions, substitutions and
+// swaps of adjacent letters needed to turn a into b
+func edit_distance(a, b string) int {
+	s, t := []rune(a), []rune(b)
+	d := make([][]int, len(s)+1)
+	for i := range d {
+		d[i] = make([]int, len(t)+1)
+		d[i][0] = i
+	}
+	for j := range d[0] {
+		d[0][j] = j
+	}
+
+	for i := 1; i <= len(s); i++ {
+		for j := 1; j <= len(t); j++ {
+			cost := 1
+			if s[i-1] == t[j-1] {
+				cost = 0
+			}
+			d[i][j] = min(d[i-1][j]+1, d[i][j-1]+1, d[i-1][j-1]+cost)
+			if i > 1 && j > 1 && s[i-1] == t[j-2] && s[i-2] == t[j-1] {
+				d[i][j] = min(d[i][j], d[i-2][j-2]+1)
+			}
+		}
+	}
+	return d[len(s)][len(t)]
+}
+
+// typo_corrections returns the closest vocabulary words to a word that isn't
+// in the vocabulary. Short words allow one typo, longer ones two.
+func typo_corrections(word string, vocabulary map[string]bool) []string {
+	length := len([]rune(word))
+	if length < 4 || vocabulary[word] {
+		return nil
+	}
+	maxDistance := 1
+	if length >= 8 {
+		maxDistance = 2
+	}
+
+	var corrections []string
+	best := maxDistance + 1
+	for candidate := range vocabulary {
+		if diff := len([]rune(candidate)) - length; diff > maxDistance || diff < -maxDistance {
+			continue
+		}
+		distance := edit_distance(word, candidate)
+		if distance < best {
+			best = distance
+			corrections = []string{candidate}
+		} else if distance == best {
+			corrections = append(corrections, candidate)
+		}
+	}
+
+	if len(corrections) > 3 {
+		corrections = corrections[:3]
+	}
+	return corrections
+}
+
+// build_fulltext_query turns a search into a boolean mode FULLTEXT query.
+// Every word of the search must match, either as typed (or as a prefix), as
+// one of its synonyms, or as a vocabulary word it is a likely typo of.
+func build_fulltext_query(search string) string {
+	var vocabulary map[string]bool
+	var groups []string
+
+	for _, word := range search_tokens(search) {
+		if search_stopwords[word] {
+			continue
+		}
+
+		var terms []string
+		if len([]rune(word)) >= FULLTEXT_MIN_WORD_LENGTH {
+			terms = append(terms, word+"*")
+		}
+
+		synonyms := get_search_synonyms(word)
+		for _, phrase := range synonyms {
+			terms = append(terms, `"`+phrase+`"`)
+		}
+
+		if len(synonyms) == 0 {
+			if vocabulary == nil {
+				vocabulary = get_search_vocabulary()
+			}
+			terms = append(terms, typo_corrections(word, vocabulary)...)
+		}
+
+		if len(terms) > 0 {
+			groups = append(groups, "+("+strings.Join(terms, " ")+")")
+		}
+	}
+
+	return strings.Join(groups, " ")
+}
+
+// DestinationMatch is how search_listings filters and ranks listings by the
+// destination searched for
+type DestinationMatch struct {
+	Condition     string
+	ConditionArgs []interface{}
+	Relevance     string
+	RelevanceArgs []interface{}
+}
+
+// match_destination searches the FULLTEXT index and ranks by its score. A
+// search made only of words too short to be indexed falls back to LIKE.
+func match_destination(destination string) DestinationMatch {
+	if query := build_fulltext_query(destination); query != "" {
+		match := fmt.Sprintf("MATCH(%s) AGAINST (? IN BOOLEAN MODE)", listing_fulltext_columns)
+		return DestinationMatch{
+			Condition:     match,
+			ConditionArgs: []interface{}{query},
+			Relevance:     match,
+			RelevanceArgs: []interface{}{query},
+		}
+	}
+
+	// Exact place matches first, then places starting with the search, then
+	// listings that only mention it in their title
+	prefix := destination + "%"
+	contains := "%" + destination + "%"
+	return DestinationMatch{
+		Condition:     "(p.city LIKE ? OR p.country LIKE ? OR p.title LIKE ?)",
+		ConditionArgs: []interface{}{contains, contains, contains},
+		Relevance: `CASE
+				WHEN p.city = ? OR p.country = ? THEN 3
+				WHEN p.city LIKE ? OR p.country LIKE ? THEN 2
+				WHEN p.title LIKE ? THEN 1
+				ELSE 0
+			END`,
+		RelevanceArgs: []interface{}{destination, destination, prefix, prefix, contains},
+	}
+}
+
+func update_tables_for_fulltext_search() {
+	_, err := db.Exec(`ALTER TABLE Posts ADD FULLTEXT INDEX ft_posts_search (title, description, city, country)`)
+	if err != nil {
+		log.Printf("Note: index might already exist: %v", err)
+	}
+
+	log.Println("Tables updated for full-text search")
+}
@@ -0,0 +1,489 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const GAZETTEER_FILE = "data/gazetteer.json"
+
+const EARTH_RADIUS_KM = 6371.0
+
+// Kilometres per degree of latitude
+const KM_PER_DEGREE = 111.045
+
+const (
+	DEFAULT_SEARCH_RADIUS_KM = 10.0
+	MAX_SEARCH_RADIUS_KM     = 500.0
+)
+
+// Listings geocoded per run of the geocode_listings job
+const GEOCODE_BATCH_SIZE = 50
+
+type GeoPoint struct {
+	Latitude  float64
+	Longitude float64
+}
+
+// GeoBounds is a map viewport. West is greater than East when it crosses the
+// antimeridian.
+type GeoBounds struct {
+	West  float64
+	South float64
+	East  float64
+	North float64
+}
+
+var ErrPlaceNotFound = fmt.Errorf("place not found")
+
+// Geocoder resolves a free-text place or address to coordinates. It returns
+// ErrPlaceNotFound when the place doesn't exist, other errors are transient.
+type Geocoder interface {
+	Geocode(query string) (GeoPoint, error)
+}
+
+// GazetteerPlace is a city, country or landmark of the bundled gazetteer
+type GazetteerPlace struct {
+	Name      string   `json:"name"`
+	Country   string   `json:"country"`
+	Aliases   []string `json:"aliases"`
+	Latitude  float64  `json:"latitude"`
+	Longitude float64  `json:"longitude"`
+}
+
+// GazetteerGeocoder resolves places offline from a bundled list of known
+// places. Addresses resolve to the most specific place they mention.
+type GazetteerGeocoder struct {
+	Places []GazetteerPlace
+}
+
+func load_gazetteer(path string) (*GazetteerGeocoder, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file struct {
+		Places []GazetteerPlace `json:"places"`
+	}
+	if err := json.Unmarshal(content, &file); err != nil {
+		return nil, err
+	}
+	return &GazetteerGeocoder{Places: file.Places}, nil
+}
+
+func normalize_place_name(name string) string {
+	return strings.Join(search_tokens(name), " ")
+}
+
+func (place GazetteerPlace) matches(name string) bool {
+	if normalize_place_name(place.Name) == name {
+		return true
+	}
+	for _, alias := range place.Aliases {
+		if normalize_place_name(alias) == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (g *GazetteerGeocoder) find(name string) []GazetteerPlace {
+	var found []GazetteerPlace
+	for _, place := range g.Places {
+		if place.matches(name) {
+			found = append(found, place)
+		}
+	}
+	return found
+}
+
+// Geocode tries the whole query, then each comma separated part from the most
+// specific. When a name is ambiguous the place in a country named in the query
+// wins.
+func (g *GazetteerGeocoder) Geocode(query string) (GeoPoint, error) {
+	parts := []string{normalize_place_name(query)}
+	for _, part := range strings.Split(query, ",") {
+		parts = append(parts, normalize_place_name(part))
+	}
+
+	mentioned := func(country string) bool {
+		for _, countryPlace := range g.find(normalize_place_name(country)) {
+			for _, part := range parts[1:] {
+				if countryPlace.matches(part) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	for _, part := range parts {
+		if part == "" {
+			continue
+		}
+		candidates := g.find(part)
+		for _, place := range candidates {
+			if place.Country == "" || mentioned(place.Country) {
+				return GeoPoint{place.Latitude, place.Longitude}, nil
+			}
+		}
+		if len(candidates) > 0 {
+			return GeoPoint{candidates[0].Latitude, candidates[0].Longitude}, nil
+		}
+	}
+	return GeoPoint{}, ErrPlaceNotFound
+}
+
+// HTTPGeocoder queries a Nominatim compatible geocoding service
+type HTTPGeocoder struct {
+	URL string
+}
+
+func (g HTTPGeocoder) Geocode(query string) (GeoPoint, error) {
+	request, err := http.NewRequest(http.MethodGet, g.URL+"?"+url.Values{
+		"q":      {query},
+		"format": {"json"},
+		"limit":  {"1"},
+	}.Encode(), nil)
+	if err != nil {
+		return GeoPoint{}, err
+	}
+	request.Header.Set("User-Agent", "airbnb-clone")
+
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(request)
+	if err != nil {
+		return GeoPoint{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return GeoPoint{}, fmt.Errorf("geocoding service returned %s", resp.Status)
+	}
+
+	var results []struct {
+		Lat string `json:"lat"`
+		Lon string `json:"lon"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&results); err != nil {
+		return GeoPoint{}, err
+	}
+	if len(results) == 0 {
+		return GeoPoint{}, ErrPlaceNotFound
+	}
+
+	latitude, err := strconv.ParseFloat(results[0].Lat, 64)
+	if err != nil {
+		return GeoPoint{}, err
+	}
+	longitude, err := strconv.ParseFloat(results[0].Lon, 64)
+	if err != nil {
+		return GeoPoint{}, err
+	}
+	return GeoPoint{latitude, longitude}, nil
+}
+
+var (
+	geocoder_once sync.Once
+	geocoder      Geocoder
+)
+
+// get_geocoder uses the geocoding service when GEOCODER_URL is set and falls
+// back to the bundled gazetteer otherwise
+func get_geocoder() Geocoder {
+	geocoder_once.Do(func() {
+		if serviceURL := os.Getenv("GEOCODER_URL"); serviceURL != "" {
+			geocoder = HTTPGeocoder{URL: serviceURL}
+			return
+		}
+		gazetteer, err := load_gazetteer(GAZETTEER_FILE)
+		if err != nil {
+			log.Printf("Error loading gazetteer: %v", err)
+			gazetteer = &GazetteerGeocoder{}
+		}
+		geocoder = gazetteer
+	})
+	return geocoder
+}
+
+// geocode_listing stores the coordinates of a listing's address. Addresses
+// that can't be found are marked so they aren't retried until edited.
+func geocode_listing(listingID int) error {
+	var address, city, country string
+	err := db.QueryRow(`SELECT address, COALESCE(city, ''), country FROM Posts WHERE id = ?`, listingID).Scan(&address, &city, &country)
+	if err != nil {
+		return err
+	}
+
+	point, err := get_geocoder().Geocode(strings.Join([]string{address, city, country}, ", "))
+	if err == ErrPlaceNotFound {
+		log.Printf("Could not geocode listing %d", listingID)
+		_, err = db.Exec(`UPDATE Posts SET latitude = NULL, longitude = NULL, geocoded_at = NOW() WHERE id = ?`, listingID)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`UPDATE Posts SET latitude = ?, longitude = ?, geocoded_at = NOW() WHERE id = ?`,
+		point.Latitude, point.Longitude, listingID)
+	return err
+}
+
+// reset_listing_geocode queues a listing for the geocode_listings job
+func reset_listing_geocode(listingID int) {
+	_, err := db.Exec(`UPDATE Posts SET geocoded_at = NULL WHERE id = ?`, listingID)
+	if err != nil {
+		log.Printf("Error resetting geocode of listing %d: %v", listingID, err)
+	}
+}
+
+// geocode_listings geocodes listings added before geolocation or whose
+// geocoding failed
+func geocode_listings() error {
+	rows, err := db.Query(`SELECT id FROM Posts WHERE geocoded_at IS NULL ORDER BY id LIMIT ?`, GEOCODE_BATCH_SIZE)
+	if err != nil {
+		return err
+	}
+
+	var listingIDs []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err == nil {
+			listingIDs = append(listingIDs, id)
+		}
+	}
+	rows.Close()
+
+	var failed int
+	for _, id := range listingIDs {
+		if err := geocode_listing(id); err != nil {
+			log.Printf("Error geocoding listing %d: %v", id, err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d listings could not be geocoded", failed, len(listingIDs))
+	}
+	return nil
+}
+
+func register_geocoding_jobs() {
+	register_job(Job{Name: "geocode_listings", Interval: 5 * time.Minute, Run: geocode_listings})
+}
+
+// distance_km_sql is the great-circle distance in km between a listing and
+// center, by the haversine formula
+func distance_km_sql(center GeoPoint) (string, []interface{}) {
+	return fmt.Sprintf(`%g * 2 * ASIN(SQRT(
+			POWER(SIN(RADIANS(p.latitude - ?) / 2), 2) +
+			COS(RADIANS(?)) * COS(RADIANS(p.latitude)) * POWER(SIN(RADIANS(p.longitude - ?) / 2), 2)))`, EARTH_RADIUS_KM),
+		[]interface{}{center.Latitude, center.Latitude, center.Longitude}
+}
+
+// radius_condition matches listings within radiusKm of center. A bounding box
+// around the circle narrows the search on the location index first.
+func radius_condition(center GeoPoint, radiusKm float64) (string, []interface{}) {
+	latDelta := radiusKm / KM_PER_DEGREE
+	conditions := []string{"p.latitude BETWEEN ? AND ?"}
+	args := []interface{}{center.Latitude - latDelta, center.Latitude + latDelta}
+
+	// Near the poles or across the antimeridian the longitude range wraps,
+	// leave it to the distance check
+	if math.Abs(center.Latitude)+latDelta < 89 {
+		lngDelta := radiusKm / (KM_PER_DEGREE * math.Cos(center.Latitude*math.Pi/180))
+		if center.Longitude-lngDelta >= -180 && center.Longitude+lngDelta <= 180 {
+			conditions = append(conditions, "p.longitude BETWEEN ? AND ?")
+			args = append(args, center.Longitude-lngDelta, center.Longitude+lngDelta)
+		}
+	}
+
+	distance, distanceArgs := distance_km_sql(center)
+	conditions = append(conditions, distance+" <= ?")
+	args = append(args, distanceArgs...)
+	args = append(args, radiusKm)
+
+	return "(" + strings.Join(conditions, " AND ") + ")", args
+}
+
+func (b GeoBounds) condition() (string, []interface{}) {
+	if b.West <= b.East {
+		return "(p.latitude BETWEEN ? AND ? AND p.longitude BETWEEN ? AND ?)",
+			[]interface{}{b.South, b.North, b.West, b.East}
+	}
+	return "(p.latitude BETWEEN ? AND ? AND (p.longitude >= ? OR p.longitude <= ?))",
+		[]interface{}{b.South, b.North, b.West, b.East}
+}
+
+// String encodes the bounds as a GeoJSON bbox, west,south,east,north
+func (b GeoBounds) String() string {
+	values := make([]string, 0, 4)
+	for _, value := range []float64{b.West, b.South, b.East, b.North} {
+		values = append(values, strconv.FormatFloat(value, 'f', -1, 64))
+	}
+	return strings.Join(values, ",")
+}
+
+func parse_bounds(value string) (*GeoBounds, error) {
+	parts := strings.Split(value, ",")
+	if len(parts) != 4 {
+		return nil, fmt.Errorf("bbox must be west,south,east,north")
+	}
+
+	var numbers [4]float64
+	for i, part := range parts {
+		number, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil || math.IsNaN(number) || math.IsInf(number, 0) {
+			return nil, fmt.Errorf("bbox must be west,south,east,north")
+		}
+		numbers[i] = number
+	}
+
+	bounds := GeoBounds{West: numbers[0], South: numbers[1], East: numbers[2], North: numbers[3]}
+	if bounds.South > bounds.North || bounds.South < -90 || bounds.North > 90 ||
+		bounds.West < -180 || bounds.West > 180 || bounds.East < -180 || bounds.East > 180 {
+		return nil, fmt.Errorf("bbox is out of range")
+	}
+	return &bounds, nil
+}
+
+// resolve_search_location geocodes the place of a "near" search. Coordinates
+// given directly take precedence.
+func resolve_search_location(params *SearchParams) error {
+	if params.Center != nil || params.Near == "" {
+		return nil
+	}
+
+	point, err := get_geocoder().Geocode(params.Near)
+	if err != nil {
+		if err != ErrPlaceNotFound {
+			log.Printf("Error geocoding %q: %v", params.Near, err)
+		}
+		return fmt.Errorf("we couldn't find %s on the map", params.Near)
+	}
+	params.Center = &point
+	return nil
+}
+
+type GeoJSONFeature struct {
+	Type     string                 `json:"type"`
+	Geometry GeoJSONGeometry        `json:"geometry"`
+	Props    map[string]interface{} `json:"properties"`
+}
+
+type GeoJSONGeometry struct {
+	Type        string    `json:"type"`
+	Coordinates []float64 `json:"coordinates"`
+}
+
+type GeoJSONFeatureCollection struct {
+	Type     string           `json:"type"`
+	BBox     []float64        `json:"bbox,omitempty"`
+	Features []GeoJSONFeature `json:"features"`
+}
+
+// listings_geojson_handler returns the map markers of a listings page. It
+// takes the same query parameters as /listings.
+func listings_geojson_handler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		write_json_error(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	params := parse_search_params(r.URL.Query())
+	params.Currency = get_display_currency(r)
+	if err := resolve_search_location(&params); err != nil {
+		write_json_error(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	result, err := search_listings(params)
+	if err != nil {
+		write_json_error(w, http.StatusInternalServerError, "Error searching listings")
+		return
+	}
+
+	collection := GeoJSONFeatureCollection{Type: "FeatureCollection", Features: []GeoJSONFeature{}}
+	for _, listing := range result.Listings {
+		if !listing.HasLocation {
+			continue
+		}
+
+		props := map[string]interface{}{
+			"id":       listing.ID,
+			"title":    listing.Title,
+			"city":     listing.City,
+			"country":  listing.Country,
+			"type":     listing.Type,
+			"price":    math.Round(listing.DisplayPrice*100) / 100,
+			"currency": listing.DisplayCurrency,
+			"url":      fmt.Sprintf("/property/%d", listing.ID),
+			"image":    listing.ImageURL,
+		}
+		if listing.ReviewCount > 0 {
+			props["rating"] = listing.RatingAvg
+			props["review_count"] = listing.ReviewCount
+		}
+		if params.Center != nil {
+			props["distance_km"] = math.Round(listing.DistanceKm*10) / 10
+		}
+
+		collection.Features = append(collection.Features, GeoJSONFeature{
+			Type:     "Feature",
+			Geometry: GeoJSONGeometry{Type: "Point", Coordinates: []float64{listing.Longitude, listing.Latitude}},
+			Props:    props,
+		})
+
+		// The bbox frames every marker of the page
+		if collection.BBox == nil {
+			collection.BBox = []float64{listing.Longitude, listing.Latitude, listing.Longitude, listing.Latitude}
+		} else {
+			collection.BBox[0] = math.Min(collection.BBox[0], listing.Longitude)
+			collection.BBox[1] = math.Min(collection.BBox[1], listing.Latitude)
+			collection.BBox[2] = math.Max(collection.BBox[2], listing.Longitude)
+			collection.BBox[3] = math.Max(collection.BBox[3], listing.Latitude)
+		}
+	}
+
+	write_json(w, http.StatusOK, collection)
+}
+
+// scan_listing_location fills in the coordinates of a listing scanned as
+// nullable columns
+func scan_listing_location(listing *Listing, latitude, longitude, distance sql.NullFloat64) {
+	if latitude.Valid && longitude.Valid {
+		listing.HasLocation = true
+		listing.Latitude = latitude.Float64
+		listing.Longitude = longitude.Float64
+	}
+	listing.DistanceKm = distance.Float64
+}
+
+func update_tables_for_geolocation() {
+	alterQueries := []string{
+		`ALTER TABLE Posts ADD COLUMN latitude DECIMAL(9,6) NULL`,
+		`ALTER TABLE Posts ADD COLUMN longitude DECIMAL(9,6) NULL`,
+		`ALTER TABLE Posts ADD COLUMN geocoded_at DATETIME NULL`,
+		`ALTER TABLE Posts ADD INDEX idx_posts_location (latitude, longitude)`,
+	}
+
+	for _, query := range alterQueries {
+		_, err := db.Exec(query)
+		if err != nil {
+			log.Printf("Note: column might already exist: %v", err)
+		}
+	}
+
+	log.Println("Tables updated for geolocation")
+}
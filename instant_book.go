@@ -0,0 +1,20 @@
+package main
+
+import (
+	"log"
+)
+
+func update_listing_instant_book(listingID int, instantBook bool) error {
+	_, err := db.Exec(`UPDATE Posts SET instant_book = ? WHERE id = ?`, instantBook, listingID)
+	return err
+}
+
+func update_tables_for_instant_book() {
+	// Existing listings are all confirmed right away
+	_, err := db.Exec(`ALTER TABLE Posts ADD COLUMN instant_book BOOLEAN NOT NULL DEFAULT TRUE`)
+	if err != nil {
+		log.Printf("Note: column might already exist: %v", err)
+	}
+
+	log.Println("Tables updated for instant book")
+}
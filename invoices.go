@@ -0,0 +1,430 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Invoice is an immutable snapshot of a booking and its price breakdown taken
+// when the invoice is issued. Later changes to the booking, listing or users
+// don't change an issued invoice.
+type Invoice struct {
+	ID              int
+	InvoiceNumber   string
+	BookingID       int
+	GuestID         int
+	HostID          int
+	IssuedAt        time.Time
+	GuestName       string
+	GuestEmail      string
+	HostName        string
+	HostEmail       string
+	PropertyTitle   string
+	PropertyAddress string
+	StartDate       string
+	EndDate         string
+	Nights          int
+	Guests          int
+	NightlyRate     float64
+	Subtotal        float64
+	DiscountAmount  float64
+	PromotionCode   string
+	Total           float64
+	Currency        string
+	DisplayCurrency string
+	ExchangeRate    float64
+}
+
+func (i *Invoice) DisplayTotal() float64 {
+	return round_money(i.Total * i.ExchangeRate)
+}
+
+func format_invoice_number(year, sequence int) string {
+	return fmt.Sprintf("INV-%d-%06d", year, sequence)
+}
+
+// next_invoice_sequence reserves the next number for year. The sequence row is
+// locked for the rest of the transaction so concurrent invoices never share a
+// number and numbers have no gaps once committed.
+func next_invoice_sequence(tx *sql.Tx, year int) (int, error) {
+	_, err := tx.Exec("INSERT IGNORE INTO InvoiceSequences (year, last_number) VALUES (?, 0)", year)
+	if err != nil {
+		return 0, err
+	}
+
+	var lastNumber int
+	err = tx.QueryRow("SELECT last_number FROM InvoiceSequences WHERE year = ? FOR UPDATE", year).Scan(&lastNumber)
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = tx.Exec("UPDATE InvoiceSequences SET last_number = ? WHERE year = ?", lastNumber+1, year)
+	if err != nil {
+		return 0, err
+	}
+
+	return lastNumber + 1, nil
+}
+
+// issue_invoice_for_booking returns the booking's invoice, issuing it first if
+// it doesn't exist yet
+func issue_invoice_for_booking(bookingID int) (*Invoice, error) {
+	invoice, err := get_invoice_by_booking(bookingID)
+	if err != nil || invoice != nil {
+		return invoice, err
+	}
+
+	booking, err := get_booking_by_id(bookingID)
+	if err != nil {
+		return nil, err
+	}
+	if booking == nil {
+		return nil, fmt.Errorf("booking not found")
+	}
+
+	guest := get_user_data(booking.UserID)
+	host := get_user_data(booking.HostID)
+	listing, err := get_listing_by_id(booking.PostID)
+	if err != nil || guest == nil || host == nil || listing == nil {
+		return nil, fmt.Errorf("booking details not found")
+	}
+
+	nights := booking.Nights
+	nightlyRate := booking.Subtotal
+	if nights > 0 {
+		nightlyRate = round_money(booking.Subtotal / float64(nights))
+	}
+
+	issuedAt := time.Now()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	sequence, err := next_invoice_sequence(tx, issuedAt.Year())
+	if err != nil {
+		log.Printf("Error reserving invoice number: %v", err)
+		return nil, err
+	}
+
+	invoiceNumber := format_invoice_number(issuedAt.Year(), sequence)
+
+	query := `INSERT INTO Invoices (invoice_number, booking_id, guest_id, host_id, issued_at,
+			  guest_name, guest_email, host_name, host_email, property_title, property_address,
+			  start_date, end_date, nights, guests, nightly_rate, subtotal, discount_amount,
+			  promotion_code, total, currency, display_currency, exchange_rate)
+			  VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+	_, err = tx.Exec(query, invoiceNumber, booking.ID, booking.UserID, booking.HostID, issuedAt,
+		full_name(guest), guest.Email, full_name(host), host.Email, listing.Title,
+		listing.Address+", "+listing.City+", "+listing.Country,
+		booking.StartDate, booking.EndDate, nights, booking.Guests, nightlyRate, booking.Subtotal,
+		booking.DiscountAmount, booking.PromotionCode, booking.TotalPrice, booking.Currency,
+		booking.DisplayCurrency, booking.ExchangeRate)
+	if err != nil {
+		// Another request may have issued the invoice first
+		if existing, getErr := get_invoice_by_booking(bookingID); getErr == nil && existing != nil {
+			return existing, nil
+		}
+		log.Printf("Error creating invoice: %v", err)
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing invoice: %v", err)
+		return nil, err
+	}
+
+	log.Printf("Invoice %s issued for booking %d", invoiceNumber, bookingID)
+	return get_invoice_by_booking(bookingID)
+}
+
+func full_name(user *UserData) string {
+	name := strings.TrimSpace(user.FirstName + " " + user.LastName)
+	if name == "" {
+		return user.Username
+	}
+	return name
+}
+
+const invoice_columns = `id, invoice_number, booking_id, guest_id, host_id, issued_at, guest_name,
+	guest_email, host_name, host_email, property_title, property_address,
+	DATE_FORMAT(start_date, '%Y-%m-%d'), DATE_FORMAT(end_date, '%Y-%m-%d'), nights, guests,
+	nightly_rate, subtotal, discount_amount, promotion_code, total, currency, display_currency,
+	exchange_rate`
+
+func scan_invoice(row interface{ Scan(...interface{}) error }) (*Invoice, error) {
+	var invoice Invoice
+	err := row.Scan(
+		&invoice.ID, &invoice.InvoiceNumber, &invoice.BookingID, &invoice.GuestID, &invoice.HostID,
+		&invoice.IssuedAt, &invoice.GuestName, &invoice.GuestEmail, &invoice.HostName,
+		&invoice.HostEmail, &invoice.PropertyTitle, &invoice.PropertyAddress, &invoice.StartDate,
+		&invoice.EndDate, &invoice.Nights, &invoice.Guests, &invoice.NightlyRate, &invoice.Subtotal,
+		&invoice.DiscountAmount, &invoice.PromotionCode, &invoice.Total, &invoice.Currency,
+		&invoice.DisplayCurrency, &invoice.ExchangeRate,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &invoice, nil
+}
+
+func get_invoice_by_booking(bookingID int) (*Invoice, error) {
+	query := "SELECT " + invoice_columns + " FROM Invoices WHERE booking_id = ?"
+	invoice, err := scan_invoice(db.QueryRow(query, bookingID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return invoice, err
+}
+
+func get_invoice_by_number(invoiceNumber string) (*Invoice, error) {
+	query := "SELECT " + invoice_columns + " FROM Invoices WHERE invoice_number = ?"
+	invoice, err := scan_invoice(db.QueryRow(query, invoiceNumber))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return invoice, err
+}
+
+// get_user_invoices returns invoices where the user is the guest or the host
+func get_user_invoices(userID int) ([]Invoice, error) {
+	var invoices []Invoice
+
+	query := "SELECT " + invoice_columns + " FROM Invoices WHERE guest_id = ? OR host_id = ? ORDER BY issued_at DESC"
+	rows, err := db.Query(query, userID, userID)
+	if err != nil {
+		log.Printf("Error querying invoices: %v", err)
+		return invoices, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		invoice, err := scan_invoice(rows)
+		if err != nil {
+			log.Printf("Error scanning invoice: %v", err)
+			continue
+		}
+		invoices = append(invoices, *invoice)
+	}
+
+	return invoices, nil
+}
+
+func render_invoice_pdf(invoice *Invoice) []byte {
+	doc := new_pdf_document()
+
+	left, right := 50.0, float64(PDF_PAGE_WIDTH-50)
+	y := float64(PDF_PAGE_HEIGHT - 60)
+
+	doc.Text(left, y, 22, true, "AirBnBClone")
+	doc.TextRight(right, y, 18, true, "INVOICE")
+	y -= 22
+	doc.TextRight(right, y, 10, false, invoice.InvoiceNumber)
+	y -= 14
+	doc.TextRight(right, y, 10, false, "Issued "+invoice.IssuedAt.Format("2006-01-02"))
+
+	y -= 40
+	doc.Text(left, y, 11, true, "Billed to")
+	doc.Text(300, y, 11, true, "Host")
+	y -= 16
+	doc.Text(left, y, 10, false, invoice.GuestName)
+	doc.Text(300, y, 10, false, invoice.HostName)
+	y -= 14
+	doc.Text(left, y, 10, false, invoice.GuestEmail)
+	doc.Text(300, y, 10, false, invoice.HostEmail)
+
+	y -= 36
+	doc.Text(left, y, 11, true, "Stay")
+	y -= 16
+	doc.Text(left, y, 10, false, invoice.PropertyTitle)
+	y -= 14
+	doc.Text(left, y, 10, false, invoice.PropertyAddress)
+	y -= 14
+	doc.Text(left, y, 10, false, fmt.Sprintf("%s to %s, %d nights, %d guests",
+		invoice.StartDate, invoice.EndDate, invoice.Nights, invoice.Guests))
+
+	y -= 36
+	doc.Text(left, y, 11, true, "Description")
+	doc.TextRight(right, y, 11, true, "Amount ("+invoice.Currency+")")
+	y -= 8
+	doc.Line(left, y, right, y)
+
+	y -= 18
+	doc.Text(left, y, 10, false, fmt.Sprintf("%d nights x %.2f %s", invoice.Nights, invoice.NightlyRate, invoice.Currency))
+	doc.TextRight(right, y, 10, false, fmt.Sprintf("%.2f", invoice.Subtotal))
+
+	if invoice.DiscountAmount > 0 {
+		y -= 16
+		doc.Text(left, y, 10, false, "Discount ("+invoice.PromotionCode+")")
+		doc.TextRight(right, y, 10, false, fmt.Sprintf("-%.2f", invoice.DiscountAmount))
+	}
+
+	y -= 10
+	doc.Line(left, y, right, y)
+	y -= 18
+	doc.Text(left, y, 12, true, "Total")
+	doc.TextRight(right, y, 12, true, fmt.Sprintf("%.2f %s", invoice.Total, invoice.Currency))
+
+	if invoice.DisplayCurrency != invoice.Currency {
+		y -= 16
+		doc.Text(left, y, 9, false, fmt.Sprintf("Equivalent to %.2f %s at 1 %s = %.6f %s",
+			invoice.DisplayTotal(), invoice.DisplayCurrency, invoice.Currency, invoice.ExchangeRate, invoice.DisplayCurrency))
+	}
+
+	y -= 40
+	doc.Text(left, y, 9, false, fmt.Sprintf("Booking #%d. This invoice was generated from the stored booking and cannot be changed.", invoice.BookingID))
+
+	return doc.Bytes()
+}
+
+// can_view_invoice allows the guest, the host and admins
+func can_view_invoice(invoice *Invoice, userID int) bool {
+	return invoice.GuestID == userID || invoice.HostID == userID || is_admin_user(userID)
+}
+
+// invoice_handler serves /invoices/{number} as HTML and /invoices/{number}.pdf as PDF
+func invoice_handler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	authenticated, userID := is_authenticated(r)
+	if !authenticated {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/invoices/")
+	asPDF := strings.HasSuffix(path, ".pdf")
+	invoiceNumber := strings.TrimSuffix(path, ".pdf")
+	if invoiceNumber == "" {
+		http.Error(w, "Invoice number is required", http.StatusBadRequest)
+		return
+	}
+
+	invoice, err := get_invoice_by_number(invoiceNumber)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		log.Println("Error fetching invoice:", err)
+		return
+	}
+	if invoice == nil || !can_view_invoice(invoice, userID) {
+		http.Error(w, "Invoice not found", http.StatusNotFound)
+		return
+	}
+
+	if asPDF {
+		w.Header().Set("Content-Type", "application/pdf")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", invoice.InvoiceNumber+".pdf"))
+		w.Write(render_invoice_pdf(invoice))
+		return
+	}
+
+	templateData := struct {
+		Auth    AuthContext
+		Invoice *Invoice
+	}{
+		Auth:    get_auth(r),
+		Invoice: invoice,
+	}
+
+	tmpl := template.Must(template.ParseFiles("template/invoice.html"))
+	err = tmpl.Execute(w, templateData)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		log.Println("Error executing template:", err)
+	}
+}
+
+// booking_invoice_handler issues the invoice for a booking if needed and
+// redirects to it
+func booking_invoice_handler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	authenticated, userID := is_authenticated(r)
+	if !authenticated {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	bookingID, err := strconv.Atoi(r.URL.Query().Get("booking_id"))
+	if err != nil {
+		http.Error(w, "Invalid booking ID", http.StatusBadRequest)
+		return
+	}
+
+	booking, err := get_booking_by_id(bookingID)
+	if err != nil || booking == nil || (booking.UserID != userID && booking.HostID != userID) {
+		http.Error(w, "Booking not found", http.StatusNotFound)
+		return
+	}
+
+	invoice, err := issue_invoice_for_booking(bookingID)
+	if err != nil {
+		http.Error(w, "Error issuing invoice: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	target := "/invoices/" + invoice.InvoiceNumber
+	if r.URL.Query().Get("format") == "pdf" {
+		target += ".pdf"
+	}
+	http.Redirect(w, r, target, http.StatusSeeOther)
+}
+
+func update_tables_for_invoices() {
+	createQueries := []string{
+		`CREATE TABLE IF NOT EXISTS InvoiceSequences (
+			year INT PRIMARY KEY,
+			last_number INT NOT NULL DEFAULT 0
+		)`,
+		`CREATE TABLE IF NOT EXISTS Invoices (
+			id INT AUTO_INCREMENT PRIMARY KEY,
+			invoice_number VARCHAR(20) NOT NULL UNIQUE,
+			booking_id INT NOT NULL UNIQUE,
+			guest_id INT NOT NULL,
+			host_id INT NOT NULL,
+			issued_at DATETIME NOT NULL,
+			guest_name VARCHAR(100) NOT NULL,
+			guest_email VARCHAR(40) NOT NULL,
+			host_name VARCHAR(100) NOT NULL,
+			host_email VARCHAR(40) NOT NULL,
+			property_title VARCHAR(100) NOT NULL,
+			property_address VARCHAR(400) NOT NULL,
+			start_date DATE NOT NULL,
+			end_date DATE NOT NULL,
+			nights INT NOT NULL,
+			guests INT NOT NULL,
+			nightly_rate DECIMAL(10, 2) NOT NULL,
+			subtotal DECIMAL(10, 2) NOT NULL,
+			discount_amount DECIMAL(10, 2) NOT NULL DEFAULT 0,
+			promotion_code VARCHAR(40) NOT NULL DEFAULT '',
+			total DECIMAL(10, 2) NOT NULL,
+			currency CHAR(3) NOT NULL,
+			display_currency CHAR(3) NOT NULL,
+			exchange_rate DECIMAL(18, 8) NOT NULL
+		)`,
+	}
+
+	for _, query := range createQueries {
+		_, err := db.Exec(query)
+		if err != nil {
+			log.Printf("Error creating invoice tables: %v", err)
+		}
+	}
+
+	log.Println("Tables updated for invoices")
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+const (
+	NOTIFICATION_PURGE_DAYS = 90
+	OUTBOX_PURGE_DAYS       = 30
+	JOB_RUNS_PURGE_DAYS     = 30
+)
+
+func register_booking_jobs() {
+	register_job(Job{Name: "complete_finished_bookings", Interval: time.Hour, Run: complete_finished_bookings})
+	register_job(Job{Name: "open_review_windows", Interval: time.Hour, Run: open_review_windows})
+	register_job(Job{Name: "send_review_reminders", Interval: 6 * time.Hour, Run: send_review_reminders})
+	register_job(Job{Name: "publish_blind_reviews", Interval: time.Hour, Run: publish_blind_reviews})
+	register_job(Job{Name: "send_checkin_reminders", Interval: time.Hour, Run: send_checkin_reminders})
+	register_job(Job{Name: "purge_expired_records", Interval: 24 * time.Hour, Run: purge_expired_records})
+}
+
+// complete_finished_bookings marks confirmed bookings completed once checkout has passed
+func complete_finished_bookings() error {
+	result, err := db.Exec(`UPDATE Bookings SET status = 'completed' WHERE status = 'confirmed' AND end_date < CURDATE()`)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n > 0 {
+		log.Printf("Marked %d bookings completed", n)
+	}
+	return nil
+}
+
+// open_review_windows invites guests to review once checkout has passed and
+// their review window is open
+func open_review_windows() error {
+	query := `SELECT b.id FROM Bookings b
+		WHERE COALESCE(b.review_enabled, false) = false AND ` + review_window_open_sql + `
+		AND NOT EXISTS (SELECT 1 FROM Reviews r WHERE r.booking_id = b.id)`
+	rows, err := db.Query(query, get_review_window_days())
+	if err != nil {
+		return err
+	}
+
+	var bookingIDs []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err == nil {
+			bookingIDs = append(bookingIDs, id)
+		}
+	}
+	rows.Close()
+
+	var failed int
+	for _, bookingID := range bookingIDs {
+		if _, err := open_review_for_booking(bookingID); err != nil {
+			log.Printf("Error opening review for booking %d: %v", bookingID, err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d review windows could not be opened", failed, len(bookingIDs))
+	}
+	return nil
+}
+
+// send_checkin_reminders emails guests the day before check-in. The sent
+// marker is set in the same transaction as the outbox row so each guest gets
+// one reminder even if the job runs twice.
+func send_checkin_reminders() error {
+	rows, err := db.Query(`SELECT id, user_id FROM Bookings
+		WHERE status = 'confirmed' AND start_date = CURDATE() + INTERVAL 1 DAY AND checkin_reminder_sent_at IS NULL`)
+	if err != nil {
+		return err
+	}
+
+	type upcoming struct{ bookingID, guestID int }
+	var bookings []upcoming
+	for rows.Next() {
+		var b upcoming
+		if err := rows.Scan(&b.bookingID, &b.guestID); err == nil {
+			bookings = append(bookings, b)
+		}
+	}
+	rows.Close()
+
+	for _, b := range bookings {
+		sent, err := send_checkin_reminder(b.bookingID, b.guestID)
+		if err != nil {
+			return err
+		}
+		if sent {
+			notify(b.guestID, NOTIFICATION_CHECKIN_REMINDER, "Check-in tomorrow",
+				fmt.Sprintf("Your stay for booking #%d starts tomorrow", b.bookingID),
+				fmt.Sprintf("/bookings/%d", b.bookingID))
+		}
+	}
+	return nil
+}
+
+func send_checkin_reminder(bookingID, guestID int) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`UPDATE Bookings SET checkin_reminder_sent_at = NOW() WHERE id = ? AND checkin_reminder_sent_at IS NULL`, bookingID)
+	if err != nil {
+		return false, err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return false, nil
+	}
+
+	emailData, err := booking_email_data(tx, bookingID)
+	if err != nil {
+		return false, err
+	}
+	if err := enqueue_email(tx, guestID, EMAIL_CHECKIN_REMINDER, emailData); err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
+
+// purge_expired_records deletes data that is no longer useful. Login sessions
+// live in signed cookies that expire on their own, so only server-side
+// records need cleaning up.
+func purge_expired_records() error {
+	purges := []struct {
+		query string
+		days  int
+	}{
+		{`DELETE FROM Notifications WHERE is_read = true AND created_at < NOW() - INTERVAL ? DAY`, NOTIFICATION_PURGE_DAYS},
+		{`DELETE FROM EmailOutbox WHERE status = 'sent' AND sent_at < NOW() - INTERVAL ? DAY`, OUTBOX_PURGE_DAYS},
+		{`DELETE FROM JobRuns WHERE started_at < NOW() - INTERVAL ? DAY`, JOB_RUNS_PURGE_DAYS},
+		{`DELETE FROM DestinationSearches WHERE searched_at < NOW() - INTERVAL ? DAY`, DESTINATION_POPULARITY_DAYS},
+		{`DELETE FROM SavedSearchMatches WHERE notified_at < NOW() - INTERVAL ? DAY`, SAVED_SEARCH_MATCH_PURGE_DAYS},
+		{`DELETE FROM ListingEvents WHERE created_at < NOW() - INTERVAL ? DAY`, LISTING_EVENT_PURGE_DAYS},
+	}
+
+	for _, purge := range purges {
+		if _, err := db.Exec(purge.query, purge.days); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func update_tables_for_booking_jobs() {
+	_, err := db.Exec(`ALTER TABLE Bookings ADD COLUMN checkin_reminder_sent_at DATETIME NULL`)
+	if err != nil {
+		log.Printf("Note: column might already exist: %v", err)
+	}
+
+	// Bookings are confirmed as they are made and there is no payment step,
+	// so nothing is ever pending and there is nothing to expire. Any pending
+	// booking left from earlier versions holds its dates and is confirmed.
+	_, err = db.Exec(`UPDATE Bookings SET status = 'confirmed' WHERE status = 'pending'`)
+	if err != nil {
+		log.Printf("Error confirming pending bookings: %v", err)
+	} else {
+		_, err = db.Exec(`ALTER TABLE Bookings MODIFY COLUMN status ENUM('confirmed', 'cancelled', 'completed') NOT NULL DEFAULT 'confirmed'`)
+		if err != nil {
+			log.Printf("Error removing the pending booking status: %v", err)
+		}
+	}
+
+	log.Println("Tables updated for booking jobs")
+}
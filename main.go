@@ -11,7 +11,6 @@ import (
 	"log"
 	"mime/multipart"
 	"net/http"
-	"net/url"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -207,24 +206,36 @@ func edit_listing_handler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		// Get amenities
-		amenities := get_listing_amenities(listingID)
+		listing.BedTypes = get_listing_beds(listingID)
 
 		// Get images
 		images := get_listing_images(listingID)
 
+		// Get cancellation policy
+		cancellation := get_listing_cancellation_policy(listingID)
+
 		authCtx := get_auth(r)
 
 		templateData := struct {
-			Auth      AuthContext
-			Listing   *Listing
-			Amenities *PropertyAmenities
-			Images    []PropertyImage
+			Auth              AuthContext
+			Listing           *Listing
+			Amenities         []AmenityCategory
+			BedTypes          []BedType
+			MaxGuests         int
+			Images            []PropertyImage
+			Cancellation      *CancellationPolicy
+			CancellationTiers string
+			Currencies        []string
 		}{
-			Auth:      authCtx,
-			Listing:   listing,
-			Amenities: amenities,
-			Images:    images,
+			Auth:              authCtx,
+			Currencies:        get_supported_currencies(),
+			Listing:           listing,
+			Amenities:         group_amenities(get_active_amenities()),
+			BedTypes:          bed_types,
+			MaxGuests:         MAX_LISTING_GUESTS,
+			Images:            images,
+			Cancellation:      cancellation,
+			CancellationTiers: format_cancellation_tiers(cancellation.Tiers),
 		}
 
 		tmpl := template.Must(template.ParseFiles("template/edit_listing.html"))
@@ -303,29 +314,57 @@ func edit_listing_handler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		currency := strings.ToUpper(r.FormValue("currency"))
+		if !is_supported_currency(currency) {
+			http.Error(w, "Unsupported currency", http.StatusBadRequest)
+			return
+		}
+
+		cancellationPolicy := r.FormValue("cancellation_policy")
+		cancellationTiers := strings.TrimSpace(r.FormValue("cancellation_tiers"))
+		if _, err := get_cancellation_policy(cancellationPolicy, cancellationTiers); err != nil {
+			http.Error(w, "Invalid cancellation policy: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		capacity, err := parse_capacity_form(r)
+		if err != nil {
+			http.Error(w, "Invalid capacity: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
 		// Update listing
-		err = update_listing(listingID, title, country, city, address, description, price, propertyType)
+		err = update_listing(listingID, title, country, city, address, description, price, currency, propertyType, capacity)
 		if err != nil {
 			http.Error(w, "Error updating listing: "+err.Error(), http.StatusInternalServerError)
 			return
 		}
 
 		// Update amenities
-		wifi := r.FormValue("wifi") == "on"
-		kitchen := r.FormValue("kitchen") == "on"
-		ac := r.FormValue("air_conditioning") == "on"
-		parking := r.FormValue("parking") == "on"
-		pool := r.FormValue("pool") == "on"
-		washer := r.FormValue("washer") == "on"
-		dryer := r.FormValue("dryer") == "on"
-		tv := r.FormValue("tv") == "on"
-		heating := r.FormValue("heating") == "on"
-		balcony := r.FormValue("balcony") == "on"
-		pets := r.FormValue("pets_allowed") == "on"
-
-		err = update_listing_amenities(listingID, wifi, ac, kitchen, parking, pets, pool, washer, dryer, tv, heating, balcony)
+		err = set_listing_amenities(listingID, parse_amenity_form(r))
 		if err != nil {
 			log.Printf("Error updating amenities: %v", err)
+			http.Error(w, "Error updating amenities", http.StatusInternalServerError)
+			return
+		}
+
+		err = update_listing_cancellation_policy(listingID, cancellationPolicy, cancellationTiers)
+		if err != nil {
+			log.Printf("Error updating cancellation policy: %v", err)
+			http.Error(w, "Error updating cancellation policy", http.StatusInternalServerError)
+			return
+		}
+
+		err = update_listing_instant_book(listingID, r.FormValue("instant_book") == "on")
+		if err != nil {
+			log.Printf("Error updating instant book: %v", err)
+		}
+
+		// The address may have changed, the geocode_listings job retries on failure
+		err = geocode_listing(listingID)
+		if err != nil {
+			log.Printf("Error geocoding listing: %v", err)
+			reset_listing_geocode(listingID)
 		}
 
 		// Redirect to the listing
@@ -655,23 +694,13 @@ func explore_handler(w http.ResponseWriter, r *http.Request) {
 	case http.MethodGet:
 		authCtx := get_auth(r)
 
-		// Get post counts for each city
-		number_of_posts_city := make(map[string]int)
-
-		number_of_posts_city["New York"] = get_post_count_by_city("New York")
-		number_of_posts_city["Paris"] = get_post_count_by_city("Paris")
-		number_of_posts_city["Tokyo"] = get_post_count_by_city("Tokyo")
-		number_of_posts_city["London"] = get_post_count_by_city("London")
-		number_of_posts_city["Bali"] = get_post_count_by_city("Bali")
-		number_of_posts_city["Dubai"] = get_post_count_by_city("Dubai")
-		number_of_posts_city["Rome"] = get_post_count_by_city("Rome")
-		number_of_posts_city["Barcelona"] = get_post_count_by_city("Barcelona")
-
 		template_data := struct {
-			CityAndPosts map[string]int
+			Destinations []Destination
+			Recommended  []Listing
 			Auth         AuthContext
 		}{
-			CityAndPosts: number_of_posts_city,
+			Destinations: get_popular_destinations(POPULAR_DESTINATIONS_SHOWN),
+			Recommended:  get_recommendations_for_user(authCtx.UserID, get_display_currency(r), RECOMMENDATIONS_SHOWN),
 			Auth:         authCtx,
 		}
 
@@ -704,21 +733,6 @@ func explore_handler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func buildPaginationQuery(values url.Values) string {
-	// Remove page parameter and build query string for pagination
-	newValues := url.Values{}
-	for key, vals := range values {
-		if key != "page" {
-			for _, val := range vals {
-				if val != "" {
-					newValues.Add(key, val)
-				}
-			}
-		}
-	}
-	return newValues.Encode()
-}
-
 func listings_handler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -728,94 +742,90 @@ func listings_handler(w http.ResponseWriter, r *http.Request) {
 	authCtx := get_auth(r)
 
 	// Parse search parameters
-	params := SearchParams{
-		Destination:  strings.TrimSpace(r.URL.Query().Get("destination")),
-		CheckIn:      r.URL.Query().Get("checkin"),
-		CheckOut:     r.URL.Query().Get("checkout"),
-		Guests:       r.URL.Query().Get("guests"),
-		PropertyType: r.URL.Query().Get("type"),
-		Page:         1,
-		Limit:        20,
-	}
+	params := parse_search_params(r.URL.Query())
+	params.Currency = get_display_currency(r)
+	params.WithFacets = true
 
-	// Parse page number
-	if pageStr := r.URL.Query().Get("page"); pageStr != "" {
-		if page, err := strconv.Atoi(pageStr); err == nil && page > 0 {
-			params.Page = page
-		}
+	if params.Destination != "" && params.Page == 1 {
+		record_destination_search(params.Destination)
 	}
 
-	// Parse price filters
-	if minPriceStr := r.URL.Query().Get("min_price"); minPriceStr != "" {
-		if minPrice, err := strconv.ParseFloat(minPriceStr, 64); err == nil && minPrice >= 0 {
-			params.MinPrice = minPrice
+	// A place we can't locate matches nothing rather than everywhere
+	result := &ListingsResult{CurrentPage: 1, Facets: new_search_facets(params)}
+	var err error
+	locationErr := resolve_search_location(&params)
+	if locationErr == nil {
+		// Search listings using enhanced function
+		result, err = search_listings(params)
+		if err != nil {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			log.Println("Error searching listings:", err)
+			return
 		}
 	}
-
-	if maxPriceStr := r.URL.Query().Get("max_price"); maxPriceStr != "" {
-		if maxPrice, err := strconv.ParseFloat(maxPriceStr, 64); err == nil && maxPrice > 0 {
-			params.MaxPrice = maxPrice
-		}
-	}
-
-	// Parse amenity filters
-	params.Wifi = r.URL.Query().Get("wifi") == "true"
-	params.Kitchen = r.URL.Query().Get("kitchen") == "true"
-	params.AirConditioning = r.URL.Query().Get("air_conditioning") == "true"
-	params.Parking = r.URL.Query().Get("parking") == "true"
-	params.Pool = r.URL.Query().Get("pool") == "true"
-	params.TV = r.URL.Query().Get("tv") == "true"
-	params.Washer = r.URL.Query().Get("washer") == "true"
-	params.Dryer = r.URL.Query().Get("dryer") == "true"
-	params.Heating = r.URL.Query().Get("heating") == "true"
-	params.Balcony = r.URL.Query().Get("balcony") == "true"
-	params.PetsAllowed = r.URL.Query().Get("pets_allowed") == "true"
-
-	// Search listings using enhanced function
-	result, err := search_listings(params)
-	if err != nil {
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
-		log.Println("Error searching listings:", err)
-		return
+	locationError := ""
+	if locationErr != nil {
+		locationError = locationErr.Error()
 	}
+	record_listing_events(r, EVENT_IMPRESSION, result.Listings)
 
 	// Prepare pagination data
 	pageNumbers := make([]int, 0)
-	start := max(1, params.Page-2)
-	end := min(result.TotalPages, params.Page+2)
+	start := max(1, result.CurrentPage-2)
+	end := min(result.TotalPages, result.CurrentPage+2)
 
 	for i := start; i <= end; i++ {
 		pageNumbers = append(pageNumbers, i)
 	}
 
 	// Build pagination query string (without page parameter)
-	paginationQuery := buildPaginationQuery(r.URL.Query())
+	paginationQuery := buildPaginationQuery(params)
 
 	// Prepare template data
 	templateData := struct {
-		Listings        []Listing
-		SearchParams    SearchParams
-		SearchQuery     string
-		TotalResults    int
-		TotalPages      int
-		CurrentPage     int
-		NextPage        int
-		PrevPage        int
-		PageNumbers     []int
-		PaginationQuery string
-		Auth            AuthContext
+		Listings         []Listing
+		SearchParams     SearchParams
+		SearchQuery      string
+		TotalResults     int
+		TotalApproximate bool
+		TotalPages       int
+		CurrentPage      int
+		NextPage         int
+		PrevPage         int
+		PageNumbers      []int
+		PaginationQuery  string
+		NextCursor       string
+		Facets           *SearchFacets
+		LocationError    string
+		SortOptions      []SearchSortOption
+		Countries        []string
+		RoomOptions      []int
+		Sort             string
+		Currency         string
+		Currencies       []string
+		Auth             AuthContext
 	}{
-		Listings:        result.Listings,
-		SearchParams:    params,
-		SearchQuery:     params.Destination,
-		TotalResults:    result.TotalResults,
-		TotalPages:      result.TotalPages,
-		CurrentPage:     result.CurrentPage,
-		NextPage:        result.CurrentPage + 1,
-		PrevPage:        result.CurrentPage - 1,
-		PageNumbers:     pageNumbers,
-		PaginationQuery: paginationQuery,
-		Auth:            authCtx,
+		Listings:         result.Listings,
+		SearchParams:     params,
+		SearchQuery:      params.Destination,
+		TotalResults:     result.TotalResults,
+		TotalApproximate: result.TotalApproximate,
+		TotalPages:       result.TotalPages,
+		CurrentPage:      result.CurrentPage,
+		NextPage:         result.CurrentPage + 1,
+		PrevPage:         result.CurrentPage - 1,
+		PageNumbers:      pageNumbers,
+		PaginationQuery:  paginationQuery,
+		NextCursor:       result.NextCursor,
+		Facets:           result.Facets,
+		LocationError:    locationError,
+		SortOptions:      search_sort_options,
+		Countries:        get_listing_countries(),
+		RoomOptions:      search_room_options,
+		Sort:             params.effective_sort(),
+		Currency:         params.Currency,
+		Currencies:       get_supported_currencies(),
+		Auth:             authCtx,
 	}
 
 	tmpl := template.Must(template.ParseFiles("template/listings_page.html"))
@@ -860,6 +870,10 @@ func property_detail_handler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	currency := get_display_currency(r)
+	set_listing_display_price(propertyDetail.Property, currency)
+	record_listing_event(r, EVENT_VIEW, propertyDetail.Property)
+
 	// Create template functions
 	funcMap := template.FuncMap{
 		"title": strings.Title,
@@ -880,17 +894,29 @@ func property_detail_handler(w http.ResponseWriter, r *http.Request) {
 
 	// Prepare template data
 	templateData := struct {
-		Property  *Listing
-		Host      *UserData
-		Amenities *PropertyAmenities
-		Reviews   []Review
-		Auth      AuthContext
+		Property     *Listing
+		Host         *UserData
+		Amenities    []AmenityCategory
+		Reviews      []Review
+		Rating       *ListingRating
+		Cancellation *CancellationPolicy
+		Similar      []Listing
+		Currency     string
+		Currencies   []string
+		Reasons      []ReviewReportReason
+		Auth         AuthContext
 	}{
-		Property:  propertyDetail.Property,
-		Host:      propertyDetail.Host,
-		Amenities: propertyDetail.Amenities,
-		Reviews:   propertyDetail.Reviews,
-		Auth:      authCtx,
+		Property:     propertyDetail.Property,
+		Host:         propertyDetail.Host,
+		Amenities:    group_amenities(propertyDetail.Property.Amenities),
+		Reviews:      propertyDetail.Reviews,
+		Rating:       propertyDetail.Rating,
+		Cancellation: propertyDetail.Cancellation,
+		Similar:      get_similar_listings(propertyID, currency, SIMILAR_LISTINGS_SHOWN),
+		Currency:     currency,
+		Currencies:   get_supported_currencies(),
+		Reasons:      review_report_reasons,
+		Auth:         authCtx,
 	}
 
 	// Parse and execute template
@@ -952,15 +978,39 @@ func booking_handler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if guests > property.MaxGuests {
+		http.Error(w, fmt.Sprintf("This place fits at most %d guests", property.MaxGuests), http.StatusBadRequest)
+		return
+	}
+	record_listing_event(r, EVENT_BOOKING_START, property)
+
 	// Calculate total price
-	totalPrice, nights, err := calculate_booking_price(propertyID, checkin, checkout)
+	subtotal, nights, err := calculate_booking_price(propertyID, checkin, checkout)
 	if err != nil {
 		http.Error(w, "Error calculating price: "+err.Error(), http.StatusBadRequest)
 		return
 	}
 
+	// Apply promotion code if one was entered
+	var promo *Promotion
+	var discount float64
+	if promoCode := strings.TrimSpace(r.FormValue("promo_code")); promoCode != "" {
+		promo, discount, err = apply_promotion_code(promoCode, userID, property, nights, subtotal)
+		if err != nil {
+			http.Error(w, "Promotion code not applied: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	// Keep the rate towards the guest's currency so the total can be reproduced
+	displayCurrency := get_display_currency(r)
+	exchangeRate, err := get_exchange_rate(property.Currency, displayCurrency)
+	if err != nil {
+		displayCurrency = property.Currency
+		exchangeRate = 1
+	}
+
 	// Create booking
-	err = create_booking(propertyID, userID, property.UserID, guests, checkin, checkout, totalPrice)
+	bookingID, err := create_booking(propertyID, userID, property.UserID, guests, checkin, checkout, subtotal, property.Currency, displayCurrency, exchangeRate, promo, discount)
 	if err != nil {
 		if err.Error() == "dates are not available" {
 			http.Error(w, "Sorry, these dates are not available", http.StatusConflict)
@@ -970,55 +1020,89 @@ func booking_handler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Redirect to booking confirmation page
-	http.Redirect(w, r, "/booking-success?property="+propertyIDStr+"&nights="+strconv.Itoa(nights)+"&total="+fmt.Sprintf("%.2f", totalPrice), http.StatusSeeOther)
+	// Redirect to the booking page, which loads everything from the stored booking
+	http.Redirect(w, r, "/bookings/"+strconv.Itoa(bookingID), http.StatusSeeOther)
 }
 
-func booking_success_handler(w http.ResponseWriter, r *http.Request) {
+func booking_detail_handler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
 	// Check if user is authenticated
-	authenticated, _ := is_authenticated(r)
+	authenticated, userID := is_authenticated(r)
 	if !authenticated {
 		http.Redirect(w, r, "/login", http.StatusSeeOther)
 		return
 	}
 
-	authCtx := get_auth(r)
+	// Extract booking ID from URL path
+	path := strings.TrimPrefix(r.URL.Path, "/bookings/")
+	bookingID, err := strconv.Atoi(path)
+	if err != nil {
+		http.Error(w, "Invalid booking ID", http.StatusBadRequest)
+		return
+	}
 
-	// Get query parameters
-	propertyIDStr := r.URL.Query().Get("property")
-	nightsStr := r.URL.Query().Get("nights")
-	totalStr := r.URL.Query().Get("total")
+	booking, err := get_booking_by_id(bookingID)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		log.Println("Error fetching booking:", err)
+		return
+	}
 
-	propertyID, _ := strconv.Atoi(propertyIDStr)
-	nights, _ := strconv.Atoi(nightsStr)
-	total, _ := strconv.ParseFloat(totalStr, 64)
+	// Only the guest and the host may see a booking
+	if booking == nil || (booking.UserID != userID && booking.HostID != userID) {
+		http.Error(w, "Booking not found", http.StatusNotFound)
+		return
+	}
 
-	// Get property details
-	property, err := get_listing_by_id(propertyID)
+	property, err := get_listing_by_id(booking.PostID)
 	if err != nil || property == nil {
 		http.Error(w, "Property not found", http.StatusNotFound)
 		return
 	}
 
-	// Prepare template data
+	host := get_user_data(booking.HostID)
+	guest := get_user_data(booking.UserID)
+	if host == nil || guest == nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	var cancellationLines []string
+	if policy, _, _, err := get_booking_cancellation_policy(bookingID); err == nil {
+		cancellationLines = policy.Describe()
+	}
+
+	// Refund the guest would get if they cancelled today
+	var refundPreview float64
+	if booking.Status == "confirmed" {
+		refundPreview, _ = preview_booking_refund(bookingID)
+	}
+
 	templateData := struct {
-		Auth     AuthContext
-		Property *Listing
-		Nights   int
-		Total    float64
+		Auth              AuthContext
+		Booking           *Booking
+		Property          *Listing
+		Host              *UserData
+		Guest             *UserData
+		IsGuest           bool
+		CancellationLines []string
+		RefundPreview     float64
 	}{
-		Auth:     authCtx,
-		Property: property,
-		Nights:   nights,
-		Total:    total,
+		Auth:              get_auth(r),
+		Booking:           booking,
+		Property:          property,
+		Host:              host,
+		Guest:             guest,
+		IsGuest:           booking.UserID == userID,
+		CancellationLines: cancellationLines,
+		RefundPreview:     refundPreview,
 	}
 
-	tmpl := template.Must(template.ParseFiles("template/booking_success.html"))
+	tmpl := template.Must(template.ParseFiles("template/booking_detail.html"))
 	err = tmpl.Execute(w, templateData)
 	if err != nil {
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
@@ -1026,6 +1110,8 @@ func booking_success_handler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// enable_review_handler lets admins reopen the review window of a booking.
+// Hosts can't, reviews open automatically after checkout.
 func enable_review_handler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -1033,11 +1119,15 @@ func enable_review_handler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Check if user is authenticated
-	authenticated, hostID := is_authenticated(r)
+	authenticated, userID := is_authenticated(r)
 	if !authenticated {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
+	if !is_admin_user(userID) {
+		http.Error(w, "Only admins can reopen reviews", http.StatusForbidden)
+		return
+	}
 
 	// Parse form data
 	bookingIDStr := r.FormValue("booking_id")
@@ -1052,13 +1142,15 @@ func enable_review_handler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Enable review for the booking
-	err = enable_review_for_booking(bookingID, hostID)
+	// Reopen the review window for the booking
+	err = override_review_window(bookingID)
 	if err != nil {
 		http.Error(w, "Error enabling review: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	log.Printf("Review window reopened for booking %d by admin %d", bookingID, userID)
+
 	// Return success
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("Review enabled successfully"))
@@ -1109,7 +1201,13 @@ func submit_review_handler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = create_review_with_booking(propertyID, userID, bookingID, rating, comment)
+	subRatings, err := parse_sub_ratings(r.FormValue)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = create_review_with_booking(propertyID, userID, bookingID, rating, subRatings, comment)
 	if err != nil {
 		http.Error(w, "Error submitting review: "+err.Error(), http.StatusInternalServerError)
 		return
@@ -1131,9 +1229,17 @@ func add_listing_handler(w http.ResponseWriter, r *http.Request) {
 		authCtx := get_auth(r)
 
 		templateData := struct {
-			Auth AuthContext
+			Auth       AuthContext
+			Currencies []string
+			Amenities  []AmenityCategory
+			BedTypes   []BedType
+			MaxGuests  int
 		}{
-			Auth: authCtx,
+			Auth:       authCtx,
+			Currencies: get_supported_currencies(),
+			Amenities:  group_amenities(get_active_amenities()),
+			BedTypes:   bed_types,
+			MaxGuests:  MAX_LISTING_GUESTS,
 		}
 
 		tmpl := template.Must(template.ParseFiles("template/add_listing.html"))
@@ -1157,20 +1263,11 @@ func add_listing_handler(w http.ResponseWriter, r *http.Request) {
 		city := strings.TrimSpace(r.FormValue("city"))
 		address := strings.TrimSpace(r.FormValue("address"))
 		priceStr := r.FormValue("price")
+		currency := strings.ToUpper(r.FormValue("currency"))
 		propertyType := r.FormValue("type")
 
 		// Amenities
-		wifi := r.FormValue("wifi") == "on"
-		kitchen := r.FormValue("kitchen") == "on"
-		ac := r.FormValue("air_conditioning") == "on"
-		parking := r.FormValue("parking") == "on"
-		pool := r.FormValue("pool") == "on"
-		washer := r.FormValue("washer") == "on"
-		dryer := r.FormValue("dryer") == "on"
-		tv := r.FormValue("tv") == "on"
-		heating := r.FormValue("heating") == "on"
-		balcony := r.FormValue("balcony") == "on"
-		pets := r.FormValue("pets_allowed") == "on"
+		amenities := parse_amenity_form(r)
 
 		// Validate required fields
 		if title == "" || description == "" || country == "" || city == "" || address == "" || priceStr == "" || propertyType == "" {
@@ -1185,6 +1282,12 @@ func add_listing_handler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		// Validate currency
+		if !is_supported_currency(currency) {
+			http.Error(w, "Unsupported currency", http.StatusBadRequest)
+			return
+		}
+
 		// Validate property type
 		validTypes := map[string]bool{
 			"apartment": true,
@@ -1197,15 +1300,56 @@ func add_listing_handler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		// Validate cancellation policy
+		cancellationPolicy := r.FormValue("cancellation_policy")
+		cancellationTiers := strings.TrimSpace(r.FormValue("cancellation_tiers"))
+		if _, err := get_cancellation_policy(cancellationPolicy, cancellationTiers); err != nil {
+			http.Error(w, "Invalid cancellation policy: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		capacity, err := parse_capacity_form(r)
+		if err != nil {
+			http.Error(w, "Invalid capacity: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
 		// Create the listing
-		listingID, err := create_listing(userID, title, country, city, address, description, price, propertyType)
+		listingID, err := create_listing(userID, title, country, city, address, description, price, currency, propertyType, capacity)
 		if err != nil {
 			http.Error(w, "Error creating listing: "+err.Error(), http.StatusInternalServerError)
 			return
 		}
 
+		// The listing exists from here on, the host can finish it from the edit page
+		editURL := "/edit-listing/" + strconv.Itoa(listingID)
+
 		// Add amenities
-		create_amenities(listingID, wifi, ac, kitchen, parking, pets, pool, washer, dryer, tv, heating, balcony)
+		err = set_listing_amenities(listingID, amenities)
+		if err != nil {
+			log.Printf("Error setting amenities: %v", err)
+			http.Error(w, "Listing created, but its amenities could not be saved. Please set them again on "+editURL, http.StatusInternalServerError)
+			return
+		}
+
+		// Set cancellation policy
+		err = update_listing_cancellation_policy(listingID, cancellationPolicy, cancellationTiers)
+		if err != nil {
+			log.Printf("Error setting cancellation policy: %v", err)
+			http.Error(w, "Listing created, but its cancellation policy could not be saved. Please set it again on "+editURL, http.StatusInternalServerError)
+			return
+		}
+
+		err = update_listing_instant_book(listingID, r.FormValue("instant_book") == "on")
+		if err != nil {
+			log.Printf("Error setting instant book: %v", err)
+		}
+
+		// The geocode_listings job retries listings that fail here
+		err = geocode_listing(listingID)
+		if err != nil {
+			log.Printf("Error geocoding listing: %v", err)
+		}
 
 		// Redirect to the new listing
 		http.Redirect(w, r, "/property/"+strconv.Itoa(listingID), http.StatusSeeOther)
@@ -1234,10 +1378,57 @@ func main() {
 	http.HandleFunc("/add-listing", add_listing_handler)
 
 	http.HandleFunc("/book", booking_handler)
-	http.HandleFunc("/booking-success", booking_success_handler)
+	http.HandleFunc("/bookings/", booking_detail_handler)
+	http.HandleFunc("/cancel-booking", cancel_booking_handler)
+
+	http.HandleFunc("/set-currency", set_currency_handler)
+	http.HandleFunc("/exchange-rates", exchange_rates_handler)
+
+	http.HandleFunc("/promotions", promotions_handler)
+	http.HandleFunc("/promotions/toggle", toggle_promotion_handler)
+	http.HandleFunc("/analytics", analytics_handler)
+
+	http.HandleFunc("/invoice", booking_invoice_handler)
+	http.HandleFunc("/invoices/", invoice_handler)
+
+	http.HandleFunc("/inbox", inbox_handler)
+	http.HandleFunc("/inbox/", inbox_handler)
+	http.HandleFunc("/messages/send", send_message_handler)
+	http.HandleFunc("/messages/report", report_thread_handler)
+	http.HandleFunc("/messages/reports/resolve", resolve_report_handler)
+	http.HandleFunc("/api/threads", api_threads_handler)
+	http.HandleFunc("/api/threads/", api_threads_handler)
+	http.HandleFunc("/api/messages/unread", api_unread_messages_handler)
+
+	http.HandleFunc("/notifications/stream", notifications_stream_handler)
+	http.HandleFunc("/api/notifications", api_notifications_handler)
+	http.HandleFunc("/api/listings/geojson", listings_geojson_handler)
+	http.HandleFunc("/api/destinations", api_destinations_handler)
+	http.HandleFunc("/api/listings", api_listings_handler)
 
 	http.HandleFunc("/enable-review", enable_review_handler)
 	http.HandleFunc("/submit-review", submit_review_handler)
+	http.HandleFunc("/submit-guest-review", submit_guest_review_handler)
+	http.HandleFunc("/reviews/reply", reply_review_handler)
+	http.HandleFunc("/reviews/report", report_review_handler)
+
+	http.HandleFunc("/email-preferences", email_preferences_handler)
+
+	http.HandleFunc("/saved-searches", saved_searches_handler)
+	http.HandleFunc("/saved-searches/update", update_saved_search_handler)
+	http.HandleFunc("/saved-searches/delete", delete_saved_search_handler)
+	http.HandleFunc("/saved-searches/unsubscribe", unsubscribe_saved_search_handler)
+
+	http.HandleFunc("/wishlists", wishlists_handler)
+	http.HandleFunc("/wishlists/", wishlists_handler)
+	http.HandleFunc("/wishlists/manage", manage_wishlist_handler)
+	http.HandleFunc("/wishlists/vote", wishlist_vote_handler)
+	http.HandleFunc("/api/wishlists", api_wishlists_handler)
+	http.HandleFunc("/api/recommendations", api_recommendations_handler)
+
+	http.HandleFunc("/admin/jobs", admin_jobs_handler)
+	http.HandleFunc("/admin/amenities", admin_amenities_handler)
+	http.HandleFunc("/admin/reviews", admin_reviews_handler)
 
 	http.HandleFunc("/edit-profile", edit_profile_handler)
 	http.HandleFunc("/edit-listing/", edit_listing_handler)
@@ -1248,9 +1439,50 @@ func main() {
 	init_database()
 
 	update_tables_for_reviews()
+	update_tables_for_cancellation()
+	update_tables_for_currency()
+	update_tables_for_promotions()
+	update_tables_for_invoices()
+	update_tables_for_messaging()
+	update_tables_for_notifications()
+	update_tables_for_emails()
+	update_tables_for_scheduler()
+	update_tables_for_booking_jobs()
+	update_tables_for_review_window()
+	update_tables_for_guest_reviews()
+	update_tables_for_review_moderation()
+	update_tables_for_ratings()
+	update_tables_for_instant_book()
+	update_tables_for_fulltext_search()
+	update_tables_for_geolocation()
+	update_tables_for_destinations()
+	update_tables_for_saved_searches()
+	update_tables_for_wishlists()
+	update_tables_for_recommendations()
+	update_tables_for_analytics()
+	update_tables_for_amenity_catalog()
+	update_tables_for_capacity()
+
+	if err := load_exchange_rates(get_rate_source()); err != nil {
+		log.Printf("Warning: Could not load exchange rates, using stored rates: %v", err)
+		refresh_exchange_rates()
+	}
+
+	if err := load_search_synonyms(SEARCH_SYNONYMS_FILE); err != nil {
+		log.Printf("Warning: Could not load search synonyms: %v", err)
+	}
 
 	if err := os.MkdirAll("static/uploads", 0755); err != nil {
 		log.Printf("Warning: Could not create uploads directory: %v", err)
 	}
+
+	start_email_worker(get_mailer())
+
+	register_booking_jobs()
+	register_geocoding_jobs()
+	register_saved_search_jobs()
+	register_recommendation_jobs()
+	register_analytics_jobs()
+	start_scheduler()
 	http.ListenAndServe(":8080", nil)
 }
@@ -0,0 +1,774 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const MAX_MESSAGE_LENGTH = 2000
+
+// MessageThread is a conversation between a guest and a host about a listing,
+// optionally tied to one of the guest's bookings
+type MessageThread struct {
+	ID            int    `json:"id"`
+	PostID        int    `json:"post_id"`
+	BookingID     int    `json:"booking_id,omitempty"` // 0 for inquiries made before booking
+	GuestID       int    `json:"guest_id"`
+	HostID        int    `json:"host_id"`
+	PropertyTitle string `json:"property_title"`
+	OtherUsername string `json:"other_username"`
+	LastMessage   string `json:"last_message"`
+	LastMessageAt string `json:"last_message_at"`
+	UnreadCount   int    `json:"unread_count"`
+	Reported      bool   `json:"reported"`
+}
+
+type Message struct {
+	ID         int    `json:"id"`
+	ThreadID   int    `json:"thread_id"`
+	SenderID   int    `json:"sender_id"`
+	SenderName string `json:"sender_name"`
+	Body       string `json:"body"`
+	CreatedAt  string `json:"created_at"`
+	IsMine     bool   `json:"is_mine"`
+}
+
+// ThreadReport is a thread flagged by one of its participants for moderators
+type ThreadReport struct {
+	ID            int
+	ThreadID      int
+	ReporterID    int
+	ReporterName  string
+	Reason        string
+	PropertyTitle string
+	CreatedAt     string
+}
+
+var (
+	contact_email_pattern = regexp.MustCompile(`[A-Za-z0-9._%+\-]+\s*(@|\(at\)|\[at\])\s*[A-Za-z0-9.\-]+\.[A-Za-z]{2,}`)
+	contact_phone_pattern = regexp.MustCompile(`\+?\d[\d\s().\-]{5,}\d`)
+	iso_date_pattern      = regexp.MustCompile(`^\d{4}-\d{2}-\d{2}$`)
+)
+
+// is_date_run reports whether a phone-like match is only ISO dates, which
+// guests often use to ask about availability
+func is_date_run(match string) bool {
+	for _, field := range strings.Fields(match) {
+		if !iso_date_pattern.MatchString(field) {
+			return false
+		}
+	}
+	return true
+}
+
+// mask_contact_details hides email addresses and phone numbers so guests and
+// hosts can't take the conversation off the platform before a booking
+func mask_contact_details(body string) string {
+	body = contact_email_pattern.ReplaceAllString(body, "[email hidden]")
+	return contact_phone_pattern.ReplaceAllStringFunc(body, func(match string) string {
+		digits := 0
+		for _, r := range match {
+			if r >= '0' && r <= '9' {
+				digits++
+			}
+		}
+		// Shorter runs are prices, dates and guest counts rather than phone numbers
+		if digits < 7 || is_date_run(match) {
+			return match
+		}
+		return "[phone hidden]"
+	})
+}
+
+const thread_columns = `t.id, t.post_id, COALESCE(t.booking_id, 0), t.guest_id, t.host_id, p.title`
+
+func get_thread(threadID int) (*MessageThread, error) {
+	query := `SELECT ` + thread_columns + `
+		FROM MessageThreads t
+		JOIN Posts p ON t.post_id = p.id
+		WHERE t.id = ?`
+
+	var thread MessageThread
+	err := db.QueryRow(query, threadID).Scan(
+		&thread.ID, &thread.PostID, &thread.BookingID, &thread.GuestID, &thread.HostID, &thread.PropertyTitle,
+	)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &thread, nil
+}
+
+// get_or_create_thread returns the thread for a booking, or the guest's
+// inquiry thread for a listing when bookingID is 0
+func get_or_create_thread(postID, bookingID, guestID, hostID int) (*MessageThread, error) {
+	var threadID int
+	var err error
+	if bookingID > 0 {
+		err = db.QueryRow(`SELECT id FROM MessageThreads WHERE booking_id = ?`, bookingID).Scan(&threadID)
+	} else {
+		err = db.QueryRow(`SELECT id FROM MessageThreads WHERE post_id = ? AND guest_id = ? AND booking_id IS NULL`,
+			postID, guestID).Scan(&threadID)
+	}
+
+	if err == sql.ErrNoRows {
+		var bookingArg interface{}
+		if bookingID > 0 {
+			bookingArg = bookingID
+		}
+		result, err := db.Exec(`INSERT INTO MessageThreads (post_id, booking_id, guest_id, host_id) VALUES (?, ?, ?, ?)`,
+			postID, bookingArg, guestID, hostID)
+		if err != nil {
+			log.Printf("Error creating message thread: %v", err)
+			return nil, err
+		}
+		id, err := result.LastInsertId()
+		if err != nil {
+			return nil, err
+		}
+		threadID = int(id)
+	} else if err != nil {
+		return nil, err
+	}
+
+	return get_thread(threadID)
+}
+
+func (t *MessageThread) is_participant(userID int) bool {
+	return t.GuestID == userID || t.HostID == userID
+}
+
+func (t *MessageThread) other_participant(userID int) int {
+	if userID == t.GuestID {
+		return t.HostID
+	}
+	return t.GuestID
+}
+
+// has_confirmed_booking reports whether contact details may be shared in the
+// thread, which is once the guest holds a confirmed booking for the listing
+func (t *MessageThread) has_confirmed_booking() bool {
+	var count int
+	var err error
+	if t.BookingID > 0 {
+		err = db.QueryRow(`SELECT COUNT(*) FROM Bookings WHERE id = ? AND status IN ('confirmed', 'completed')`,
+			t.BookingID).Scan(&count)
+	} else {
+		err = db.QueryRow(`SELECT COUNT(*) FROM Bookings WHERE post_id = ? AND user_id = ? AND status IN ('confirmed', 'completed')`,
+			t.PostID, t.GuestID).Scan(&count)
+	}
+	if err != nil {
+		log.Printf("Error checking thread bookings: %v", err)
+		return false
+	}
+	return count > 0
+}
+
+func send_message(thread *MessageThread, senderID int, body string) (*Message, error) {
+	if !thread.is_participant(senderID) {
+		return nil, fmt.Errorf("you are not part of this conversation")
+	}
+
+	body = strings.TrimSpace(body)
+	if body == "" {
+		return nil, fmt.Errorf("message cannot be empty")
+	}
+	if utf8.RuneCountInString(body) > MAX_MESSAGE_LENGTH {
+		return nil, fmt.Errorf("message must be at most %d characters", MAX_MESSAGE_LENGTH)
+	}
+
+	// Masked when stored so the raw details never reach the other side
+	if !thread.has_confirmed_booking() {
+		body = mask_contact_details(body)
+	}
+
+	result, err := db.Exec(`INSERT INTO Messages (thread_id, sender_id, body) VALUES (?, ?, ?)`, thread.ID, senderID, body)
+	if err != nil {
+		log.Printf("Error saving message: %v", err)
+		return nil, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = db.Exec(`UPDATE MessageThreads SET last_message_at = NOW() WHERE id = ?`, thread.ID)
+	if err != nil {
+		log.Printf("Error updating thread timestamp: %v", err)
+	}
+	mark_thread_read(thread, senderID)
+
+	notify(thread.other_participant(senderID), NOTIFICATION_NEW_MESSAGE, "New message",
+		fmt.Sprintf("About %s", thread.PropertyTitle), fmt.Sprintf("/inbox/%d", thread.ID))
+
+	return &Message{ID: int(id), ThreadID: thread.ID, SenderID: senderID, Body: body, IsMine: true}, nil
+}
+
+func get_thread_messages(threadID, userID int) ([]Message, error) {
+	query := `
+		SELECT m.id, m.thread_id, m.sender_id, u.username, m.body, DATE_FORMAT(m.created_at, '%Y-%m-%d %H:%i')
+		FROM Messages m
+		JOIN Users u ON m.sender_id = u.id
+		WHERE m.thread_id = ?
+		ORDER BY m.id`
+
+	rows, err := db.Query(query, threadID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var messages []Message
+	for rows.Next() {
+		var message Message
+		err := rows.Scan(&message.ID, &message.ThreadID, &message.SenderID, &message.SenderName, &message.Body, &message.CreatedAt)
+		if err != nil {
+			log.Printf("Error scanning message: %v", err)
+			continue
+		}
+		message.IsMine = message.SenderID == userID
+		messages = append(messages, message)
+	}
+
+	return messages, nil
+}
+
+// mark_thread_read moves the user's read marker to the latest message
+func mark_thread_read(thread *MessageThread, userID int) {
+	column := "guest_last_read_id"
+	if userID == thread.HostID {
+		column = "host_last_read_id"
+	} else if userID != thread.GuestID {
+		return
+	}
+
+	query := `UPDATE MessageThreads SET ` + column + ` = (SELECT COALESCE(MAX(id), 0) FROM Messages WHERE thread_id = ?) WHERE id = ?`
+	_, err := db.Exec(query, thread.ID, thread.ID)
+	if err != nil {
+		log.Printf("Error marking thread read: %v", err)
+	}
+}
+
+// unread_messages_expr counts messages from the other participant newer than
+// the user's read marker. It takes the user ID twice.
+const unread_messages_expr = `(SELECT COUNT(*) FROM Messages m
+		WHERE m.thread_id = t.id AND m.sender_id != ?
+		AND m.id > CASE WHEN t.guest_id = ? THEN t.guest_last_read_id ELSE t.host_last_read_id END)`
+
+func get_user_threads(userID int) ([]MessageThread, error) {
+	query := `
+		SELECT ` + thread_columns + `, u.username,
+		       COALESCE((SELECT body FROM Messages WHERE thread_id = t.id ORDER BY id DESC LIMIT 1), ''),
+		       DATE_FORMAT(t.last_message_at, '%Y-%m-%d %H:%i'),
+		       ` + unread_messages_expr + `,
+		       EXISTS(SELECT 1 FROM ThreadReports r WHERE r.thread_id = t.id AND r.status = 'open')
+		FROM MessageThreads t
+		JOIN Posts p ON t.post_id = p.id
+		JOIN Users u ON u.id = CASE WHEN t.guest_id = ? THEN t.host_id ELSE t.guest_id END
+		WHERE t.guest_id = ? OR t.host_id = ?
+		ORDER BY t.last_message_at DESC`
+
+	rows, err := db.Query(query, userID, userID, userID, userID, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var threads []MessageThread
+	for rows.Next() {
+		var thread MessageThread
+		err := rows.Scan(
+			&thread.ID, &thread.PostID, &thread.BookingID, &thread.GuestID, &thread.HostID, &thread.PropertyTitle,
+			&thread.OtherUsername, &thread.LastMessage, &thread.LastMessageAt, &thread.UnreadCount, &thread.Reported,
+		)
+		if err != nil {
+			log.Printf("Error scanning thread: %v", err)
+			continue
+		}
+		threads = append(threads, thread)
+	}
+
+	return threads, nil
+}
+
+func get_unread_message_count(userID int) int {
+	query := `SELECT COALESCE(SUM(` + unread_messages_expr + `), 0)
+		FROM MessageThreads t
+		WHERE t.guest_id = ? OR t.host_id = ?`
+
+	var count int
+	err := db.QueryRow(query, userID, userID, userID, userID).Scan(&count)
+	if err != nil {
+		log.Printf("Error counting unread messages: %v", err)
+		return 0
+	}
+	return count
+}
+
+func report_thread(thread *MessageThread, reporterID int, reason string) error {
+	if !thread.is_participant(reporterID) {
+		return fmt.Errorf("you are not part of this conversation")
+	}
+
+	reason = strings.TrimSpace(reason)
+	if reason == "" {
+		return fmt.Errorf("please describe the problem")
+	}
+	if utf8.RuneCountInString(reason) > 500 {
+		reason = string([]rune(reason)[:500])
+	}
+
+	_, err := db.Exec(`INSERT INTO ThreadReports (thread_id, reporter_id, reason) VALUES (?, ?, ?)`,
+		thread.ID, reporterID, reason)
+	if err != nil {
+		log.Printf("Error reporting thread: %v", err)
+	}
+	return err
+}
+
+func get_open_thread_reports() ([]ThreadReport, error) {
+	query := `
+		SELECT r.id, r.thread_id, r.reporter_id, u.username, r.reason, p.title,
+		       DATE_FORMAT(r.created_at, '%Y-%m-%d %H:%i')
+		FROM ThreadReports r
+		JOIN Users u ON r.reporter_id = u.id
+		JOIN MessageThreads t ON r.thread_id = t.id
+		JOIN Posts p ON t.post_id = p.id
+		WHERE r.status = 'open'
+		ORDER BY r.created_at`
+
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var reports []ThreadReport
+	for rows.Next() {
+		var report ThreadReport
+		err := rows.Scan(&report.ID, &report.ThreadID, &report.ReporterID, &report.ReporterName,
+			&report.Reason, &report.PropertyTitle, &report.CreatedAt)
+		if err != nil {
+			log.Printf("Error scanning report: %v", err)
+			continue
+		}
+		reports = append(reports, report)
+	}
+
+	return reports, nil
+}
+
+func resolve_thread_report(reportID, moderatorID int) error {
+	result, err := db.Exec(`UPDATE ThreadReports SET status = 'resolved', resolved_by = ?, resolved_at = NOW()
+		WHERE id = ? AND status = 'open'`, moderatorID, reportID)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return fmt.Errorf("report not found or already resolved")
+	}
+	return nil
+}
+
+// load_thread_for_user fetches a thread the user may read. Participants can
+// always read it, moderators only once it has been reported.
+func load_thread_for_user(threadID, userID int) (*MessageThread, error) {
+	thread, err := get_thread(threadID)
+	if err != nil || thread == nil {
+		return nil, err
+	}
+	if thread.is_participant(userID) {
+		return thread, nil
+	}
+
+	if is_admin_user(userID) {
+		var reports int
+		db.QueryRow(`SELECT COUNT(*) FROM ThreadReports WHERE thread_id = ?`, threadID).Scan(&reports)
+		if reports > 0 {
+			return thread, nil
+		}
+	}
+	return nil, nil
+}
+
+// start_thread_from_form resolves the thread a new message belongs to from a
+// thread_id, booking_id or property_id form value
+func start_thread_from_form(r *http.Request, userID int) (*MessageThread, error) {
+	if threadID, err := strconv.Atoi(r.FormValue("thread_id")); err == nil {
+		thread, err := get_thread(threadID)
+		if err != nil || thread == nil || !thread.is_participant(userID) {
+			return nil, fmt.Errorf("conversation not found")
+		}
+		return thread, nil
+	}
+
+	if bookingID, err := strconv.Atoi(r.FormValue("booking_id")); err == nil {
+		booking, err := get_booking_by_id(bookingID)
+		if err != nil || booking == nil || (booking.UserID != userID && booking.HostID != userID) {
+			return nil, fmt.Errorf("booking not found")
+		}
+		return get_or_create_thread(booking.PostID, booking.ID, booking.UserID, booking.HostID)
+	}
+
+	if propertyID, err := strconv.Atoi(r.FormValue("property_id")); err == nil {
+		listing, err := get_listing_by_id(propertyID)
+		if err != nil || listing == nil {
+			return nil, fmt.Errorf("property not found")
+		}
+		if listing.UserID == userID {
+			return nil, fmt.Errorf("you can't message yourself about your own listing")
+		}
+		return get_or_create_thread(listing.ID, 0, userID, listing.UserID)
+	}
+
+	return nil, fmt.Errorf("a conversation, booking or property is required")
+}
+
+// inbox_handler serves /inbox and /inbox/{threadID}
+func inbox_handler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	authenticated, userID := is_authenticated(r)
+	if !authenticated {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	threads, err := get_user_threads(userID)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		log.Println("Error fetching threads:", err)
+		return
+	}
+
+	var thread *MessageThread
+	var messages []Message
+	canReply := false
+	masked := false
+
+	if path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/inbox"), "/"); path != "" {
+		threadID, err := strconv.Atoi(path)
+		if err != nil {
+			http.Error(w, "Invalid conversation ID", http.StatusBadRequest)
+			return
+		}
+
+		thread, err = load_thread_for_user(threadID, userID)
+		if err != nil || thread == nil {
+			http.Error(w, "Conversation not found", http.StatusNotFound)
+			return
+		}
+
+		messages, err = get_thread_messages(thread.ID, userID)
+		if err != nil {
+			log.Printf("Error fetching messages: %v", err)
+		}
+
+		canReply = thread.is_participant(userID)
+		if canReply {
+			mark_thread_read(thread, userID)
+			masked = !thread.has_confirmed_booking()
+			for i := range threads {
+				if threads[i].ID == thread.ID {
+					threads[i].UnreadCount = 0
+					thread.OtherUsername = threads[i].OtherUsername
+				}
+			}
+		}
+	}
+
+	isAdmin := is_admin_user(userID)
+	var reports []ThreadReport
+	if isAdmin {
+		reports, err = get_open_thread_reports()
+		if err != nil {
+			log.Printf("Error fetching thread reports: %v", err)
+		}
+	}
+
+	templateData := struct {
+		Auth     AuthContext
+		Threads  []MessageThread
+		Thread   *MessageThread
+		Messages []Message
+		CanReply bool
+		Masked   bool
+		IsAdmin  bool
+		Reports  []ThreadReport
+	}{
+		Auth:     get_auth(r),
+		Threads:  threads,
+		Thread:   thread,
+		Messages: messages,
+		CanReply: canReply,
+		Masked:   masked,
+		IsAdmin:  isAdmin,
+		Reports:  reports,
+	}
+
+	tmpl := template.Must(template.ParseFiles("template/inbox.html"))
+	err = tmpl.Execute(w, templateData)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		log.Println("Error executing template:", err)
+	}
+}
+
+func send_message_handler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	authenticated, userID := is_authenticated(r)
+	if !authenticated {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	thread, err := start_thread_from_form(r, userID)
+	if err != nil {
+		http.Error(w, "Error sending message: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	_, err = send_message(thread, userID, r.FormValue("body"))
+	if err != nil {
+		http.Error(w, "Error sending message: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	http.Redirect(w, r, "/inbox/"+strconv.Itoa(thread.ID), http.StatusSeeOther)
+}
+
+func report_thread_handler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	authenticated, userID := is_authenticated(r)
+	if !authenticated {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	threadID, err := strconv.Atoi(r.FormValue("thread_id"))
+	if err != nil {
+		http.Error(w, "Invalid conversation ID", http.StatusBadRequest)
+		return
+	}
+
+	thread, err := get_thread(threadID)
+	if err != nil || thread == nil {
+		http.Error(w, "Conversation not found", http.StatusNotFound)
+		return
+	}
+
+	err = report_thread(thread, userID, r.FormValue("reason"))
+	if err != nil {
+		http.Error(w, "Error reporting conversation: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	http.Redirect(w, r, "/inbox/"+strconv.Itoa(thread.ID), http.StatusSeeOther)
+}
+
+func resolve_report_handler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	authenticated, userID := is_authenticated(r)
+	if !authenticated || !is_admin_user(userID) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	reportID, err := strconv.Atoi(r.FormValue("report_id"))
+	if err != nil {
+		http.Error(w, "Invalid report ID", http.StatusBadRequest)
+		return
+	}
+
+	err = resolve_thread_report(reportID, userID)
+	if err != nil {
+		http.Error(w, "Error resolving report: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	http.Redirect(w, r, "/inbox", http.StatusSeeOther)
+}
+
+func write_json(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+func write_json_error(w http.ResponseWriter, status int, message string) {
+	write_json(w, status, map[string]string{"error": message})
+}
+
+// api_threads_handler serves the messaging JSON API:
+//
+//	GET  /api/threads          threads with unread counts
+//	GET  /api/threads/{id}     messages in a thread, marking it read
+//	POST /api/threads/{id}     send {"body": "..."} to a thread
+func api_threads_handler(w http.ResponseWriter, r *http.Request) {
+	authenticated, userID := is_authenticated(r)
+	if !authenticated {
+		write_json_error(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/threads"), "/")
+	if path == "" {
+		if r.Method != http.MethodGet {
+			write_json_error(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		threads, err := get_user_threads(userID)
+		if err != nil {
+			log.Println("Error fetching threads:", err)
+			write_json_error(w, http.StatusInternalServerError, "internal server error")
+			return
+		}
+		if threads == nil {
+			threads = []MessageThread{}
+		}
+		write_json(w, http.StatusOK, threads)
+		return
+	}
+
+	threadID, err := strconv.Atoi(path)
+	if err != nil {
+		write_json_error(w, http.StatusBadRequest, "invalid thread ID")
+		return
+	}
+
+	thread, err := get_thread(threadID)
+	if err != nil || thread == nil || !thread.is_participant(userID) {
+		write_json_error(w, http.StatusNotFound, "thread not found")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		messages, err := get_thread_messages(thread.ID, userID)
+		if err != nil {
+			log.Println("Error fetching messages:", err)
+			write_json_error(w, http.StatusInternalServerError, "internal server error")
+			return
+		}
+		if messages == nil {
+			messages = []Message{}
+		}
+		mark_thread_read(thread, userID)
+		write_json(w, http.StatusOK, messages)
+
+	case http.MethodPost:
+		var request struct {
+			Body string `json:"body"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			write_json_error(w, http.StatusBadRequest, "invalid JSON body")
+			return
+		}
+		message, err := send_message(thread, userID, request.Body)
+		if err != nil {
+			write_json_error(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		write_json(w, http.StatusCreated, message)
+
+	default:
+		write_json_error(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func api_unread_messages_handler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		write_json_error(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	authenticated, userID := is_authenticated(r)
+	if !authenticated {
+		write_json_error(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+
+	write_json(w, http.StatusOK, map[string]int{"unread": get_unread_message_count(userID)})
+}
+
+func update_tables_for_messaging() {
+	createQueries := []string{
+		`CREATE TABLE IF NOT EXISTS MessageThreads (
+			id INT AUTO_INCREMENT PRIMARY KEY,
+			post_id INT NOT NULL,
+			booking_id INT NULL UNIQUE,
+			guest_id INT NOT NULL,
+			host_id INT NOT NULL,
+			guest_last_read_id INT NOT NULL DEFAULT 0,
+			host_last_read_id INT NOT NULL DEFAULT 0,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			last_message_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			INDEX idx_guest (guest_id, last_message_at),
+			INDEX idx_host (host_id, last_message_at),
+			FOREIGN KEY (post_id) REFERENCES Posts(id) ON DELETE CASCADE ON UPDATE CASCADE,
+			FOREIGN KEY (booking_id) REFERENCES Bookings(id) ON DELETE SET NULL ON UPDATE CASCADE,
+			FOREIGN KEY (guest_id) REFERENCES Users(id) ON DELETE CASCADE ON UPDATE CASCADE,
+			FOREIGN KEY (host_id) REFERENCES Users(id) ON DELETE CASCADE ON UPDATE CASCADE
+		)`,
+		`CREATE TABLE IF NOT EXISTS Messages (
+			id INT AUTO_INCREMENT PRIMARY KEY,
+			thread_id INT NOT NULL,
+			sender_id INT NOT NULL,
+			body TEXT NOT NULL,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			INDEX idx_thread (thread_id, id),
+			FOREIGN KEY (thread_id) REFERENCES MessageThreads(id) ON DELETE CASCADE ON UPDATE CASCADE,
+			FOREIGN KEY (sender_id) REFERENCES Users(id) ON DELETE CASCADE ON UPDATE CASCADE
+		)`,
+		`CREATE TABLE IF NOT EXISTS ThreadReports (
+			id INT AUTO_INCREMENT PRIMARY KEY,
+			thread_id INT NOT NULL,
+			reporter_id INT NOT NULL,
+			reason VARCHAR(500) NOT NULL,
+			status ENUM('open', 'resolved') NOT NULL DEFAULT 'open',
+			resolved_by INT NULL,
+			resolved_at DATETIME NULL,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (thread_id) REFERENCES MessageThreads(id) ON DELETE CASCADE ON UPDATE CASCADE,
+			FOREIGN KEY (reporter_id) REFERENCES Users(id) ON DELETE CASCADE ON UPDATE CASCADE
+		)`,
+	}
+
+	for _, query := range createQueries {
+		_, err := db.Exec(query)
+		if err != nil {
+			log.Printf("Error creating messaging tables: %v", err)
+		}
+	}
+
+	log.Println("Tables updated for messaging")
+}
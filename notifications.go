@@ -0,0 +1,298 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	NOTIFICATION_NEW_BOOKING       = "booking_created"
+	NOTIFICATION_BOOKING_CANCELLED = "booking_cancelled"
+	NOTIFICATION_REVIEW_ENABLED    = "review_enabled"
+	NOTIFICATION_REVIEW_RECEIVED   = "review_received"
+	NOTIFICATION_NEW_MESSAGE       = "new_message"
+	NOTIFICATION_CHECKIN_REMINDER  = "checkin_reminder"
+	NOTIFICATION_REVIEWS_PUBLISHED = "reviews_published"
+	NOTIFICATION_REVIEW_REPLY      = "review_reply"
+	NOTIFICATION_REVIEW_HIDDEN     = "review_hidden"
+)
+
+const NOTIFICATION_FEED_SIZE = 20
+
+// How often the stream sends a comment so proxies keep the connection open
+const NOTIFICATION_HEARTBEAT = 25 * time.Second
+
+type Notification struct {
+	ID        int    `json:"id"`
+	UserID    int    `json:"user_id"`
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	Body      string `json:"body"`
+	Link      string `json:"link"`
+	Read      bool   `json:"read"`
+	CreatedAt string `json:"created_at"`
+}
+
+// NotificationPublisher delivers stored notifications to connected clients
+type NotificationPublisher interface {
+	Publish(notification Notification) error
+}
+
+// NotificationSubscriber opens a stream of a user's new notifications. The
+// returned function must be called when the stream closes.
+type NotificationSubscriber interface {
+	Subscribe(userID int) (<-chan Notification, func())
+}
+
+// NotificationBroker carries notifications from the instance that creates them
+// to the streams open on any instance. The in-process hub is the default; a
+// message broker can implement both sides to fan out across several servers.
+type NotificationBroker interface {
+	NotificationPublisher
+	NotificationSubscriber
+}
+
+// NotificationHub keeps the open streams of each user in this process
+type NotificationHub struct {
+	mu          sync.Mutex
+	subscribers map[int]map[chan Notification]struct{}
+}
+
+func new_notification_hub() *NotificationHub {
+	return &NotificationHub{subscribers: make(map[int]map[chan Notification]struct{})}
+}
+
+// Subscribe registers a stream for the user. The returned function must be
+// called when the stream closes.
+func (h *NotificationHub) Subscribe(userID int) (<-chan Notification, func()) {
+	ch := make(chan Notification, 16)
+
+	h.mu.Lock()
+	if h.subscribers[userID] == nil {
+		h.subscribers[userID] = make(map[chan Notification]struct{})
+	}
+	h.subscribers[userID][ch] = struct{}{}
+	h.mu.Unlock()
+
+	return ch, func() {
+		h.mu.Lock()
+		delete(h.subscribers[userID], ch)
+		if len(h.subscribers[userID]) == 0 {
+			delete(h.subscribers, userID)
+		}
+		h.mu.Unlock()
+	}
+}
+
+func (h *NotificationHub) Publish(notification Notification) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for ch := range h.subscribers[notification.UserID] {
+		select {
+		case ch <- notification:
+		default:
+			// Slow clients skip live updates and catch up from the feed
+		}
+	}
+	return nil
+}
+
+var notification_broker NotificationBroker = new_notification_hub()
+
+// notify stores a notification for the user and pushes it to their open
+// streams. Failures are logged since notifications never block the action
+// that caused them.
+func notify(userID int, kind, title, body, link string) {
+	result, err := db.Exec(`INSERT INTO Notifications (user_id, type, title, body, link) VALUES (?, ?, ?, ?, ?)`,
+		userID, kind, title, body, link)
+	if err != nil {
+		log.Printf("Error saving notification: %v", err)
+		return
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		log.Printf("Error saving notification: %v", err)
+		return
+	}
+
+	notification := Notification{
+		ID:        int(id),
+		UserID:    userID,
+		Type:      kind,
+		Title:     title,
+		Body:      body,
+		Link:      link,
+		CreatedAt: time.Now().Format("2006-01-02 15:04"),
+	}
+	if err := notification_broker.Publish(notification); err != nil {
+		log.Printf("Error publishing notification: %v", err)
+	}
+}
+
+func get_user_notifications(userID, limit int) ([]Notification, error) {
+	query := `
+		SELECT id, user_id, type, title, body, link, is_read, DATE_FORMAT(created_at, '%Y-%m-%d %H:%i')
+		FROM Notifications
+		WHERE user_id = ?
+		ORDER BY id DESC
+		LIMIT ?`
+
+	rows, err := db.Query(query, userID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	notifications := []Notification{}
+	for rows.Next() {
+		var notification Notification
+		err := rows.Scan(&notification.ID, &notification.UserID, &notification.Type, &notification.Title,
+			&notification.Body, &notification.Link, &notification.Read, &notification.CreatedAt)
+		if err != nil {
+			log.Printf("Error scanning notification: %v", err)
+			continue
+		}
+		notifications = append(notifications, notification)
+	}
+
+	return notifications, nil
+}
+
+func get_unread_notification_count(userID int) int {
+	var count int
+	err := db.QueryRow(`SELECT COUNT(*) FROM Notifications WHERE user_id = ? AND is_read = false`, userID).Scan(&count)
+	if err != nil {
+		log.Printf("Error counting notifications: %v", err)
+		return 0
+	}
+	return count
+}
+
+// mark_notifications_read marks one notification read, or all of the user's
+// notifications when notificationID is 0
+func mark_notifications_read(userID, notificationID int) error {
+	var err error
+	if notificationID > 0 {
+		_, err = db.Exec(`UPDATE Notifications SET is_read = true WHERE id = ? AND user_id = ?`, notificationID, userID)
+	} else {
+		_, err = db.Exec(`UPDATE Notifications SET is_read = true WHERE user_id = ? AND is_read = false`, userID)
+	}
+	return err
+}
+
+// notifications_stream_handler keeps a Server-Sent Events connection open and
+// forwards the user's notifications as they are published
+func notifications_stream_handler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	authenticated, userID := is_authenticated(r)
+	if !authenticated {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	notifications, unsubscribe := notification_broker.Subscribe(userID)
+	defer unsubscribe()
+
+	fmt.Fprintf(w, "event: unread\ndata: %d\n\n", get_unread_notification_count(userID))
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(NOTIFICATION_HEARTBEAT)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": ping\n\n")
+			flusher.Flush()
+		case notification := <-notifications:
+			data, err := json.Marshal(notification)
+			if err != nil {
+				log.Printf("Error encoding notification: %v", err)
+				continue
+			}
+			fmt.Fprintf(w, "id: %d\nevent: notification\ndata: %s\n\n", notification.ID, data)
+			flusher.Flush()
+		}
+	}
+}
+
+// api_notifications_handler serves the bell feed on GET and marks
+// notifications read on POST, either one by id or all of them
+func api_notifications_handler(w http.ResponseWriter, r *http.Request) {
+	authenticated, userID := is_authenticated(r)
+	if !authenticated {
+		write_json_error(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		notifications, err := get_user_notifications(userID, NOTIFICATION_FEED_SIZE)
+		if err != nil {
+			log.Println("Error fetching notifications:", err)
+			write_json_error(w, http.StatusInternalServerError, "internal server error")
+			return
+		}
+		write_json(w, http.StatusOK, map[string]interface{}{
+			"unread":        get_unread_notification_count(userID),
+			"notifications": notifications,
+		})
+
+	case http.MethodPost:
+		notificationID, _ := strconv.Atoi(r.FormValue("id"))
+		if err := mark_notifications_read(userID, notificationID); err != nil {
+			log.Println("Error marking notifications read:", err)
+			write_json_error(w, http.StatusInternalServerError, "internal server error")
+			return
+		}
+		write_json(w, http.StatusOK, map[string]int{"unread": get_unread_notification_count(userID)})
+
+	default:
+		write_json_error(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func update_tables_for_notifications() {
+	createQuery := `CREATE TABLE IF NOT EXISTS Notifications (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		user_id INT NOT NULL,
+		type VARCHAR(40) NOT NULL,
+		title VARCHAR(255) NOT NULL,
+		body VARCHAR(500) NOT NULL DEFAULT '',
+		link VARCHAR(255) NOT NULL DEFAULT '',
+		is_read BOOLEAN NOT NULL DEFAULT FALSE,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		INDEX idx_user_read (user_id, is_read),
+		FOREIGN KEY (user_id) REFERENCES Users(id) ON DELETE CASCADE ON UPDATE CASCADE
+	)`
+
+	_, err := db.Exec(createQuery)
+	if err != nil {
+		log.Printf("Error creating notifications table: %v", err)
+	}
+
+	log.Println("Tables updated for notifications")
+}
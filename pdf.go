@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// PDFDocument is a minimal writer for text-based A4 documents using the
+// built-in Helvetica fonts, enough for invoices without external libraries
+type PDFDocument struct {
+	pages []*bytes.Buffer
+}
+
+const (
+	PDF_PAGE_WIDTH  = 595
+	PDF_PAGE_HEIGHT = 842
+)
+
+func new_pdf_document() *PDFDocument {
+	doc := &PDFDocument{}
+	doc.AddPage()
+	return doc
+}
+
+func (d *PDFDocument) AddPage() {
+	d.pages = append(d.pages, &bytes.Buffer{})
+}
+
+func (d *PDFDocument) current() *bytes.Buffer {
+	return d.pages[len(d.pages)-1]
+}
+
+// Text draws s with its baseline at (x, y), measured from the bottom left corner
+func (d *PDFDocument) Text(x, y float64, size float64, bold bool, s string) {
+	font := "F1"
+	if bold {
+		font = "F2"
+	}
+	fmt.Fprintf(d.current(), "BT /%s %.1f Tf %.2f %.2f Td (%s) Tj ET\n", font, size, x, y, pdf_escape(s))
+}
+
+// TextRight draws s so that it ends at x, using an approximate Helvetica width
+func (d *PDFDocument) TextRight(x, y float64, size float64, bold bool, s string) {
+	d.Text(x-pdf_text_width(s, size), y, size, bold, s)
+}
+
+func (d *PDFDocument) Line(x1, y1, x2, y2 float64) {
+	fmt.Fprintf(d.current(), "%.2f %.2f m %.2f %.2f l S\n", x1, y1, x2, y2)
+}
+
+func (d *PDFDocument) Bytes() []byte {
+	var out bytes.Buffer
+	var offsets []int
+
+	writeObject := func(body string) {
+		offsets = append(offsets, out.Len())
+		fmt.Fprintf(&out, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+	}
+
+	out.WriteString("%PDF-1.4\n")
+
+	// Objects 1-4 are the catalog, page tree and fonts, pages follow in pairs
+	kids := make([]string, len(d.pages))
+	for i := range d.pages {
+		kids[i] = fmt.Sprintf("%d 0 R", 5+i*2)
+	}
+
+	writeObject("<< /Type /Catalog /Pages 2 0 R >>")
+	writeObject(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(d.pages)))
+	writeObject("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>")
+	writeObject("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >>")
+
+	for i, page := range d.pages {
+		writeObject(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %d %d] /Contents %d 0 R "+
+			"/Resources << /Font << /F1 3 0 R /F2 4 0 R >> >> >>", PDF_PAGE_WIDTH, PDF_PAGE_HEIGHT, 6+i*2))
+		writeObject(fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", page.Len(), page.String()))
+	}
+
+	xrefOffset := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xrefOffset)
+
+	return out.Bytes()
+}
+
+// pdf_escape escapes string delimiters and maps text to WinAnsi, replacing
+// characters the standard fonts can't show
+func pdf_escape(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r == '€':
+			b.WriteString("\\200")
+		case r >= 32 && r < 127:
+			b.WriteRune(r)
+		case r >= 160 && r <= 255:
+			fmt.Fprintf(&b, "\\%03o", r)
+		default:
+			b.WriteByte('?')
+		}
+	}
+	return b.String()
+}
+
+func pdf_text_width(s string, size float64) float64 {
+	// Average Helvetica glyph is about half the font size wide
+	return float64(len([]rune(s))) * size * 0.5
+}
@@ -0,0 +1,584 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Promotion struct {
+	ID             int
+	Code           string
+	Description    string
+	DiscountType   string // "percent" or "fixed"
+	Amount         float64
+	Currency       string
+	Scope          string // "platform", "host" or "listing"
+	HostID         int
+	ListingIDs     []int
+	ValidFrom      sql.NullTime
+	ValidUntil     sql.NullTime
+	MaxUses        int // 0 means unlimited
+	MaxUsesPerUser int // 0 means unlimited
+	MinNights      int
+	Active         bool
+	CreatedBy      int
+	CreatedAt      string
+}
+
+// PromotionUsage is one row of the per-code redemption report
+type PromotionUsage struct {
+	Promotion     Promotion
+	Redemptions   int
+	UniqueUsers   int
+	TotalDiscount float64
+}
+
+func get_promotion_by_code(code string) (*Promotion, error) {
+	query := `
+		SELECT id, code, COALESCE(description, ''), discount_type, amount, currency, scope,
+		       COALESCE(host_id, 0), valid_from, valid_until, COALESCE(max_uses, 0),
+		       COALESCE(max_uses_per_user, 0), min_nights, active, created_by, created_at
+		FROM Promotions WHERE code = ?`
+
+	var promo Promotion
+	err := db.QueryRow(query, strings.ToUpper(strings.TrimSpace(code))).Scan(
+		&promo.ID, &promo.Code, &promo.Description, &promo.DiscountType, &promo.Amount,
+		&promo.Currency, &promo.Scope, &promo.HostID, &promo.ValidFrom, &promo.ValidUntil,
+		&promo.MaxUses, &promo.MaxUsesPerUser, &promo.MinNights, &promo.Active,
+		&promo.CreatedBy, &promo.CreatedAt,
+	)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		log.Printf("Error querying promotion: %v", err)
+		return nil, err
+	}
+
+	promo.ListingIDs = get_promotion_listings(promo.ID)
+	return &promo, nil
+}
+
+func get_promotion_listings(promotionID int) []int {
+	var listingIDs []int
+
+	rows, err := db.Query("SELECT post_id FROM PromotionListings WHERE promotion_id = ?", promotionID)
+	if err != nil {
+		log.Printf("Error querying promotion listings: %v", err)
+		return listingIDs
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var listingID int
+		if err := rows.Scan(&listingID); err != nil {
+			log.Printf("Error scanning promotion listing: %v", err)
+			continue
+		}
+		listingIDs = append(listingIDs, listingID)
+	}
+
+	return listingIDs
+}
+
+// applies_to checks the scope, validity window and minimum stay of a promotion.
+// Usage caps are checked separately because they need the database.
+func (p *Promotion) applies_to(listing *Listing, nights int, now time.Time) error {
+	if !p.Active {
+		return fmt.Errorf("this code is no longer active")
+	}
+	if p.ValidFrom.Valid && now.Before(p.ValidFrom.Time) {
+		return fmt.Errorf("this code is not valid yet")
+	}
+	if p.ValidUntil.Valid && now.After(p.ValidUntil.Time) {
+		return fmt.Errorf("this code has expired")
+	}
+	if nights < p.MinNights {
+		return fmt.Errorf("this code requires a stay of at least %d nights", p.MinNights)
+	}
+
+	switch p.Scope {
+	case "host":
+		if listing.UserID != p.HostID {
+			return fmt.Errorf("this code is not valid for this property")
+		}
+	case "listing":
+		found := false
+		for _, listingID := range p.ListingIDs {
+			if listingID == listing.ID {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("this code is not valid for this property")
+		}
+	}
+
+	return nil
+}
+
+// discount_for returns the discount on subtotal, in the listing's currency
+func (p *Promotion) discount_for(subtotal float64, currency string) (float64, error) {
+	var discount float64
+
+	switch p.DiscountType {
+	case "percent":
+		discount = subtotal * p.Amount / 100
+	case "fixed":
+		converted, _, err := convert_amount(p.Amount, p.Currency, currency)
+		if err != nil {
+			return 0, err
+		}
+		discount = converted
+	default:
+		return 0, fmt.Errorf("unknown discount type: %s", p.DiscountType)
+	}
+
+	if discount > subtotal {
+		discount = subtotal
+	}
+	return round_money(discount), nil
+}
+
+// check_promotion_usage verifies the global and per-user caps. Redemptions of
+// cancelled bookings give the use back. Pass a transaction with the promotion
+// row locked to make the check race free.
+func check_promotion_usage(q interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}, promo *Promotion, userID int) error {
+	if promo.MaxUses > 0 {
+		var uses int
+		err := q.QueryRow(`SELECT COUNT(*) FROM PromotionRedemptions r JOIN Bookings b ON b.id = r.booking_id
+			WHERE r.promotion_id = ? AND COALESCE(b.status, 'confirmed') != 'cancelled'`, promo.ID).Scan(&uses)
+		if err != nil {
+			return err
+		}
+		if uses >= promo.MaxUses {
+			return fmt.Errorf("this code has reached its usage limit")
+		}
+	}
+
+	if promo.MaxUsesPerUser > 0 {
+		var uses int
+		err := q.QueryRow(`SELECT COUNT(*) FROM PromotionRedemptions r JOIN Bookings b ON b.id = r.booking_id
+			WHERE r.promotion_id = ? AND r.user_id = ? AND COALESCE(b.status, 'confirmed') != 'cancelled'`, promo.ID, userID).Scan(&uses)
+		if err != nil {
+			return err
+		}
+		if uses >= promo.MaxUsesPerUser {
+			return fmt.Errorf("you have already used this code")
+		}
+	}
+
+	return nil
+}
+
+// apply_promotion_code validates a code for a booking and returns the
+// promotion together with the discount in the listing's currency
+func apply_promotion_code(code string, userID int, listing *Listing, nights int, subtotal float64) (*Promotion, float64, error) {
+	promo, err := get_promotion_by_code(code)
+	if err != nil {
+		return nil, 0, err
+	}
+	if promo == nil {
+		return nil, 0, fmt.Errorf("invalid promotion code")
+	}
+
+	if err := promo.applies_to(listing, nights, time.Now()); err != nil {
+		return nil, 0, err
+	}
+	if err := check_promotion_usage(db, promo, userID); err != nil {
+		return nil, 0, err
+	}
+
+	discount, err := promo.discount_for(subtotal, listing.Currency)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return promo, discount, nil
+}
+
+// redeem_promotion records a redemption inside the booking transaction. The
+// promotion row is locked first so concurrent bookings can't exceed the caps.
+func redeem_promotion(tx *sql.Tx, promo *Promotion, bookingID, userID int, discount float64, currency string) error {
+	var locked int
+	err := tx.QueryRow("SELECT id FROM Promotions WHERE id = ? FOR UPDATE", promo.ID).Scan(&locked)
+	if err != nil {
+		return err
+	}
+
+	if err := check_promotion_usage(tx, promo, userID); err != nil {
+		return err
+	}
+
+	query := `INSERT INTO PromotionRedemptions (promotion_id, booking_id, user_id, discount_amount, currency)
+			  VALUES (?, ?, ?, ?, ?)`
+	_, err = tx.Exec(query, promo.ID, bookingID, userID, discount, currency)
+	if err != nil {
+		log.Printf("Error recording promotion redemption: %v", err)
+		return err
+	}
+
+	return nil
+}
+
+func create_promotion(promo *Promotion) (int, error) {
+	query := `INSERT INTO Promotions (code, description, discount_type, amount, currency, scope, host_id,
+			  valid_from, valid_until, max_uses, max_uses_per_user, min_nights, active, created_by)
+			  VALUES (?, ?, ?, ?, ?, ?, NULLIF(?, 0), ?, ?, NULLIF(?, 0), NULLIF(?, 0), ?, ?, ?)`
+
+	// The promotion only exists with all of its listings
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(query, promo.Code, promo.Description, promo.DiscountType, promo.Amount,
+		promo.Currency, promo.Scope, promo.HostID, promo.ValidFrom, promo.ValidUntil, promo.MaxUses,
+		promo.MaxUsesPerUser, promo.MinNights, promo.Active, promo.CreatedBy)
+	if err != nil {
+		log.Printf("Error creating promotion: %v", err)
+		return 0, err
+	}
+
+	promotionID, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	for _, listingID := range promo.ListingIDs {
+		_, err := tx.Exec("INSERT INTO PromotionListings (promotion_id, post_id) VALUES (?, ?)", promotionID, listingID)
+		if err != nil {
+			log.Printf("Error adding listing %d to promotion: %v", listingID, err)
+			return 0, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	log.Printf("Promotion %s created by user %d", promo.Code, promo.CreatedBy)
+	return int(promotionID), nil
+}
+
+func set_promotion_active(promotionID, userID int, active bool, isAdmin bool) error {
+	query := "UPDATE Promotions SET active = ? WHERE id = ? AND (created_by = ? OR ?)"
+	result, err := db.Exec(query, active, promotionID, userID, isAdmin)
+	if err != nil {
+		log.Printf("Error updating promotion: %v", err)
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return fmt.Errorf("promotion not found or access denied")
+	}
+
+	return nil
+}
+
+// get_promotion_usage_report returns per-code redemption totals. Admins see
+// every code, other users only the codes they created.
+func get_promotion_usage_report(userID int, isAdmin bool) ([]PromotionUsage, error) {
+	var report []PromotionUsage
+
+	query := `
+		SELECT p.id, p.code, COALESCE(p.description, ''), p.discount_type, p.amount, p.currency,
+		       p.scope, COALESCE(p.max_uses, 0), COALESCE(p.max_uses_per_user, 0), p.min_nights,
+		       p.valid_from, p.valid_until, p.active, p.created_at,
+		       COUNT(r.id), COUNT(DISTINCT r.user_id), COALESCE(SUM(r.discount_amount / COALESCE(er.rate, 1)), 0)
+		FROM Promotions p
+		LEFT JOIN PromotionRedemptions r ON p.id = r.promotion_id
+		LEFT JOIN ExchangeRates er ON r.currency = er.currency
+		WHERE p.created_by = ? OR ?
+		GROUP BY p.id
+		ORDER BY p.created_at DESC`
+
+	rows, err := db.Query(query, userID, isAdmin)
+	if err != nil {
+		log.Printf("Error querying promotion usage: %v", err)
+		return report, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var usage PromotionUsage
+		promo := &usage.Promotion
+		err := rows.Scan(
+			&promo.ID, &promo.Code, &promo.Description, &promo.DiscountType, &promo.Amount,
+			&promo.Currency, &promo.Scope, &promo.MaxUses, &promo.MaxUsesPerUser, &promo.MinNights,
+			&promo.ValidFrom, &promo.ValidUntil, &promo.Active, &promo.CreatedAt,
+			&usage.Redemptions, &usage.UniqueUsers, &usage.TotalDiscount,
+		)
+		if err != nil {
+			log.Printf("Error scanning promotion usage: %v", err)
+			continue
+		}
+		report = append(report, usage)
+	}
+
+	return report, nil
+}
+
+func promotions_handler(w http.ResponseWriter, r *http.Request) {
+	authenticated, userID := is_authenticated(r)
+	if !authenticated {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	isAdmin := is_admin_user(userID)
+
+	switch r.Method {
+	case http.MethodGet:
+		report, err := get_promotion_usage_report(userID, isAdmin)
+		if err != nil {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		templateData := struct {
+			Auth       AuthContext
+			IsAdmin    bool
+			Report     []PromotionUsage
+			Listings   []Listing
+			Currencies []string
+			BaseSymbol string
+		}{
+			Auth:       get_auth(r),
+			IsAdmin:    isAdmin,
+			Report:     report,
+			Listings:   get_user_listings(userID, false),
+			Currencies: get_supported_currencies(),
+			BaseSymbol: currency_symbol(BASE_CURRENCY),
+		}
+
+		tmpl := template.Must(template.ParseFiles("template/promotions_page.html"))
+		err = tmpl.Execute(w, templateData)
+		if err != nil {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			log.Println("Error executing template:", err)
+		}
+
+	case http.MethodPost:
+		promo, err := parse_promotion_form(r, userID, isAdmin)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		_, err = create_promotion(promo)
+		if err != nil {
+			http.Error(w, "Error creating promotion: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		http.Redirect(w, r, "/promotions", http.StatusSeeOther)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func parse_promotion_form(r *http.Request, userID int, isAdmin bool) (*Promotion, error) {
+	err := r.ParseForm()
+	if err != nil {
+		return nil, fmt.Errorf("error parsing form")
+	}
+
+	promo := &Promotion{
+		Code:         strings.ToUpper(strings.TrimSpace(r.FormValue("code"))),
+		Description:  strings.TrimSpace(r.FormValue("description")),
+		DiscountType: r.FormValue("discount_type"),
+		Currency:     strings.ToUpper(r.FormValue("currency")),
+		Scope:        r.FormValue("scope"),
+		Active:       true,
+		CreatedBy:    userID,
+	}
+
+	if promo.Code == "" || len(promo.Code) > 40 {
+		return nil, fmt.Errorf("code is required and must be at most 40 characters")
+	}
+
+	promo.Amount, err = strconv.ParseFloat(r.FormValue("amount"), 64)
+	if err != nil || promo.Amount <= 0 {
+		return nil, fmt.Errorf("invalid discount amount")
+	}
+
+	switch promo.DiscountType {
+	case "percent":
+		if promo.Amount > 100 {
+			return nil, fmt.Errorf("percentage discount cannot exceed 100")
+		}
+		promo.Currency = BASE_CURRENCY
+	case "fixed":
+		if !is_supported_currency(promo.Currency) {
+			return nil, fmt.Errorf("unsupported currency")
+		}
+	default:
+		return nil, fmt.Errorf("invalid discount type")
+	}
+
+	switch promo.Scope {
+	case "platform":
+		if !isAdmin {
+			return nil, fmt.Errorf("only admins can create platform-wide codes")
+		}
+	case "host":
+		promo.HostID = userID
+	case "listing":
+		for _, idStr := range r.Form["listing_ids"] {
+			listingID, err := strconv.Atoi(idStr)
+			if err != nil {
+				return nil, fmt.Errorf("invalid listing ID")
+			}
+			listing, err := get_listing_by_id(listingID)
+			if err != nil || listing == nil || (listing.UserID != userID && !isAdmin) {
+				return nil, fmt.Errorf("listing %d not found or access denied", listingID)
+			}
+			promo.ListingIDs = append(promo.ListingIDs, listingID)
+		}
+		if len(promo.ListingIDs) == 0 {
+			return nil, fmt.Errorf("select at least one listing")
+		}
+	default:
+		return nil, fmt.Errorf("invalid scope")
+	}
+
+	if validFrom := r.FormValue("valid_from"); validFrom != "" {
+		t, err := time.Parse("2006-01-02", validFrom)
+		if err != nil {
+			return nil, fmt.Errorf("invalid start date")
+		}
+		promo.ValidFrom = sql.NullTime{Time: t, Valid: true}
+	}
+
+	if validUntil := r.FormValue("valid_until"); validUntil != "" {
+		t, err := time.Parse("2006-01-02", validUntil)
+		if err != nil {
+			return nil, fmt.Errorf("invalid end date")
+		}
+		// Valid through the end of the given day
+		promo.ValidUntil = sql.NullTime{Time: t.Add(24*time.Hour - time.Second), Valid: true}
+	}
+
+	if promo.ValidFrom.Valid && promo.ValidUntil.Valid && promo.ValidUntil.Time.Before(promo.ValidFrom.Time) {
+		return nil, fmt.Errorf("end date must be after start date")
+	}
+
+	promo.MaxUses, _ = strconv.Atoi(r.FormValue("max_uses"))
+	promo.MaxUsesPerUser, _ = strconv.Atoi(r.FormValue("max_uses_per_user"))
+	promo.MinNights, _ = strconv.Atoi(r.FormValue("min_nights"))
+	if promo.MaxUses < 0 || promo.MaxUsesPerUser < 0 || promo.MinNights < 0 {
+		return nil, fmt.Errorf("limits cannot be negative")
+	}
+
+	return promo, nil
+}
+
+func toggle_promotion_handler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	authenticated, userID := is_authenticated(r)
+	if !authenticated {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	promotionID, err := strconv.Atoi(r.FormValue("promotion_id"))
+	if err != nil {
+		http.Error(w, "Invalid promotion ID", http.StatusBadRequest)
+		return
+	}
+
+	active := r.FormValue("active") == "true"
+	err = set_promotion_active(promotionID, userID, active, is_admin_user(userID))
+	if err != nil {
+		http.Error(w, "Error updating promotion: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	http.Redirect(w, r, "/promotions", http.StatusSeeOther)
+}
+
+func update_tables_for_promotions() {
+	createQueries := []string{
+		`CREATE TABLE IF NOT EXISTS Promotions (
+			id INT AUTO_INCREMENT PRIMARY KEY,
+			code VARCHAR(40) NOT NULL UNIQUE,
+			description VARCHAR(255),
+			discount_type ENUM('percent', 'fixed') NOT NULL,
+			amount DECIMAL(10, 2) NOT NULL,
+			currency CHAR(3) NOT NULL DEFAULT 'USD',
+			scope ENUM('platform', 'host', 'listing') NOT NULL DEFAULT 'platform',
+			host_id INT NULL,
+			valid_from DATETIME NULL,
+			valid_until DATETIME NULL,
+			max_uses INT NULL,
+			max_uses_per_user INT NULL,
+			min_nights INT NOT NULL DEFAULT 0,
+			active BOOLEAN NOT NULL DEFAULT TRUE,
+			created_by INT NOT NULL,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (host_id) REFERENCES Users(id) ON DELETE CASCADE ON UPDATE CASCADE,
+			FOREIGN KEY (created_by) REFERENCES Users(id) ON DELETE CASCADE ON UPDATE CASCADE
+		)`,
+		`CREATE TABLE IF NOT EXISTS PromotionListings (
+			promotion_id INT NOT NULL,
+			post_id INT NOT NULL,
+			PRIMARY KEY (promotion_id, post_id),
+			FOREIGN KEY (promotion_id) REFERENCES Promotions(id) ON DELETE CASCADE ON UPDATE CASCADE,
+			FOREIGN KEY (post_id) REFERENCES Posts(id) ON DELETE CASCADE ON UPDATE CASCADE
+		)`,
+		`CREATE TABLE IF NOT EXISTS PromotionRedemptions (
+			id INT AUTO_INCREMENT PRIMARY KEY,
+			promotion_id INT NOT NULL,
+			booking_id INT NOT NULL,
+			user_id INT NOT NULL,
+			discount_amount DECIMAL(10, 2) NOT NULL,
+			currency CHAR(3) NOT NULL,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (promotion_id) REFERENCES Promotions(id) ON DELETE CASCADE ON UPDATE CASCADE,
+			FOREIGN KEY (booking_id) REFERENCES Bookings(id) ON DELETE CASCADE ON UPDATE CASCADE,
+			FOREIGN KEY (user_id) REFERENCES Users(id) ON DELETE CASCADE ON UPDATE CASCADE
+		)`,
+	}
+
+	for _, query := range createQueries {
+		_, err := db.Exec(query)
+		if err != nil {
+			log.Printf("Error creating promotion tables: %v", err)
+		}
+	}
+
+	alterQueries := []string{
+		`ALTER TABLE Bookings ADD COLUMN subtotal DECIMAL(10, 2) NULL`,
+		`ALTER TABLE Bookings ADD COLUMN discount_amount DECIMAL(10, 2) NOT NULL DEFAULT 0`,
+		`ALTER TABLE Bookings ADD COLUMN promotion_code VARCHAR(40) NULL`,
+	}
+
+	for _, query := range alterQueries {
+		_, err := db.Exec(query)
+		if err != nil {
+			log.Printf("Note: column might already exist: %v", err)
+		}
+	}
+
+	log.Println("Tables updated for promotions")
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// ReviewCategory is one of the aspects guests rate besides the overall rating
+type ReviewCategory struct {
+	Key   string
+	Label string
+}
+
+var review_categories = []ReviewCategory{
+	{"cleanliness", "Cleanliness"},
+	{"accuracy", "Accuracy"},
+	{"communication", "Communication"},
+	{"location", "Location"},
+	{"checkin", "Check-in"},
+	{"value", "Value"},
+}
+
+type CategoryRating struct {
+	Key     string
+	Label   string
+	Average float64
+}
+
+type RatingBar struct {
+	Stars   int
+	Count   int
+	Percent float64
+}
+
+// ListingRating is the stored aggregate of a listing's visible reviews
+type ListingRating struct {
+	PostID       int
+	ReviewCount  int
+	Average      float64
+	Distribution []RatingBar
+	Categories   []CategoryRating
+}
+
+// parse_sub_ratings reads one 1-5 rating per category from the form values
+// named rating_<category>
+func parse_sub_ratings(value func(string) string) (map[string]int, error) {
+	ratings := make(map[string]int)
+	for _, category := range review_categories {
+		rating, err := strconv.Atoi(value("rating_" + category.Key))
+		if err != nil || rating < 1 || rating > 5 {
+			return nil, fmt.Errorf("%s rating must be between 1 and 5", category.Label)
+		}
+		ratings[category.Key] = rating
+	}
+	return ratings, nil
+}
+
+// listing_rating_upsert_sql recomputes the aggregates of the listings matching
+// the condition on p from their published, visible reviews
+func listing_rating_upsert_sql(condition string) string {
+	columns := []string{"post_id", "review_count", "rating_avg", "rating_1", "rating_2", "rating_3", "rating_4", "rating_5"}
+	selects := []string{"p.id", "COUNT(r.id)", "COALESCE(AVG(r.rating), 0)"}
+	for stars := 1; stars <= 5; stars++ {
+		selects = append(selects, fmt.Sprintf("COALESCE(SUM(r.rating = %d), 0)", stars))
+	}
+	for _, category := range review_categories {
+		columns = append(columns, category.Key+"_avg")
+		selects = append(selects, "AVG(r."+category.Key+"_rating)")
+	}
+
+	updates := make([]string, 0, len(columns)-1)
+	for _, column := range columns[1:] {
+		updates = append(updates, column+" = VALUES("+column+")")
+	}
+
+	return `INSERT INTO ListingRatings (` + strings.Join(columns, ", ") + `)
+		SELECT ` + strings.Join(selects, ", ") + `
+		FROM Posts p
+		LEFT JOIN Reviews r ON r.post_id = p.id AND r.published_at IS NOT NULL AND r.hidden_at IS NULL
+		WHERE ` + condition + `
+		GROUP BY p.id
+		ON DUPLICATE KEY UPDATE ` + strings.Join(updates, ", ")
+}
+
+// refresh_listing_rating updates a listing's aggregates. It runs whenever the
+// set of visible reviews of the listing changes.
+func refresh_listing_rating(q interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}, postID int) error {
+	_, err := q.Exec(listing_rating_upsert_sql("p.id = ?"), postID)
+	if err != nil {
+		log.Printf("Error refreshing rating of listing %d: %v", postID, err)
+	}
+	return err
+}
+
+func get_listing_rating(postID int) *ListingRating {
+	rating := &ListingRating{PostID: postID}
+
+	columns := []string{"review_count", "rating_avg", "rating_1", "rating_2", "rating_3", "rating_4", "rating_5"}
+	for _, category := range review_categories {
+		columns = append(columns, category.Key+"_avg")
+	}
+
+	var counts [5]int
+	categoryAverages := make([]sql.NullFloat64, len(review_categories))
+	dest := []interface{}{&rating.ReviewCount, &rating.Average, &counts[0], &counts[1], &counts[2], &counts[3], &counts[4]}
+	for i := range categoryAverages {
+		dest = append(dest, &categoryAverages[i])
+	}
+
+	err := db.QueryRow(`SELECT `+strings.Join(columns, ", ")+` FROM ListingRatings WHERE post_id = ?`, postID).Scan(dest...)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("Error fetching rating of listing %d: %v", postID, err)
+		}
+		return rating
+	}
+
+	for stars := 5; stars >= 1; stars-- {
+		bar := RatingBar{Stars: stars, Count: counts[stars-1]}
+		if rating.ReviewCount > 0 {
+			bar.Percent = float64(bar.Count) * 100 / float64(rating.ReviewCount)
+		}
+		rating.Distribution = append(rating.Distribution, bar)
+	}
+
+	for i, category := range review_categories {
+		if categoryAverages[i].Valid {
+			rating.Categories = append(rating.Categories, CategoryRating{
+				Key:     category.Key,
+				Label:   category.Label,
+				Average: categoryAverages[i].Float64,
+			})
+		}
+	}
+
+	return rating
+}
+
+func update_tables_for_ratings() {
+	for _, category := range review_categories {
+		_, err := db.Exec(`ALTER TABLE Reviews ADD COLUMN ` + category.Key + `_rating TINYINT NULL`)
+		if err != nil {
+			log.Printf("Note: column might already exist: %v", err)
+		}
+	}
+
+	categoryColumns := ""
+	for _, category := range review_categories {
+		categoryColumns += category.Key + "_avg DECIMAL(3,2) NULL,\n\t\t"
+	}
+
+	createQuery := `CREATE TABLE IF NOT EXISTS ListingRatings (
+		post_id INT PRIMARY KEY,
+		review_count INT NOT NULL DEFAULT 0,
+		rating_avg DECIMAL(3,2) NOT NULL DEFAULT 0,
+		rating_1 INT NOT NULL DEFAULT 0,
+		rating_2 INT NOT NULL DEFAULT 0,
+		rating_3 INT NOT NULL DEFAULT 0,
+		rating_4 INT NOT NULL DEFAULT 0,
+		rating_5 INT NOT NULL DEFAULT 0,
+		` + categoryColumns + `INDEX idx_rating (rating_avg),
+		FOREIGN KEY (post_id) REFERENCES Posts(id) ON DELETE CASCADE ON UPDATE CASCADE
+	)`
+
+	_, err := db.Exec(createQuery)
+	if err != nil {
+		log.Printf("Error creating listing ratings table: %v", err)
+	}
+
+	// Backfill so listings reviewed before aggregates existed have them too
+	_, err = db.Exec(listing_rating_upsert_sql("1 = 1"))
+	if err != nil {
+		log.Printf("Error computing listing ratings: %v", err)
+	}
+
+	log.Println("Tables updated for ratings")
+}
@@ -0,0 +1,451 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Similar listings kept per listing by the compute_listing_similarities job
+const SIMILAR_LISTINGS_KEPT = 12
+
+const SIMILAR_LISTINGS_SHOWN = 4
+
+const RECOMMENDATIONS_SHOWN = 8
+
+// Weights of the content similarity of two listings, they add up to 1
+const (
+	SIMILARITY_WEIGHT_TYPE      = 0.2
+	SIMILARITY_WEIGHT_CITY      = 0.3
+	SIMILARITY_WEIGHT_COUNTRY   = 0.1
+	SIMILARITY_WEIGHT_PRICE     = 0.2
+	SIMILARITY_WEIGHT_AMENITIES = 0.3
+)
+
+// Prices this many times apart are in different price bands
+const SIMILARITY_PRICE_RATIO = 3.0
+
+// Weight of guests who booked, saved or viewed both listings, on top of the
+// content similarity. Stays count for more than wishlists, views the least.
+const (
+	SIMILARITY_WEIGHT_CO_BOOKING  = 1.0
+	SIMILARITY_WEIGHT_CO_WISHLIST = 0.5
+	SIMILARITY_WEIGHT_CO_VIEW     = 0.25
+)
+
+// Detail views from this many days back count as co-views
+const CO_VIEW_DAYS = 30
+
+// How much a seed listing counts towards a user's recommendations
+const (
+	RECOMMENDATION_SEED_BOOKING  = 2.0
+	RECOMMENDATION_SEED_WISHLIST = 1.0
+)
+
+// listingFeatures are what content similarity compares two listings on
+type listingFeatures struct {
+	ID        int
+	UserID    int
+	Type      string
+	City      string
+	Country   string
+	BasePrice float64
+	Amenities map[int]bool
+}
+
+// co_occurrence_queries count, for each pair of listings, the guests who
+// chose or looked at both of them. Pairs come back once, with the lower id
+// first.
+var co_occurrence_queries = []struct {
+	Name   string
+	Weight float64
+	Query  string
+}{
+	{"co-booking", SIMILARITY_WEIGHT_CO_BOOKING, `SELECT b1.post_id, b2.post_id, COUNT(DISTINCT b1.user_id)
+		FROM Bookings b1
+		JOIN Bookings b2 ON b2.user_id = b1.user_id AND b2.post_id > b1.post_id
+		WHERE COALESCE(b1.status, 'confirmed') != 'cancelled' AND COALESCE(b2.status, 'confirmed') != 'cancelled'
+		GROUP BY b1.post_id, b2.post_id`},
+	{"co-wishlist", SIMILARITY_WEIGHT_CO_WISHLIST, `SELECT w1.post_id, w2.post_id, COUNT(DISTINCT w1.wishlist_id)
+		FROM WishlistItems w1
+		JOIN WishlistItems w2 ON w2.wishlist_id = w1.wishlist_id AND w2.post_id > w1.post_id
+		GROUP BY w1.post_id, w2.post_id`},
+	{"co-view", SIMILARITY_WEIGHT_CO_VIEW, fmt.Sprintf(`SELECT e1.post_id, e2.post_id, COUNT(DISTINCT e1.viewer)
+		FROM ListingEvents e1
+		JOIN ListingEvents e2 ON e2.viewer = e1.viewer AND e2.kind = e1.kind AND e2.post_id > e1.post_id
+		WHERE e1.kind = '%s' AND e1.created_at >= NOW() - INTERVAL %d DAY AND e2.created_at >= NOW() - INTERVAL %d DAY
+		GROUP BY e1.post_id, e2.post_id`, EVENT_VIEW, CO_VIEW_DAYS, CO_VIEW_DAYS)},
+}
+
+func load_listing_features() ([]listingFeatures, error) {
+	amenities := map[int]map[int]bool{}
+	rows, err := db.Query(`SELECT la.post_id, la.amenity_id FROM ListingAmenities la
+		JOIN AmenityCatalog ac ON ac.id = la.amenity_id WHERE ac.active = TRUE`)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var postID, amenityID int
+		if err := rows.Scan(&postID, &amenityID); err != nil {
+			log.Printf("Error scanning listing amenity: %v", err)
+			continue
+		}
+		if amenities[postID] == nil {
+			amenities[postID] = map[int]bool{}
+		}
+		amenities[postID][amenityID] = true
+	}
+	rows.Close()
+
+	rows, err = db.Query(`SELECT p.id, p.user_id, p.type, LOWER(COALESCE(p.city, '')), LOWER(p.country),
+		       p.price / COALESCE(er.rate, 1)
+		FROM Posts p
+		LEFT JOIN ExchangeRates er ON er.currency = p.currency`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var listings []listingFeatures
+	for rows.Next() {
+		var f listingFeatures
+		err := rows.Scan(&f.ID, &f.UserID, &f.Type, &f.City, &f.Country, &f.BasePrice)
+		if err != nil {
+			log.Printf("Error scanning listing features: %v", err)
+			continue
+		}
+		f.Amenities = amenities[f.ID]
+		listings = append(listings, f)
+	}
+	return listings, rows.Err()
+}
+
+// content_similarity scores two listings from 0 to 1 on their type, place,
+// price band and amenities
+func content_similarity(a, b listingFeatures) float64 {
+	score := 0.0
+	if a.Type != "" && a.Type == b.Type {
+		score += SIMILARITY_WEIGHT_TYPE
+	}
+	if a.Country == b.Country {
+		if a.City != "" && a.City == b.City {
+			score += SIMILARITY_WEIGHT_CITY
+		} else {
+			score += SIMILARITY_WEIGHT_COUNTRY
+		}
+	}
+	if a.BasePrice > 0 && b.BasePrice > 0 {
+		distance := math.Abs(math.Log(a.BasePrice/b.BasePrice)) / math.Log(SIMILARITY_PRICE_RATIO)
+		score += SIMILARITY_WEIGHT_PRICE * math.Max(0, 1-distance)
+	}
+	score += SIMILARITY_WEIGHT_AMENITIES * amenity_cosine(a.Amenities, b.Amenities)
+	return score
+}
+
+// amenity_cosine is the cosine similarity of two sets of amenity ids. Two
+// listings without any amenities are alike.
+func amenity_cosine(a, b map[int]bool) float64 {
+	if len(a) == 0 || len(b) == 0 {
+		if len(a) == len(b) {
+			return 1
+		}
+		return 0
+	}
+	both := 0
+	for id := range a {
+		if b[id] {
+			both++
+		}
+	}
+	return float64(both) / math.Sqrt(float64(len(a)*len(b)))
+}
+
+type listingPair struct {
+	a, b int
+}
+
+// load_co_occurrences adds up the collaborative signals of each pair of
+// listings. Each signal saturates, the first guests who chose both count most.
+func load_co_occurrences() map[listingPair]float64 {
+	scores := map[listingPair]float64{}
+	for _, signal := range co_occurrence_queries {
+		rows, err := db.Query(signal.Query)
+		if err != nil {
+			log.Printf("Error loading %s signal: %v", signal.Name, err)
+			continue
+		}
+		for rows.Next() {
+			var pair listingPair
+			var count int
+			if err := rows.Scan(&pair.a, &pair.b, &count); err != nil {
+				log.Printf("Error scanning %s signal: %v", signal.Name, err)
+				continue
+			}
+			scores[pair] += signal.Weight * (1 - 1/float64(1+count))
+		}
+		rows.Close()
+	}
+	return scores
+}
+
+// compute_listing_similarities stores the most similar listings of every
+// listing in ListingSimilarities. Listings of the same host aren't suggested
+// for each other, the host's profile already shows them.
+func register_recommendation_jobs() {
+	register_job(Job{Name: "compute_listing_similarities", Interval: 6 * time.Hour, Run: compute_listing_similarities})
+}
+
+func compute_listing_similarities() error {
+	listings, err := load_listing_features()
+	if err != nil {
+		return err
+	}
+	coOccurrences := load_co_occurrences()
+
+	type similar struct {
+		id    int
+		score float64
+	}
+	computedAt := time.Now()
+
+	for _, listing := range listings {
+		var candidates []similar
+		for _, other := range listings {
+			if other.ID == listing.ID || other.UserID == listing.UserID {
+				continue
+			}
+			pair := listingPair{min(listing.ID, other.ID), max(listing.ID, other.ID)}
+			score := content_similarity(listing, other) + coOccurrences[pair]
+			if score > 0 {
+				candidates = append(candidates, similar{other.ID, score})
+			}
+		}
+		sort.Slice(candidates, func(i, j int) bool {
+			if candidates[i].score != candidates[j].score {
+				return candidates[i].score > candidates[j].score
+			}
+			return candidates[i].id > candidates[j].id
+		})
+		if len(candidates) > SIMILAR_LISTINGS_KEPT {
+			candidates = candidates[:SIMILAR_LISTINGS_KEPT]
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`DELETE FROM ListingSimilarities WHERE post_id = ?`, listing.ID); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if len(candidates) > 0 {
+			placeholders := make([]string, len(candidates))
+			args := make([]interface{}, 0, len(candidates)*4)
+			for i, candidate := range candidates {
+				placeholders[i] = "(?, ?, ?, ?)"
+				args = append(args, listing.ID, candidate.id, candidate.score, computedAt)
+			}
+			_, err := tx.Exec(`INSERT INTO ListingSimilarities (post_id, similar_post_id, score, computed_at) VALUES `+
+				strings.Join(placeholders, ", "), args...)
+			if err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+
+	log.Printf("Computed similar listings for %d listings", len(listings))
+	return nil
+}
+
+// recommendation_columns select a listing card for the recommendation queries
+const recommendation_columns = `p.id, p.user_id, p.title, p.country, COALESCE(p.city, ''), p.price, p.currency, p.type,
+	       COALESCE((SELECT MIN(i.image_url) FROM Images i WHERE i.post_id = p.id), ''),
+	       ` + listing_amenity_ids_sql + `,
+	       p.instant_book, COALESCE(lr.rating_avg, 0), COALESCE(lr.review_count, 0),
+	       p.max_guests, p.bedrooms, p.beds, p.bathrooms`
+
+const recommendation_joins = `LEFT JOIN ListingRatings lr ON lr.post_id = p.id`
+
+func scan_recommended_listings(rows *sql.Rows, currency string) []Listing {
+	defer rows.Close()
+	var listings []Listing
+	seen := map[int]bool{}
+	for rows.Next() {
+		var l Listing
+		var amenityIDs string
+		err := rows.Scan(&l.ID, &l.UserID, &l.Title, &l.Country, &l.City, &l.Price, &l.Currency, &l.Type,
+			&l.ImageURL, &amenityIDs,
+			&l.InstantBook, &l.RatingAvg, &l.ReviewCount, &l.MaxGuests, &l.Bedrooms, &l.Beds, &l.Bathrooms)
+		if err != nil {
+			log.Printf("Error scanning recommended listing: %v", err)
+			continue
+		}
+		if seen[l.ID] {
+			continue
+		}
+		seen[l.ID] = true
+		l.Amenities = amenities_from_ids(amenityIDs)
+		set_listing_display_price(&l, currency)
+		listings = append(listings, l)
+	}
+	return listings
+}
+
+// get_similar_listings returns the listings most like listingID. Until the
+// job has run for a new listing, the best rated listings in its city stand in.
+func get_similar_listings(listingID int, currency string, limit int) []Listing {
+	rows, err := db.Query(`SELECT `+recommendation_columns+`
+		FROM ListingSimilarities s
+		JOIN Posts p ON p.id = s.similar_post_id
+		`+recommendation_joins+`
+		WHERE s.post_id = ?
+		ORDER BY s.score DESC, p.id DESC
+		LIMIT ?`, listingID, limit)
+	if err != nil {
+		log.Printf("Error querying similar listings: %v", err)
+		return nil
+	}
+	if listings := scan_recommended_listings(rows, currency); len(listings) > 0 {
+		return listings
+	}
+
+	rows, err = db.Query(`SELECT `+recommendation_columns+`
+		FROM Posts base
+		JOIN Posts p ON p.country = base.country AND p.city = base.city AND p.id != base.id AND p.user_id != base.user_id
+		`+recommendation_joins+`
+		WHERE base.id = ?
+		ORDER BY COALESCE(lr.rating_avg, 0) DESC, COALESCE(lr.review_count, 0) DESC, p.id DESC
+		LIMIT ?`, listingID, limit)
+	if err != nil {
+		log.Printf("Error querying listings in the same city: %v", err)
+		return nil
+	}
+	return scan_recommended_listings(rows, currency)
+}
+
+// get_recommendations_for_user ranks the listings similar to the ones the
+// user booked or saved, leaving out those and the user's own listings.
+// Without any history, or for visitors, the best rated listings are shown.
+func get_recommendations_for_user(userID int, currency string, limit int) []Listing {
+	if userID > 0 {
+		rows, err := db.Query(`SELECT `+recommendation_columns+`
+			FROM (
+				SELECT s.similar_post_id, SUM(s.score * seeds.weight) AS score
+				FROM (
+					SELECT post_id, ? AS weight FROM Bookings
+					WHERE user_id = ? AND COALESCE(status, 'confirmed') != 'cancelled'
+					UNION ALL
+					SELECT wi.post_id, ? FROM WishlistItems wi
+					JOIN Wishlists w ON w.id = wi.wishlist_id
+					WHERE w.user_id = ?
+				) seeds
+				JOIN ListingSimilarities s ON s.post_id = seeds.post_id
+				GROUP BY s.similar_post_id
+			) ranked
+			JOIN Posts p ON p.id = ranked.similar_post_id
+			`+recommendation_joins+`
+			WHERE p.user_id != ?
+			  AND p.id NOT IN (SELECT post_id FROM Bookings WHERE user_id = ?)
+			  AND p.id NOT IN (SELECT wi.post_id FROM WishlistItems wi JOIN Wishlists w ON w.id = wi.wishlist_id WHERE w.user_id = ?)
+			ORDER BY ranked.score DESC, p.id DESC
+			LIMIT ?`,
+			RECOMMENDATION_SEED_BOOKING, userID, RECOMMENDATION_SEED_WISHLIST, userID,
+			userID, userID, userID, limit)
+		if err != nil {
+			log.Printf("Error querying recommendations: %v", err)
+		} else if listings := scan_recommended_listings(rows, currency); len(listings) > 0 {
+			return listings
+		}
+	}
+
+	rows, err := db.Query(`SELECT `+recommendation_columns+`
+		FROM Posts p
+		`+recommendation_joins+`
+		WHERE p.user_id != ?
+		ORDER BY COALESCE(lr.rating_avg, 0) * LEAST(COALESCE(lr.review_count, 0), 10) DESC, p.created_at DESC, p.id DESC
+		LIMIT ?`, userID, limit)
+	if err != nil {
+		log.Printf("Error querying popular listings: %v", err)
+		return nil
+	}
+	return scan_recommended_listings(rows, currency)
+}
+
+// api_recommendations_handler returns the listings similar to listing_id, or
+// without it the recommendations for the signed in user
+func api_recommendations_handler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		write_json_error(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	currency := get_display_currency(r)
+	limit := RECOMMENDATIONS_SHOWN
+	if requested, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && requested > 0 {
+		limit = min(requested, SIMILAR_LISTINGS_KEPT)
+	}
+
+	var listings []Listing
+	if raw := r.URL.Query().Get("listing_id"); raw != "" {
+		listingID, err := strconv.Atoi(raw)
+		if err != nil {
+			write_json_error(w, http.StatusBadRequest, "invalid listing_id")
+			return
+		}
+		listings = get_similar_listings(listingID, currency, limit)
+	} else {
+		_, userID := is_authenticated(r)
+		listings = get_recommendations_for_user(userID, currency, limit)
+	}
+
+	summaries := []ListingSummary{}
+	for _, listing := range listings {
+		summaries = append(summaries, ListingSummary{
+			ID:             listing.ID,
+			Title:          listing.Title,
+			City:           listing.City,
+			Country:        listing.Country,
+			Type:           listing.Type,
+			ImageURL:       listing.ImageURL,
+			Price:          listing.DisplayPrice,
+			Currency:       listing.DisplayCurrency,
+			CurrencySymbol: listing.DisplaySymbol,
+			Rating:         listing.RatingAvg,
+			ReviewCount:    listing.ReviewCount,
+			InstantBook:    listing.InstantBook,
+			Amenities:      listing.Amenities,
+			MaxGuests:      listing.MaxGuests,
+			Bedrooms:       listing.Bedrooms,
+			Beds:           listing.Beds,
+			Bathrooms:      listing.Bathrooms,
+			URL:            fmt.Sprintf("/property/%d", listing.ID),
+		})
+	}
+	write_json(w, http.StatusOK, map[string]interface{}{"listings": summaries})
+}
+
+func update_tables_for_recommendations() {
+	createSimilarities := `CREATE TABLE IF NOT EXISTS ListingSimilarities (
+		post_id INT NOT NULL,
+		similar_post_id INT NOT NULL,
+		score DOUBLE NOT NULL,
+		computed_at DATETIME NOT NULL,
+		PRIMARY KEY (post_id, similar_post_id),
+		INDEX idx_listing_similarities_score (post_id, score),
+		FOREIGN KEY (post_id) REFERENCES Posts(id) ON DELETE CASCADE,
+		FOREIGN KEY (similar_post_id) REFERENCES Posts(id) ON DELETE CASCADE
+	)`
+	if _, err := db.Exec(createSimilarities); err != nil {
+		log.Printf("Error creating ListingSimilarities table: %v", err)
+	}
+}
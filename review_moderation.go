@@ -0,0 +1,386 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// ReviewReportReason is one of the fixed reasons a review can be reported for
+type ReviewReportReason struct {
+	Value string
+	Label string
+}
+
+var review_report_reasons = []ReviewReportReason{
+	{"offensive", "Offensive or hateful"},
+	{"spam", "Spam or advertising"},
+	{"fake", "Fake or not about a real stay"},
+	{"private_info", "Shares private information"},
+	{"off_topic", "Not about the listing"},
+	{"other", "Something else"},
+}
+
+func review_report_reason_label(value string) string {
+	for _, reason := range review_report_reasons {
+		if reason.Value == value {
+			return reason.Label
+		}
+	}
+	return ""
+}
+
+// ReviewReport is a review flagged for moderators, with enough of the review
+// to judge it from the queue
+type ReviewReport struct {
+	ID            int
+	ReviewID      int
+	ReporterName  string
+	Reason        string
+	ReasonLabel   string
+	Details       string
+	CreatedAt     string
+	ReviewAuthor  string
+	ReviewRating  int
+	ReviewComment string
+	PropertyID    int
+	PropertyTitle string
+}
+
+// reply_to_review stores the host's public reply. Each review gets one reply,
+// which can't be changed afterwards.
+func reply_to_review(hostID, reviewID int, reply string) error {
+	reply = strings.TrimSpace(reply)
+	if reply == "" {
+		return fmt.Errorf("the reply can't be empty")
+	}
+	if utf8.RuneCountInString(reply) > 1000 {
+		return fmt.Errorf("the reply can be at most 1000 characters")
+	}
+
+	result, err := db.Exec(`UPDATE Reviews r JOIN Posts p ON r.post_id = p.id
+		SET r.host_reply = ?, r.host_replied_at = NOW()
+		WHERE r.id = ? AND p.user_id = ? AND r.host_reply IS NULL
+		AND r.published_at IS NOT NULL AND r.hidden_at IS NULL`, reply, reviewID, hostID)
+	if err != nil {
+		log.Printf("Error saving review reply: %v", err)
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return fmt.Errorf("review not found or already replied to")
+	}
+
+	var authorID, postID int
+	var title string
+	err = db.QueryRow(`SELECT r.user_id, r.post_id, p.title FROM Reviews r JOIN Posts p ON r.post_id = p.id WHERE r.id = ?`,
+		reviewID).Scan(&authorID, &postID, &title)
+	if err == nil {
+		notify(authorID, NOTIFICATION_REVIEW_REPLY, "The host replied to your review",
+			fmt.Sprintf("Your host replied to your review of %s", title), fmt.Sprintf("/property/%d", postID))
+	}
+
+	return nil
+}
+
+func report_review(reviewID, reporterID int, reason, details string) error {
+	if review_report_reason_label(reason) == "" {
+		return fmt.Errorf("please choose a reason")
+	}
+	details = strings.TrimSpace(details)
+	if utf8.RuneCountInString(details) > 500 {
+		details = string([]rune(details)[:500])
+	}
+
+	var authorID int
+	err := db.QueryRow(`SELECT user_id FROM Reviews WHERE id = ? AND published_at IS NOT NULL AND hidden_at IS NULL`,
+		reviewID).Scan(&authorID)
+	if err != nil {
+		return fmt.Errorf("review not found")
+	}
+	if authorID == reporterID {
+		return fmt.Errorf("you can't report your own review")
+	}
+
+	var existing int
+	db.QueryRow(`SELECT COUNT(*) FROM ReviewReports WHERE review_id = ? AND reporter_id = ?`, reviewID, reporterID).Scan(&existing)
+	if existing > 0 {
+		return fmt.Errorf("you already reported this review")
+	}
+
+	_, err = db.Exec(`INSERT INTO ReviewReports (review_id, reporter_id, reason, details) VALUES (?, ?, ?, ?)`,
+		reviewID, reporterID, reason, details)
+	if err != nil {
+		log.Printf("Error reporting review: %v", err)
+	}
+	return err
+}
+
+// get_review_moderation_queue returns open reports, oldest first
+func get_review_moderation_queue() ([]ReviewReport, error) {
+	query := `
+		SELECT rr.id, rr.review_id, u.username, rr.reason, rr.details,
+		       DATE_FORMAT(rr.created_at, '%Y-%m-%d %H:%i'),
+		       a.username, r.rating, r.comment, p.id, p.title
+		FROM ReviewReports rr
+		JOIN Users u ON rr.reporter_id = u.id
+		JOIN Reviews r ON rr.review_id = r.id
+		JOIN Users a ON r.user_id = a.id
+		JOIN Posts p ON r.post_id = p.id
+		WHERE rr.status = 'open'
+		ORDER BY rr.created_at`
+
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var reports []ReviewReport
+	for rows.Next() {
+		var report ReviewReport
+		err := rows.Scan(&report.ID, &report.ReviewID, &report.ReporterName, &report.Reason, &report.Details,
+			&report.CreatedAt, &report.ReviewAuthor, &report.ReviewRating, &report.ReviewComment,
+			&report.PropertyID, &report.PropertyTitle)
+		if err != nil {
+			log.Printf("Error scanning review report: %v", err)
+			continue
+		}
+		report.ReasonLabel = review_report_reason_label(report.Reason)
+		reports = append(reports, report)
+	}
+
+	return reports, nil
+}
+
+// moderate_review settles every open report of a review. Hiding takes the
+// review off the listing, dismissing keeps it. Either way the moderator's
+// justification is recorded on the reports.
+func moderate_review(reviewID, moderatorID int, action, justification string) error {
+	justification = strings.TrimSpace(justification)
+	if justification == "" {
+		return fmt.Errorf("a justification is required")
+	}
+	if utf8.RuneCountInString(justification) > 500 {
+		justification = string([]rune(justification)[:500])
+	}
+
+	var status string
+	switch action {
+	case "hide":
+		status = "hidden"
+	case "dismiss":
+		status = "dismissed"
+	default:
+		return fmt.Errorf("unknown moderation action")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`UPDATE ReviewReports SET status = ?, resolved_by = ?, resolved_at = NOW(), resolution = ?
+		WHERE review_id = ? AND status = 'open'`, status, moderatorID, justification, reviewID)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return fmt.Errorf("no open reports for this review")
+	}
+
+	if action == "hide" {
+		_, err = tx.Exec(`UPDATE Reviews SET hidden_at = NOW(), hidden_by = ?, hidden_reason = ? WHERE id = ?`,
+			moderatorID, justification, reviewID)
+		if err != nil {
+			return err
+		}
+
+		var postID int
+		if err := tx.QueryRow(`SELECT post_id FROM Reviews WHERE id = ?`, reviewID).Scan(&postID); err != nil {
+			return err
+		}
+		if err := refresh_listing_rating(tx, postID); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	log.Printf("Review %d %s by moderator %d", reviewID, status, moderatorID)
+
+	if action == "hide" {
+		var authorID, postID int
+		var title string
+		err = db.QueryRow(`SELECT r.user_id, r.post_id, p.title FROM Reviews r JOIN Posts p ON r.post_id = p.id WHERE r.id = ?`,
+			reviewID).Scan(&authorID, &postID, &title)
+		// The justification stays on the reports, it can be longer than a
+		// notification body
+		if err == nil {
+			notify(authorID, NOTIFICATION_REVIEW_HIDDEN, "Your review was removed",
+				fmt.Sprintf("Your review of %s was removed by a moderator", title),
+				fmt.Sprintf("/property/%d", postID))
+		}
+	}
+
+	return nil
+}
+
+func reply_review_handler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	authenticated, userID := is_authenticated(r)
+	if !authenticated {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	reviewID, err := strconv.Atoi(r.FormValue("review_id"))
+	if err != nil {
+		http.Error(w, "Invalid review ID", http.StatusBadRequest)
+		return
+	}
+
+	err = reply_to_review(userID, reviewID, r.FormValue("reply"))
+	if err != nil {
+		http.Error(w, "Error replying to review: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	propertyID, _ := strconv.Atoi(r.FormValue("property_id"))
+	http.Redirect(w, r, fmt.Sprintf("/property/%d", propertyID), http.StatusSeeOther)
+}
+
+func report_review_handler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	authenticated, userID := is_authenticated(r)
+	if !authenticated {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	reviewID, err := strconv.Atoi(r.FormValue("review_id"))
+	if err != nil {
+		http.Error(w, "Invalid review ID", http.StatusBadRequest)
+		return
+	}
+
+	err = report_review(reviewID, userID, r.FormValue("reason"), r.FormValue("details"))
+	if err != nil {
+		http.Error(w, "Error reporting review: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	propertyID, _ := strconv.Atoi(r.FormValue("property_id"))
+	http.Redirect(w, r, fmt.Sprintf("/property/%d", propertyID), http.StatusSeeOther)
+}
+
+// admin_reviews_handler shows the moderation queue on GET and applies a
+// moderator's decision on POST
+func admin_reviews_handler(w http.ResponseWriter, r *http.Request) {
+	authenticated, userID := is_authenticated(r)
+	if !authenticated {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	if !is_admin_user(userID) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		reports, err := get_review_moderation_queue()
+		if err != nil {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			log.Println("Error fetching review reports:", err)
+			return
+		}
+
+		templateData := struct {
+			Auth    AuthContext
+			Reports []ReviewReport
+		}{
+			Auth:    get_auth(r),
+			Reports: reports,
+		}
+
+		tmpl := template.Must(template.ParseFiles("template/admin_reviews.html"))
+		err = tmpl.Execute(w, templateData)
+		if err != nil {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			log.Println("Error executing template:", err)
+		}
+
+	case http.MethodPost:
+		reviewID, err := strconv.Atoi(r.FormValue("review_id"))
+		if err != nil {
+			http.Error(w, "Invalid review ID", http.StatusBadRequest)
+			return
+		}
+
+		err = moderate_review(reviewID, userID, r.FormValue("action"), r.FormValue("justification"))
+		if err != nil {
+			http.Error(w, "Error moderating review: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		http.Redirect(w, r, "/admin/reviews", http.StatusSeeOther)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func update_tables_for_review_moderation() {
+	alterQueries := []string{
+		`ALTER TABLE Reviews ADD COLUMN host_reply TEXT NULL`,
+		`ALTER TABLE Reviews ADD COLUMN host_replied_at DATETIME NULL`,
+		`ALTER TABLE Reviews ADD COLUMN hidden_at DATETIME NULL`,
+		`ALTER TABLE Reviews ADD COLUMN hidden_by INT NULL`,
+		`ALTER TABLE Reviews ADD COLUMN hidden_reason VARCHAR(500) NULL`,
+	}
+
+	for _, query := range alterQueries {
+		_, err := db.Exec(query)
+		if err != nil {
+			log.Printf("Note: column might already exist: %v", err)
+		}
+	}
+
+	createQuery := `CREATE TABLE IF NOT EXISTS ReviewReports (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		review_id INT NOT NULL,
+		reporter_id INT NOT NULL,
+		reason VARCHAR(20) NOT NULL,
+		details VARCHAR(500) NOT NULL DEFAULT '',
+		status ENUM('open', 'hidden', 'dismissed') NOT NULL DEFAULT 'open',
+		resolved_by INT NULL,
+		resolved_at DATETIME NULL,
+		resolution VARCHAR(500) NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE KEY uq_review_reporter (review_id, reporter_id),
+		INDEX idx_status (status),
+		FOREIGN KEY (review_id) REFERENCES Reviews(id) ON DELETE CASCADE ON UPDATE CASCADE,
+		FOREIGN KEY (reporter_id) REFERENCES Users(id) ON DELETE CASCADE ON UPDATE CASCADE
+	)`
+
+	_, err := db.Exec(createQuery)
+	if err != nil {
+		log.Printf("Error creating review reports table: %v", err)
+	}
+
+	log.Println("Tables updated for review moderation")
+}
@@ -0,0 +1,460 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Guests can review a stay for this many days after checkout
+const DEFAULT_REVIEW_WINDOW_DAYS = 14
+
+// Guests who haven't reviewed yet are reminded this many days before the window closes
+const REVIEW_REMINDER_DAYS = 3
+
+// get_review_window_days reads REVIEW_WINDOW_DAYS, falling back to the default
+func get_review_window_days() int {
+	if days, err := strconv.Atoi(os.Getenv("REVIEW_WINDOW_DAYS")); err == nil && days > 0 {
+		return days
+	}
+	return DEFAULT_REVIEW_WINDOW_DAYS
+}
+
+// GuestReview is a host's review of the guest of one of their bookings
+type GuestReview struct {
+	ID        int
+	BookingID int
+	HostID    int
+	GuestID   int
+	HostName  string
+	Rating    int
+	Comment   string
+	CreatedAt string
+}
+
+// GuestReviewSummary is what hosts have said about a guest, shown on their profile
+type GuestReviewSummary struct {
+	Count   int
+	Average float64
+	Reviews []GuestReview
+}
+
+// review_window_open_sql is true while the guest of booking b may review it:
+// from the day after checkout until the window closes, or until an admin
+// override. It takes the window length in days as its argument.
+const review_window_open_sql = `(COALESCE(b.status, 'confirmed') != 'cancelled' AND (
+		(b.end_date < CURDATE() AND CURDATE() <= b.end_date + INTERVAL ? DAY)
+		OR CURDATE() <= b.review_override_until))`
+
+// review_closes_sql is the last day booking b can be reviewed. It takes the
+// window length in days as its argument.
+const review_closes_sql = `DATE_FORMAT(GREATEST(b.end_date + INTERVAL ? DAY, COALESCE(b.review_override_until, b.end_date)), '%Y-%m-%d')`
+
+// can_user_review_booking checks the booking belongs to the user and
+// property, is inside its review window and hasn't been reviewed yet
+func can_user_review_booking(userID, propertyID, bookingID int) (bool, error) {
+	query := `
+		SELECT COUNT(*) FROM Bookings b
+		WHERE b.id = ? AND b.user_id = ? AND b.post_id = ? AND ` + review_window_open_sql + `
+		AND NOT EXISTS (SELECT 1 FROM Reviews r WHERE r.booking_id = b.id)`
+
+	var count int
+	err := db.QueryRow(query, bookingID, userID, propertyID, get_review_window_days()).Scan(&count)
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// override_review_window lets an admin open the review window of a booking
+// for another full window, for example after a dispute delayed the review
+func override_review_window(bookingID int) error {
+	result, err := db.Exec(`UPDATE Bookings SET review_override_until = CURDATE() + INTERVAL ? DAY
+		WHERE id = ? AND COALESCE(status, 'confirmed') != 'cancelled'`, get_review_window_days(), bookingID)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return fmt.Errorf("booking not found or cancelled")
+	}
+
+	// Invite the guest if they haven't been already
+	_, err = open_review_for_booking(bookingID)
+	return err
+}
+
+// send_review_reminders emails guests whose review window is about to close
+func send_review_reminders() error {
+	days := get_review_window_days()
+	query := `
+		SELECT b.id, b.user_id, b.post_id, p.title FROM Bookings b
+		JOIN Posts p ON b.post_id = p.id
+		WHERE ` + review_window_open_sql + `
+		AND b.review_reminder_sent_at IS NULL
+		AND CURDATE() >= STR_TO_DATE(` + review_closes_sql + `, '%Y-%m-%d') - INTERVAL ? DAY
+		AND NOT EXISTS (SELECT 1 FROM Reviews r WHERE r.booking_id = b.id)`
+
+	rows, err := db.Query(query, days, days, REVIEW_REMINDER_DAYS)
+	if err != nil {
+		return err
+	}
+
+	type reminder struct {
+		bookingID, guestID, postID int
+		title                      string
+	}
+	var reminders []reminder
+	for rows.Next() {
+		var r reminder
+		if err := rows.Scan(&r.bookingID, &r.guestID, &r.postID, &r.title); err == nil {
+			reminders = append(reminders, r)
+		}
+	}
+	rows.Close()
+
+	for _, r := range reminders {
+		sent, err := send_review_reminder(r.bookingID, r.guestID, r.postID)
+		if err != nil {
+			return err
+		}
+		if sent {
+			notify(r.guestID, NOTIFICATION_REVIEW_ENABLED, "Last days to review your stay",
+				fmt.Sprintf("Your review window for %s closes soon", r.title), fmt.Sprintf("/property/%d", r.postID))
+		}
+	}
+	return nil
+}
+
+func send_review_reminder(bookingID, guestID, postID int) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`UPDATE Bookings SET review_reminder_sent_at = NOW() WHERE id = ? AND review_reminder_sent_at IS NULL`, bookingID)
+	if err != nil {
+		return false, err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return false, nil
+	}
+
+	emailData, err := booking_email_data(tx, bookingID)
+	if err != nil {
+		return false, err
+	}
+
+	var closesAt string
+	err = tx.QueryRow(`SELECT `+review_closes_sql+` FROM Bookings b WHERE b.id = ?`, get_review_window_days(), bookingID).Scan(&closesAt)
+	if err != nil {
+		return false, err
+	}
+	emailData["ReviewClosesAt"] = closesAt
+	emailData["ReviewLink"] = fmt.Sprintf("%s/property/%d", get_base_url(), postID)
+
+	if err := enqueue_email(tx, guestID, EMAIL_REVIEW_REMINDER, emailData); err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
+
+// can_host_review_booking checks the host owns the booking, it is inside its
+// review window and the guest hasn't been reviewed yet
+func can_host_review_booking(hostID, bookingID int) (bool, error) {
+	query := `
+		SELECT COUNT(*) FROM Bookings b
+		WHERE b.id = ? AND b.host_id = ? AND ` + review_window_open_sql + `
+		AND NOT EXISTS (SELECT 1 FROM GuestReviews gr WHERE gr.booking_id = b.id)`
+
+	var count int
+	err := db.QueryRow(query, bookingID, hostID, get_review_window_days()).Scan(&count)
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+func create_guest_review(hostID, bookingID, rating int, comment string) error {
+	canReview, err := can_host_review_booking(hostID, bookingID)
+	if err != nil {
+		return err
+	}
+	if !canReview {
+		return fmt.Errorf("this guest can't be reviewed, the review window opens after checkout and closes %d days later", get_review_window_days())
+	}
+
+	var guestID int
+	err = db.QueryRow(`SELECT user_id FROM Bookings WHERE id = ?`, bookingID).Scan(&guestID)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`INSERT INTO GuestReviews (booking_id, host_id, guest_id, rating, comment) VALUES (?, ?, ?, ?, ?)`,
+		bookingID, hostID, guestID, rating, comment)
+	if err != nil {
+		log.Printf("Error creating guest review: %v", err)
+		return err
+	}
+
+	published, err := publish_reviews_if_complete(tx, bookingID)
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	log.Printf("Guest review created for booking %d by host %d", bookingID, hostID)
+
+	if published {
+		notify_reviews_published(bookingID)
+	} else {
+		notify(guestID, NOTIFICATION_REVIEW_RECEIVED, "Your host left a review",
+			fmt.Sprintf("Review your stay from booking #%d to see it, or it's published when the review window closes", bookingID),
+			fmt.Sprintf("/bookings/%d", bookingID))
+	}
+
+	return nil
+}
+
+// publish_reviews_if_complete publishes both reviews of a booking once the
+// guest and the host have each written theirs. It reports whether anything
+// was published.
+func publish_reviews_if_complete(q interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}, bookingID int) (bool, error) {
+	var complete bool
+	err := q.QueryRow(`SELECT EXISTS (SELECT 1 FROM Reviews WHERE booking_id = ?)
+		AND EXISTS (SELECT 1 FROM GuestReviews WHERE booking_id = ?)`, bookingID, bookingID).Scan(&complete)
+	if err != nil || !complete {
+		return false, err
+	}
+
+	return publish_booking_reviews(q, bookingID)
+}
+
+// publish_booking_reviews makes whatever reviews a booking has visible
+func publish_booking_reviews(q interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}, bookingID int) (bool, error) {
+	var published int64
+	for _, query := range []string{
+		`UPDATE Reviews SET published_at = NOW() WHERE booking_id = ? AND published_at IS NULL`,
+		`UPDATE GuestReviews SET published_at = NOW() WHERE booking_id = ? AND published_at IS NULL`,
+	} {
+		result, err := q.Exec(query, bookingID)
+		if err != nil {
+			return false, err
+		}
+		n, _ := result.RowsAffected()
+		published += n
+	}
+	if published == 0 {
+		return false, nil
+	}
+
+	var postID int
+	if err := q.QueryRow(`SELECT post_id FROM Bookings WHERE id = ?`, bookingID).Scan(&postID); err != nil {
+		return false, err
+	}
+	if err := refresh_listing_rating(q, postID); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func notify_reviews_published(bookingID int) {
+	var guestID, hostID, postID int
+	var title string
+	err := db.QueryRow(`SELECT b.user_id, b.host_id, b.post_id, p.title FROM Bookings b
+		JOIN Posts p ON b.post_id = p.id WHERE b.id = ?`, bookingID).Scan(&guestID, &hostID, &postID, &title)
+	if err != nil {
+		log.Printf("Error loading booking %d for review notifications: %v", bookingID, err)
+		return
+	}
+
+	notify(guestID, NOTIFICATION_REVIEWS_PUBLISHED, "Reviews published",
+		fmt.Sprintf("The reviews for your stay at %s are now visible", title), fmt.Sprintf("/users/%d", guestID))
+	notify(hostID, NOTIFICATION_REVIEWS_PUBLISHED, "Reviews published",
+		fmt.Sprintf("The reviews for booking #%d at %s are now visible", bookingID, title), fmt.Sprintf("/property/%d", postID))
+}
+
+// publish_blind_reviews publishes reviews whose counterpart has arrived, or
+// whose review window closed without one
+func publish_blind_reviews() error {
+	query := `
+		SELECT b.id FROM Bookings b
+		WHERE (EXISTS (SELECT 1 FROM Reviews r WHERE r.booking_id = b.id AND r.published_at IS NULL)
+		       OR EXISTS (SELECT 1 FROM GuestReviews gr WHERE gr.booking_id = b.id AND gr.published_at IS NULL))
+		AND (NOT ` + review_window_open_sql + `
+		     OR (EXISTS (SELECT 1 FROM Reviews r WHERE r.booking_id = b.id)
+		         AND EXISTS (SELECT 1 FROM GuestReviews gr WHERE gr.booking_id = b.id)))`
+
+	rows, err := db.Query(query, get_review_window_days())
+	if err != nil {
+		return err
+	}
+
+	var bookingIDs []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err == nil {
+			bookingIDs = append(bookingIDs, id)
+		}
+	}
+	rows.Close()
+
+	for _, bookingID := range bookingIDs {
+		published, err := publish_booking_reviews(db, bookingID)
+		if err != nil {
+			return err
+		}
+		if published {
+			notify_reviews_published(bookingID)
+		}
+	}
+	return nil
+}
+
+// get_guest_review_summary returns the published reviews hosts left for a guest
+func get_guest_review_summary(guestID int) GuestReviewSummary {
+	var summary GuestReviewSummary
+
+	query := `
+		SELECT gr.id, gr.booking_id, gr.host_id, gr.guest_id, u.username, gr.rating, gr.comment,
+		       DATE_FORMAT(gr.created_at, '%Y-%m-%d')
+		FROM GuestReviews gr
+		JOIN Users u ON gr.host_id = u.id
+		WHERE gr.guest_id = ? AND gr.published_at IS NOT NULL
+		ORDER BY gr.created_at DESC`
+
+	rows, err := db.Query(query, guestID)
+	if err != nil {
+		log.Printf("Error fetching guest reviews: %v", err)
+		return summary
+	}
+	defer rows.Close()
+
+	total := 0
+	for rows.Next() {
+		var review GuestReview
+		err := rows.Scan(&review.ID, &review.BookingID, &review.HostID, &review.GuestID, &review.HostName,
+			&review.Rating, &review.Comment, &review.CreatedAt)
+		if err != nil {
+			log.Printf("Error scanning guest review: %v", err)
+			continue
+		}
+		total += review.Rating
+		summary.Reviews = append(summary.Reviews, review)
+	}
+
+	summary.Count = len(summary.Reviews)
+	if summary.Count > 0 {
+		summary.Average = float64(total) / float64(summary.Count)
+	}
+	return summary
+}
+
+func submit_guest_review_handler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	authenticated, userID := is_authenticated(r)
+	if !authenticated {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	bookingID, err := strconv.Atoi(r.FormValue("booking_id"))
+	if err != nil {
+		http.Error(w, "Invalid booking ID", http.StatusBadRequest)
+		return
+	}
+
+	rating, err := strconv.Atoi(r.FormValue("rating"))
+	if err != nil || rating < 1 || rating > 5 {
+		http.Error(w, "Rating must be between 1 and 5", http.StatusBadRequest)
+		return
+	}
+
+	comment := strings.TrimSpace(r.FormValue("comment"))
+	if len(comment) < 10 {
+		http.Error(w, "Review comment must be at least 10 characters long", http.StatusBadRequest)
+		return
+	}
+
+	err = create_guest_review(userID, bookingID, rating, comment)
+	if err != nil {
+		http.Error(w, "Error submitting review: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Review submitted successfully"))
+}
+
+func update_tables_for_review_window() {
+	alterQueries := []string{
+		`ALTER TABLE Bookings ADD COLUMN review_override_until DATE NULL`,
+		`ALTER TABLE Bookings ADD COLUMN review_reminder_sent_at DATETIME NULL`,
+	}
+
+	for _, query := range alterQueries {
+		_, err := db.Exec(query)
+		if err != nil {
+			log.Printf("Note: column might already exist: %v", err)
+		}
+	}
+
+	log.Println("Tables updated for review window")
+}
+
+// update_tables_for_guest_reviews adds host-to-guest reviews and the
+// published_at marker used to keep both sides hidden until they are complete
+func update_tables_for_guest_reviews() {
+	createQuery := `CREATE TABLE IF NOT EXISTS GuestReviews (
+		id INT AUTO_INCREMENT PRIMARY KEY,
+		booking_id INT NOT NULL UNIQUE,
+		host_id INT NOT NULL,
+		guest_id INT NOT NULL,
+		rating INT NOT NULL,
+		comment TEXT NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		published_at DATETIME NULL,
+		INDEX idx_guest_published (guest_id, published_at),
+		FOREIGN KEY (booking_id) REFERENCES Bookings(id) ON DELETE CASCADE,
+		FOREIGN KEY (host_id) REFERENCES Users(id) ON DELETE CASCADE,
+		FOREIGN KEY (guest_id) REFERENCES Users(id) ON DELETE CASCADE
+	)`
+
+	_, err := db.Exec(createQuery)
+	if err != nil {
+		log.Printf("Error creating guest reviews table: %v", err)
+	}
+
+	// Existing reviews get the current time so they stay visible, new
+	// booking reviews are inserted unpublished
+	_, err = db.Exec(`ALTER TABLE Reviews ADD COLUMN published_at DATETIME NULL DEFAULT CURRENT_TIMESTAMP`)
+	if err != nil {
+		log.Printf("Note: column might already exist: %v", err)
+	}
+
+	log.Println("Tables updated for guest reviews")
+}
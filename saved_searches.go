@@ -0,0 +1,579 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const MAX_SAVED_SEARCHES = 20
+
+// Listings created this many days ago at most are still new to a saved
+// search. The window lets listings match once they are geocoded.
+const SAVED_SEARCH_MATCH_DAYS = 7
+
+// Notified matches are kept past the match window so they aren't sent twice
+const SAVED_SEARCH_MATCH_PURGE_DAYS = 30
+
+// Listings shown in one alert, the rest are only counted
+const SAVED_SEARCH_ALERT_LISTINGS = 10
+
+const NOTIFICATION_SAVED_SEARCH = "saved_search"
+
+const EMAIL_SAVED_SEARCH_ALERT = "saved_search_alert"
+
+type SavedSearchFrequency struct {
+	Value string
+	Label string
+}
+
+var saved_search_frequencies = []SavedSearchFrequency{
+	{"instant", "As soon as they're listed"},
+	{"daily", "Daily digest"},
+	{"weekly", "Weekly digest"},
+	{"never", "Off"},
+}
+
+func is_saved_search_frequency(value string) bool {
+	for _, frequency := range saved_search_frequencies {
+		if frequency.Value == value {
+			return true
+		}
+	}
+	return false
+}
+
+// SavedSearch is a search a user wants to be told about. Query is the
+// listings page query string, as built by buildPaginationQuery.
+type SavedSearch struct {
+	ID             int
+	UserID         int
+	Name           string
+	Query          string
+	Currency       string
+	Frequency      string
+	NotifyEmail    bool
+	NotifyInApp    bool
+	Token          string
+	CreatedAt      string
+	LastNotifiedAt string
+	NewListings    int
+}
+
+// URL runs the search again
+func (s SavedSearch) URL() string {
+	return "/listings?" + s.Query
+}
+
+func (s SavedSearch) params() SearchParams {
+	values, _ := url.ParseQuery(s.Query)
+	params := parse_search_params(values)
+	params.Currency = s.Currency
+	return params
+}
+
+// Summary describes the filters of the search
+func (s SavedSearch) Summary() string {
+	return describe_search(s.params())
+}
+
+// describe_search names a search after its filters, e.g.
+// "Paris · Pool · under 300 EUR"
+func describe_search(params SearchParams) string {
+	var parts []string
+	if params.Destination != "" {
+		parts = append(parts, params.Destination)
+	}
+	if params.Near != "" {
+		parts = append(parts, "near "+params.Near)
+	}
+	if params.Country != "" {
+		parts = append(parts, params.Country)
+	}
+	for _, propertyType := range params.PropertyTypes {
+		parts = append(parts, strings.ToUpper(propertyType[:1])+propertyType[1:])
+	}
+	for _, key := range params.Amenities {
+		if amenity, ok := find_amenity(key); ok {
+			parts = append(parts, amenity.Label)
+		}
+	}
+	switch {
+	case params.MinPrice > 0 && params.MaxPrice > 0:
+		parts = append(parts, fmt.Sprintf("%g-%g %s", params.MinPrice, params.MaxPrice, params.Currency))
+	case params.MaxPrice > 0:
+		parts = append(parts, fmt.Sprintf("under %g %s", params.MaxPrice, params.Currency))
+	case params.MinPrice > 0:
+		parts = append(parts, fmt.Sprintf("from %g %s", params.MinPrice, params.Currency))
+	}
+	if params.MinRating > 0 {
+		parts = append(parts, fmt.Sprintf("%g★+", params.MinRating))
+	}
+	if params.Guests > 0 {
+		parts = append(parts, plural(params.Guests, "guest", "guests"))
+	}
+	if params.MinBedrooms > 0 {
+		parts = append(parts, fmt.Sprintf("%d+ bedrooms", params.MinBedrooms))
+	}
+	if params.MinBeds > 0 {
+		parts = append(parts, fmt.Sprintf("%d+ beds", params.MinBeds))
+	}
+	if params.MinBathrooms > 0 {
+		parts = append(parts, fmt.Sprintf("%g+ bathrooms", params.MinBathrooms))
+	}
+	if params.InstantBook {
+		parts = append(parts, "Instant Book")
+	}
+
+	if len(parts) == 0 {
+		return "All stays"
+	}
+	return strings.Join(parts, " · ")
+}
+
+func new_random_token() string {
+	bytes := make([]byte, 16)
+	rand.Read(bytes)
+	return hex.EncodeToString(bytes)
+}
+
+const saved_search_columns = `s.id, s.user_id, s.name, s.query, s.currency, s.frequency, s.notify_email, s.notify_in_app,
+	s.unsubscribe_token, DATE_FORMAT(s.created_at, '%Y-%m-%d %H:%i:%s'), COALESCE(DATE_FORMAT(s.last_notified_at, '%Y-%m-%d %H:%i'), '')`
+
+func scan_saved_search(row interface{ Scan(...interface{}) error }, s *SavedSearch) error {
+	return row.Scan(&s.ID, &s.UserID, &s.Name, &s.Query, &s.Currency, &s.Frequency, &s.NotifyEmail, &s.NotifyInApp,
+		&s.Token, &s.CreatedAt, &s.LastNotifiedAt)
+}
+
+// get_user_saved_searches returns a user's saved searches with the number of
+// new listings not yet sent to them
+func get_user_saved_searches(userID int) ([]SavedSearch, error) {
+	query := `SELECT ` + saved_search_columns + `,
+		       (SELECT COUNT(*) FROM SavedSearchMatches m WHERE m.saved_search_id = s.id AND m.notified_at IS NULL)
+		FROM SavedSearches s
+		WHERE s.user_id = ?
+		ORDER BY s.created_at DESC`
+	rows, err := db.Query(query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var searches []SavedSearch
+	for rows.Next() {
+		var s SavedSearch
+		err := rows.Scan(&s.ID, &s.UserID, &s.Name, &s.Query, &s.Currency, &s.Frequency, &s.NotifyEmail, &s.NotifyInApp,
+			&s.Token, &s.CreatedAt, &s.LastNotifiedAt, &s.NewListings)
+		if err != nil {
+			log.Printf("Error scanning saved search: %v", err)
+			continue
+		}
+		searches = append(searches, s)
+	}
+	return searches, nil
+}
+
+func create_saved_search(s SavedSearch) error {
+	var count int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM SavedSearches WHERE user_id = ?`, s.UserID).Scan(&count); err != nil {
+		return err
+	}
+	if count >= MAX_SAVED_SEARCHES {
+		return fmt.Errorf("you can save up to %d searches", MAX_SAVED_SEARCHES)
+	}
+
+	_, err := db.Exec(`INSERT INTO SavedSearches (user_id, name, query, currency, frequency, notify_email, notify_in_app, unsubscribe_token)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		s.UserID, s.Name, s.Query, s.Currency, s.Frequency, s.NotifyEmail, s.NotifyInApp, new_random_token())
+	return err
+}
+
+func register_saved_search_jobs() {
+	register_job(Job{Name: "match_saved_searches", Interval: 15 * time.Minute, Run: match_saved_searches})
+}
+
+// match_saved_searches records the recent listings that match each saved
+// search and were created after it, then sends the alerts that are due
+func match_saved_searches() error {
+	rows, err := db.Query(`SELECT ` + saved_search_columns + ` FROM SavedSearches s WHERE s.frequency != 'never'`)
+	if err != nil {
+		return err
+	}
+	var searches []SavedSearch
+	for rows.Next() {
+		var s SavedSearch
+		if err := scan_saved_search(rows, &s); err == nil {
+			searches = append(searches, s)
+		}
+	}
+	rows.Close()
+
+	matched, failed := 0, 0
+	for _, s := range searches {
+		params := s.params()
+		if err := resolve_search_location(&params); err != nil {
+			log.Printf("Error locating saved search %d: %v", s.ID, err)
+			failed++
+			continue
+		}
+		filters := build_search_filters(params)
+
+		query := fmt.Sprintf(`INSERT IGNORE INTO SavedSearchMatches (saved_search_id, post_id)
+			SELECT DISTINCT ?, p.id FROM Posts p %s
+			WHERE %s AND p.created_at > ? AND p.created_at >= NOW() - INTERVAL ? DAY AND p.user_id != ?`,
+			filters.Joins, filters.Where)
+		args := append([]interface{}{s.ID}, filters.Args...)
+		args = append(args, s.CreatedAt, SAVED_SEARCH_MATCH_DAYS, s.UserID)
+
+		result, err := db.Exec(query, args...)
+		if err != nil {
+			log.Printf("Error matching saved search %d: %v", s.ID, err)
+			failed++
+			continue
+		}
+		if n, _ := result.RowsAffected(); n > 0 {
+			matched += int(n)
+		}
+	}
+	if matched > 0 {
+		log.Printf("Matched %d new listings to saved searches", matched)
+	}
+
+	// Searches that failed to match still get the alerts they already have
+	if err := send_saved_search_alerts(); err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d saved searches could not be matched", failed, len(searches))
+	}
+	return nil
+}
+
+// send_saved_search_alerts sends the new matches of every saved search whose
+// digest is due
+func send_saved_search_alerts() error {
+	query := `SELECT ` + saved_search_columns + ` FROM SavedSearches s
+		WHERE EXISTS (SELECT 1 FROM SavedSearchMatches m WHERE m.saved_search_id = s.id AND m.notified_at IS NULL)
+		AND (s.frequency = 'instant'
+			OR (s.frequency = 'daily' AND (s.last_notified_at IS NULL OR s.last_notified_at <= NOW() - INTERVAL 1 DAY))
+			OR (s.frequency = 'weekly' AND (s.last_notified_at IS NULL OR s.last_notified_at <= NOW() - INTERVAL 7 DAY)))`
+	rows, err := db.Query(query)
+	if err != nil {
+		return err
+	}
+	var searches []SavedSearch
+	for rows.Next() {
+		var s SavedSearch
+		if err := scan_saved_search(rows, &s); err == nil {
+			searches = append(searches, s)
+		}
+	}
+	rows.Close()
+
+	var failed int
+	for _, s := range searches {
+		count, err := send_saved_search_alert(s)
+		if err != nil {
+			log.Printf("Error sending alert for saved search %d: %v", s.ID, err)
+			failed++
+			continue
+		}
+		if count > 0 && s.NotifyInApp {
+			body := fmt.Sprintf("%d new stays match your search", count)
+			if count == 1 {
+				body = "A new stay matches your search"
+			}
+			notify(s.UserID, NOTIFICATION_SAVED_SEARCH, s.Name, body, s.URL())
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d saved search alerts could not be sent", failed, len(searches))
+	}
+	return nil
+}
+
+// send_saved_search_alert marks the pending matches of a search notified and
+// queues the email in the same transaction, so each listing is sent once
+func send_saved_search_alert(s SavedSearch) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`SELECT p.id, p.title, COALESCE(p.city, ''), p.country, p.price, p.currency
+		FROM SavedSearchMatches m
+		JOIN Posts p ON p.id = m.post_id
+		WHERE m.saved_search_id = ? AND m.notified_at IS NULL
+		ORDER BY p.created_at DESC
+		FOR UPDATE`, s.ID)
+	if err != nil {
+		return 0, err
+	}
+	var listings []map[string]interface{}
+	for rows.Next() {
+		var id int
+		var title, city, country, currency string
+		var price float64
+		if err := rows.Scan(&id, &title, &city, &country, &price, &currency); err != nil {
+			continue
+		}
+		listings = append(listings, map[string]interface{}{
+			"Title":    title,
+			"Location": strings.Trim(city+", "+country, ", "),
+			"Price":    fmt.Sprintf("%.0f %s", price, currency),
+			"Link":     fmt.Sprintf("%s/property/%d", get_base_url(), id),
+		})
+	}
+	rows.Close()
+
+	if _, err := tx.Exec(`UPDATE SavedSearchMatches SET notified_at = NOW() WHERE saved_search_id = ? AND notified_at IS NULL`, s.ID); err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(`UPDATE SavedSearches SET last_notified_at = NOW() WHERE id = ?`, s.ID); err != nil {
+		return 0, err
+	}
+
+	count := len(listings)
+	if count > 0 && s.NotifyEmail {
+		data := map[string]interface{}{
+			"SearchName":      s.Name,
+			"Count":           count,
+			"Listings":        listings[:min(count, SAVED_SEARCH_ALERT_LISTINGS)],
+			"More":            max(0, count-SAVED_SEARCH_ALERT_LISTINGS),
+			"SearchLink":      get_base_url() + s.URL(),
+			"ManageLink":      get_base_url() + "/saved-searches",
+			"UnsubscribeLink": get_base_url() + "/saved-searches/unsubscribe?token=" + s.Token,
+		}
+		if err := enqueue_email(tx, s.UserID, EMAIL_SAVED_SEARCH_ALERT, data); err != nil {
+			return 0, err
+		}
+	}
+
+	return count, tx.Commit()
+}
+
+func render_saved_searches(w http.ResponseWriter, r *http.Request, unsubscribed *SavedSearch, errorMessage string) {
+	var searches []SavedSearch
+	if authenticated, userID := is_authenticated(r); authenticated {
+		var err error
+		searches, err = get_user_saved_searches(userID)
+		if err != nil {
+			log.Printf("Error fetching saved searches: %v", err)
+		}
+	}
+
+	templateData := struct {
+		Auth          AuthContext
+		SavedSearches []SavedSearch
+		Frequencies   []SavedSearchFrequency
+		Saved         bool
+		Unsubscribed  *SavedSearch
+		Error         string
+	}{
+		Auth:          get_auth(r),
+		SavedSearches: searches,
+		Frequencies:   saved_search_frequencies,
+		Saved:         r.URL.Query().Get("saved") == "1",
+		Unsubscribed:  unsubscribed,
+		Error:         errorMessage,
+	}
+
+	tmpl := template.Must(template.ParseFiles("template/saved_searches.html"))
+	err := tmpl.Execute(w, templateData)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		log.Println("Error executing template:", err)
+	}
+}
+
+// saved_searches_handler lists the user's saved searches and saves a new one
+// from the listings page
+func saved_searches_handler(w http.ResponseWriter, r *http.Request) {
+	authenticated, userID := is_authenticated(r)
+	if !authenticated {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		render_saved_searches(w, r, nil, "")
+
+	case http.MethodPost:
+		values, err := url.ParseQuery(r.FormValue("query"))
+		if err != nil {
+			http.Error(w, "Invalid search", http.StatusBadRequest)
+			return
+		}
+		params := parse_search_params(values)
+		params.Currency = get_display_currency(r)
+
+		frequency := r.FormValue("frequency")
+		if !is_saved_search_frequency(frequency) {
+			frequency = "daily"
+		}
+		name := strings.TrimSpace(r.FormValue("name"))
+		if name == "" {
+			name = describe_search(params)
+		}
+		if utf8.RuneCountInString(name) > 100 {
+			name = string([]rune(name)[:100])
+		}
+
+		search := SavedSearch{
+			UserID:      userID,
+			Name:        name,
+			Query:       buildPaginationQuery(params),
+			Currency:    params.Currency,
+			Frequency:   frequency,
+			NotifyEmail: true,
+			NotifyInApp: true,
+		}
+		if err := create_saved_search(search); err != nil {
+			log.Printf("Error saving search: %v", err)
+			render_saved_searches(w, r, nil, err.Error())
+			return
+		}
+		http.Redirect(w, r, "/saved-searches?saved=1", http.StatusSeeOther)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// update_saved_search_handler changes how often and where the alerts of a
+// saved search are sent
+func update_saved_search_handler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	authenticated, userID := is_authenticated(r)
+	if !authenticated {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	id, err := strconv.Atoi(r.FormValue("id"))
+	frequency := r.FormValue("frequency")
+	if err != nil || !is_saved_search_frequency(frequency) {
+		http.Error(w, "Invalid saved search", http.StatusBadRequest)
+		return
+	}
+	name := strings.TrimSpace(r.FormValue("name"))
+	if name == "" || utf8.RuneCountInString(name) > 100 {
+		http.Error(w, "Name must be 1 to 100 characters", http.StatusBadRequest)
+		return
+	}
+
+	_, err = db.Exec(`UPDATE SavedSearches SET name = ?, frequency = ?, notify_email = ?, notify_in_app = ?
+		WHERE id = ? AND user_id = ?`,
+		name, frequency, r.FormValue("notify_email") == "on", r.FormValue("notify_in_app") == "on", id, userID)
+	if err != nil {
+		http.Error(w, "Error saving search", http.StatusInternalServerError)
+		log.Println("Error updating saved search:", err)
+		return
+	}
+	http.Redirect(w, r, "/saved-searches?saved=1", http.StatusSeeOther)
+}
+
+func delete_saved_search_handler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	authenticated, userID := is_authenticated(r)
+	if !authenticated {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	id, err := strconv.Atoi(r.FormValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid saved search", http.StatusBadRequest)
+		return
+	}
+	if _, err := db.Exec(`DELETE FROM SavedSearches WHERE id = ? AND user_id = ?`, id, userID); err != nil {
+		http.Error(w, "Error deleting search", http.StatusInternalServerError)
+		log.Println("Error deleting saved search:", err)
+		return
+	}
+	http.Redirect(w, r, "/saved-searches", http.StatusSeeOther)
+}
+
+// unsubscribe_saved_search_handler turns off the alerts of the saved search
+// an email was sent for. The token stands in for logging in.
+func unsubscribe_saved_search_handler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	token := r.URL.Query().Get("token")
+	var s SavedSearch
+	err := scan_saved_search(db.QueryRow(`SELECT `+saved_search_columns+` FROM SavedSearches s WHERE s.unsubscribe_token = ?`, token), &s)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, "This unsubscribe link is no longer valid", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		log.Println("Error fetching saved search:", err)
+		return
+	}
+
+	if _, err := db.Exec(`UPDATE SavedSearches SET frequency = 'never' WHERE id = ?`, s.ID); err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		log.Println("Error unsubscribing saved search:", err)
+		return
+	}
+	render_saved_searches(w, r, &s, "")
+}
+
+func update_tables_for_saved_searches() {
+	createQueries := []string{
+		`CREATE TABLE IF NOT EXISTS SavedSearches (
+			id INT AUTO_INCREMENT PRIMARY KEY,
+			user_id INT NOT NULL,
+			name VARCHAR(100) NOT NULL,
+			query TEXT NOT NULL,
+			currency VARCHAR(3) NOT NULL DEFAULT 'USD',
+			frequency ENUM('instant', 'daily', 'weekly', 'never') NOT NULL DEFAULT 'daily',
+			notify_email BOOLEAN NOT NULL DEFAULT TRUE,
+			notify_in_app BOOLEAN NOT NULL DEFAULT TRUE,
+			unsubscribe_token CHAR(32) NOT NULL UNIQUE,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			last_notified_at DATETIME NULL,
+			FOREIGN KEY (user_id) REFERENCES Users(id) ON DELETE CASCADE ON UPDATE CASCADE
+		)`,
+		`CREATE TABLE IF NOT EXISTS SavedSearchMatches (
+			saved_search_id INT NOT NULL,
+			post_id INT NOT NULL,
+			matched_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			notified_at DATETIME NULL,
+			PRIMARY KEY (saved_search_id, post_id),
+			FOREIGN KEY (saved_search_id) REFERENCES SavedSearches(id) ON DELETE CASCADE,
+			FOREIGN KEY (post_id) REFERENCES Posts(id) ON DELETE CASCADE
+		)`,
+		`ALTER TABLE EmailPreferences ADD COLUMN saved_search_alerts BOOLEAN NOT NULL DEFAULT TRUE`,
+	}
+
+	for _, query := range createQueries {
+		_, err := db.Exec(query)
+		if err != nil {
+			log.Printf("Note: saved search tables might already exist: %v", err)
+		}
+	}
+
+	log.Println("Tables updated for saved searches")
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+// How often the scheduler checks for due jobs
+const SCHEDULER_TICK = 30 * time.Second
+
+// How long a claimed job is locked to one instance. Jobs must finish well
+// within it, after that another instance may take over.
+const JOB_LOCK_TIMEOUT = 15 * time.Minute
+
+const JOB_MAX_BACKOFF = time.Hour
+const JOB_RUNS_SHOWN = 50
+
+// Job is a task run periodically by the scheduler
+type Job struct {
+	Name     string
+	Interval time.Duration
+	Run      func() error
+}
+
+type JobState struct {
+	Name        string
+	IntervalSec int
+	NextRunAt   string
+	LastRunAt   string
+	LastStatus  string
+	Failures    int
+	LockedBy    string
+}
+
+type JobRun struct {
+	ID         int
+	JobName    string
+	InstanceID string
+	StartedAt  string
+	FinishedAt string
+	Status     string
+	Error      string
+}
+
+var scheduled_jobs []Job
+
+// scheduler_instance_id identifies this process in job locks and run history
+var scheduler_instance_id = func() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return fmt.Sprintf("%s-%d", host, os.Getpid())
+}()
+
+func register_job(job Job) {
+	scheduled_jobs = append(scheduled_jobs, job)
+
+	_, err := db.Exec(`INSERT INTO ScheduledJobs (name, interval_seconds) VALUES (?, ?)
+		ON DUPLICATE KEY UPDATE interval_seconds = VALUES(interval_seconds)`, job.Name, int(job.Interval.Seconds()))
+	if err != nil {
+		log.Printf("Error registering job %s: %v", job.Name, err)
+	}
+}
+
+// claim_job takes the job's lock if it is due and no other instance holds it.
+// The conditional update makes the database the arbiter between instances.
+func claim_job(job Job) bool {
+	result, err := db.Exec(`UPDATE ScheduledJobs SET locked_by = ?, locked_until = NOW() + INTERVAL ? SECOND
+		WHERE name = ? AND next_run_at <= NOW() AND (locked_until IS NULL OR locked_until < NOW())`,
+		scheduler_instance_id, int(JOB_LOCK_TIMEOUT.Seconds()), job.Name)
+	if err != nil {
+		log.Printf("Error claiming job %s: %v", job.Name, err)
+		return false
+	}
+	n, err := result.RowsAffected()
+	return err == nil && n == 1
+}
+
+// job_retry_delay backs off exponentially from one minute, never waiting
+// longer than the job's own interval or an hour
+func job_retry_delay(job Job, failures int) time.Duration {
+	delay := time.Minute << uint(failures-1)
+	if delay > job.Interval {
+		delay = job.Interval
+	}
+	if delay > JOB_MAX_BACKOFF {
+		delay = JOB_MAX_BACKOFF
+	}
+	return delay
+}
+
+func run_job(job Job) {
+	result, err := db.Exec(`INSERT INTO JobRuns (job_name, instance_id, status) VALUES (?, ?, 'running')`,
+		job.Name, scheduler_instance_id)
+	if err != nil {
+		log.Printf("Error recording job run for %s: %v", job.Name, err)
+	}
+	var runID int64
+	if result != nil {
+		runID, _ = result.LastInsertId()
+	}
+
+	runErr := func() (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("panic: %v", r)
+			}
+		}()
+		return job.Run()
+	}()
+
+	status, message := "succeeded", ""
+	if runErr != nil {
+		status, message = "failed", truncate_error(runErr)
+		log.Printf("Job %s failed: %v", job.Name, runErr)
+	}
+
+	if runID > 0 {
+		_, err = db.Exec(`UPDATE JobRuns SET status = ?, error = NULLIF(?, ''), finished_at = NOW() WHERE id = ?`,
+			status, message, runID)
+		if err != nil {
+			log.Printf("Error recording job result for %s: %v", job.Name, err)
+		}
+	}
+
+	if runErr == nil {
+		_, err = db.Exec(`UPDATE ScheduledJobs SET last_run_at = NOW(), last_status = 'succeeded', failures = 0,
+			next_run_at = NOW() + INTERVAL ? SECOND, locked_by = NULL, locked_until = NULL
+			WHERE name = ? AND locked_by = ?`, int(job.Interval.Seconds()), job.Name, scheduler_instance_id)
+	} else {
+		var failures int
+		db.QueryRow(`SELECT failures FROM ScheduledJobs WHERE name = ?`, job.Name).Scan(&failures)
+		failures++
+		_, err = db.Exec(`UPDATE ScheduledJobs SET last_run_at = NOW(), last_status = 'failed', failures = ?,
+			next_run_at = NOW() + INTERVAL ? SECOND, locked_by = NULL, locked_until = NULL
+			WHERE name = ? AND locked_by = ?`, failures, int(job_retry_delay(job, failures).Seconds()), job.Name, scheduler_instance_id)
+	}
+	if err != nil {
+		log.Printf("Error releasing job %s: %v", job.Name, err)
+	}
+}
+
+func run_due_jobs() {
+	for _, job := range scheduled_jobs {
+		if claim_job(job) {
+			run_job(job)
+		}
+	}
+}
+
+// start_scheduler runs registered jobs in the background. Any number of
+// instances can run it, each job only runs on the instance that claims it.
+func start_scheduler() {
+	go func() {
+		run_due_jobs()
+
+		ticker := time.NewTicker(SCHEDULER_TICK)
+		defer ticker.Stop()
+		for range ticker.C {
+			run_due_jobs()
+		}
+	}()
+}
+
+func get_job_states() ([]JobState, error) {
+	query := `
+		SELECT name, interval_seconds, DATE_FORMAT(next_run_at, '%Y-%m-%d %H:%i:%s'),
+		       COALESCE(DATE_FORMAT(last_run_at, '%Y-%m-%d %H:%i:%s'), ''), COALESCE(last_status, ''),
+		       failures, IF(locked_until > NOW(), COALESCE(locked_by, ''), '')
+		FROM ScheduledJobs
+		ORDER BY name`
+
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var states []JobState
+	for rows.Next() {
+		var state JobState
+		err := rows.Scan(&state.Name, &state.IntervalSec, &state.NextRunAt, &state.LastRunAt,
+			&state.LastStatus, &state.Failures, &state.LockedBy)
+		if err != nil {
+			log.Printf("Error scanning job state: %v", err)
+			continue
+		}
+		states = append(states, state)
+	}
+
+	return states, nil
+}
+
+func get_recent_job_runs(limit int) ([]JobRun, error) {
+	query := `
+		SELECT id, job_name, instance_id, DATE_FORMAT(started_at, '%Y-%m-%d %H:%i:%s'),
+		       COALESCE(DATE_FORMAT(finished_at, '%Y-%m-%d %H:%i:%s'), ''), status, COALESCE(error, '')
+		FROM JobRuns
+		ORDER BY id DESC
+		LIMIT ?`
+
+	rows, err := db.Query(query, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var runs []JobRun
+	for rows.Next() {
+		var run JobRun
+		err := rows.Scan(&run.ID, &run.JobName, &run.InstanceID, &run.StartedAt, &run.FinishedAt, &run.Status, &run.Error)
+		if err != nil {
+			log.Printf("Error scanning job run: %v", err)
+			continue
+		}
+		runs = append(runs, run)
+	}
+
+	return runs, nil
+}
+
+// admin_jobs_handler shows job state and recent runs. Posting a job name
+// makes it due immediately.
+func admin_jobs_handler(w http.ResponseWriter, r *http.Request) {
+	authenticated, userID := is_authenticated(r)
+	if !authenticated {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	if !is_admin_user(userID) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		states, err := get_job_states()
+		if err != nil {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			log.Println("Error fetching job states:", err)
+			return
+		}
+		runs, err := get_recent_job_runs(JOB_RUNS_SHOWN)
+		if err != nil {
+			log.Println("Error fetching job runs:", err)
+		}
+
+		templateData := struct {
+			Auth       AuthContext
+			Jobs       []JobState
+			Runs       []JobRun
+			InstanceID string
+		}{
+			Auth:       get_auth(r),
+			Jobs:       states,
+			Runs:       runs,
+			InstanceID: scheduler_instance_id,
+		}
+
+		tmpl := template.Must(template.ParseFiles("template/admin_jobs.html"))
+		err = tmpl.Execute(w, templateData)
+		if err != nil {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			log.Println("Error executing template:", err)
+		}
+
+	case http.MethodPost:
+		_, err := db.Exec(`UPDATE ScheduledJobs SET next_run_at = NOW() WHERE name = ?`, r.FormValue("job"))
+		if err != nil {
+			http.Error(w, "Error scheduling job", http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, "/admin/jobs", http.StatusSeeOther)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func update_tables_for_scheduler() {
+	createQueries := []string{
+		`CREATE TABLE IF NOT EXISTS ScheduledJobs (
+			name VARCHAR(64) PRIMARY KEY,
+			interval_seconds INT NOT NULL,
+			next_run_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			last_run_at DATETIME NULL,
+			last_status VARCHAR(20) NULL,
+			failures INT NOT NULL DEFAULT 0,
+			locked_by VARCHAR(100) NULL,
+			locked_until DATETIME NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS JobRuns (
+			id INT AUTO_INCREMENT PRIMARY KEY,
+			job_name VARCHAR(64) NOT NULL,
+			instance_id VARCHAR(100) NOT NULL,
+			started_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			finished_at DATETIME NULL,
+			status ENUM('running', 'succeeded', 'failed') NOT NULL,
+			error VARCHAR(500) NULL,
+			INDEX idx_job (job_name, id)
+		)`,
+	}
+
+	for _, query := range createQueries {
+		_, err := db.Exec(query)
+		if err != nil {
+			log.Printf("Error creating scheduler tables: %v", err)
+		}
+	}
+
+	log.Println("Tables updated for scheduler")
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"log"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+type SearchSortOption struct {
+	Value string
+	Label string
+}
+
+var search_sort_options = []SearchSortOption{
+	{"relevance", "Relevance"},
+	{"newest", "Newest"},
+	{"price_asc", "Price: low to high"},
+	{"price_desc", "Price: high to low"},
+	{"rating", "Top rated"},
+	{"reviews", "Most reviewed"},
+	{"distance", "Distance"},
+}
+
+var listing_property_types = []string{"apartment", "house", "room", "other"}
+
+func is_search_sort(value string) bool {
+	for _, option := range search_sort_options {
+		if option.Value == value {
+			return true
+		}
+	}
+	return false
+}
+
+func is_listing_property_type(value string) bool {
+	for _, propertyType := range listing_property_types {
+		if propertyType == value {
+			return true
+		}
+	}
+	return false
+}
+
+// HasPropertyType lets templates tick the property types being filtered on
+func (params SearchParams) HasPropertyType(propertyType string) bool {
+	for _, selected := range params.PropertyTypes {
+		if selected == propertyType {
+			return true
+		}
+	}
+	return false
+}
+
+// effective_sort resolves the default sort: relevance only means something
+// when there is a destination to match, distance when there is a location
+func (params SearchParams) effective_sort() string {
+	sort := params.Sort
+	if sort == "" || (sort == "relevance" && params.Destination == "") || (sort == "distance" && params.Center == nil) {
+		if params.Destination != "" {
+			return "relevance"
+		}
+		if params.Center != nil {
+			return "distance"
+		}
+		return "newest"
+	}
+	return sort
+}
+
+// search_sort_columns returns the sort keys of search_listings. Prices are
+// compared in the base currency, and every sort ends with the listing ID so
+// the order is total and a cursor can resume after any row.
+func search_sort_columns(params SearchParams, filters SearchFilters) []SortColumn {
+	id := SortColumn{Expr: "p.id", Desc: true}
+	rating := SortColumn{Expr: "COALESCE(lr.rating_avg, 0)", Desc: true}
+	reviews := SortColumn{Expr: "COALESCE(lr.review_count, 0)", Desc: true}
+
+	switch params.effective_sort() {
+	case "price_asc":
+		return []SortColumn{{Expr: "p.price / COALESCE(er.rate, 1)"}, id}
+	case "price_desc":
+		return []SortColumn{{Expr: "p.price / COALESCE(er.rate, 1)", Desc: true}, id}
+	case "rating":
+		return []SortColumn{rating, reviews, id}
+	case "reviews":
+		return []SortColumn{reviews, rating, id}
+	case "relevance":
+		return []SortColumn{{Expr: filters.Relevance, Args: filters.RelevanceArgs, Desc: true}, rating, id}
+	case "distance":
+		return []SortColumn{{Expr: filters.Distance, Args: filters.DistanceArgs}, id}
+	default:
+		return []SortColumn{{Expr: "p.created_at", Desc: true}, id}
+	}
+}
+
+// parse_search_params reads the listings page query string into SearchParams,
+// ignoring values that aren't valid
+func parse_search_params(query url.Values) SearchParams {
+	params := SearchParams{
+		Destination: strings.TrimSpace(query.Get("destination")),
+		Country:     strings.TrimSpace(query.Get("country")),
+		CheckIn:     query.Get("checkin"),
+		CheckOut:    query.Get("checkout"),
+		Page:        1,
+		Limit:       20,
+	}
+
+	if page, err := strconv.Atoi(query.Get("page")); err == nil && page > 0 {
+		params.Page = page
+	}
+
+	if minPrice, err := strconv.ParseFloat(query.Get("min_price"), 64); err == nil && minPrice >= 0 {
+		params.MinPrice = minPrice
+	}
+	if maxPrice, err := strconv.ParseFloat(query.Get("max_price"), 64); err == nil && maxPrice > 0 {
+		params.MaxPrice = maxPrice
+	}
+
+	for _, propertyType := range query["type"] {
+		if is_listing_property_type(propertyType) && !params.HasPropertyType(propertyType) {
+			params.PropertyTypes = append(params.PropertyTypes, propertyType)
+		}
+	}
+
+	if minRating, err := strconv.ParseFloat(query.Get("min_rating"), 64); err == nil && minRating > 0 && minRating <= 5 {
+		params.MinRating = minRating
+	}
+	params.InstantBook = query.Get("instant_book") == "true"
+
+	if guests, err := strconv.Atoi(strings.TrimSpace(query.Get("guests"))); err == nil && guests > 0 {
+		params.Guests = min(guests, MAX_LISTING_GUESTS)
+	}
+	if bedrooms, err := strconv.Atoi(query.Get("min_bedrooms")); err == nil && bedrooms > 0 {
+		params.MinBedrooms = bedrooms
+	}
+	if beds, err := strconv.Atoi(query.Get("min_beds")); err == nil && beds > 0 {
+		params.MinBeds = beds
+	}
+	if bathrooms, err := strconv.ParseFloat(query.Get("min_bathrooms"), 64); err == nil && bathrooms > 0 {
+		params.MinBathrooms = bathrooms
+	}
+
+	latitude, latErr := strconv.ParseFloat(query.Get("lat"), 64)
+	longitude, lngErr := strconv.ParseFloat(query.Get("lng"), 64)
+	if latErr == nil && lngErr == nil && math.Abs(latitude) <= 90 && math.Abs(longitude) <= 180 {
+		params.Center = &GeoPoint{Latitude: latitude, Longitude: longitude}
+	} else {
+		params.Near = strings.TrimSpace(query.Get("near"))
+	}
+	if radius, err := strconv.ParseFloat(query.Get("radius"), 64); err == nil && radius > 0 {
+		params.RadiusKm = math.Min(radius, MAX_SEARCH_RADIUS_KM)
+	}
+	if bounds, err := parse_bounds(query.Get("bbox")); err == nil {
+		params.Bounds = bounds
+	}
+
+	if sort := query.Get("sort"); is_search_sort(sort) {
+		params.Sort = sort
+	}
+
+	// Saved searches and links from before the catalogue use wifi=true
+	amenities := query["amenity"]
+	for _, amenity := range default_amenities {
+		if query.Get(amenity.Key) == "true" {
+			amenities = append(amenities, amenity.Key)
+		}
+	}
+	params.Amenities = normalize_amenity_keys(amenities)
+
+	return params
+}
+
+// buildPaginationQuery encodes the search, sort and filters of params so page
+// links keep them. The page itself is added by the template.
+func buildPaginationQuery(params SearchParams) string {
+	values := url.Values{}
+	set := func(key, value string) {
+		if value != "" {
+			values.Set(key, value)
+		}
+	}
+	flag := func(key string, on bool) {
+		if on {
+			values.Set(key, "true")
+		}
+	}
+
+	set("destination", params.Destination)
+	set("country", params.Country)
+	set("checkin", params.CheckIn)
+	set("checkout", params.CheckOut)
+	if params.MinPrice > 0 {
+		values.Set("min_price", strconv.FormatFloat(params.MinPrice, 'f', -1, 64))
+	}
+	if params.MaxPrice > 0 {
+		values.Set("max_price", strconv.FormatFloat(params.MaxPrice, 'f', -1, 64))
+	}
+	for _, propertyType := range params.PropertyTypes {
+		values.Add("type", propertyType)
+	}
+	if params.MinRating > 0 {
+		values.Set("min_rating", strconv.FormatFloat(params.MinRating, 'f', -1, 64))
+	}
+	flag("instant_book", params.InstantBook)
+	count := func(key string, value int) {
+		if value > 0 {
+			values.Set(key, strconv.Itoa(value))
+		}
+	}
+	count("guests", params.Guests)
+	count("min_bedrooms", params.MinBedrooms)
+	count("min_beds", params.MinBeds)
+	if params.MinBathrooms > 0 {
+		values.Set("min_bathrooms", strconv.FormatFloat(params.MinBathrooms, 'f', -1, 64))
+	}
+	if params.Near != "" {
+		values.Set("near", params.Near)
+	} else if params.Center != nil {
+		values.Set("lat", strconv.FormatFloat(params.Center.Latitude, 'f', -1, 64))
+		values.Set("lng", strconv.FormatFloat(params.Center.Longitude, 'f', -1, 64))
+	}
+	if params.RadiusKm > 0 {
+		values.Set("radius", strconv.FormatFloat(params.RadiusKm, 'f', -1, 64))
+	}
+	if params.Bounds != nil {
+		values.Set("bbox", params.Bounds.String())
+	}
+	set("sort", params.Sort)
+
+	for _, amenity := range params.Amenities {
+		values.Add("amenity", amenity)
+	}
+
+	return values.Encode()
+}
+
+// get_listing_countries returns the countries that have listings, for the
+// country filter
+func get_listing_countries() []string {
+	rows, err := db.Query(`SELECT DISTINCT country FROM Posts WHERE country != '' ORDER BY country`)
+	if err != nil {
+		log.Printf("Error fetching listing countries: %v", err)
+		return nil
+	}
+	defer rows.Close()
+
+	var countries []string
+	for rows.Next() {
+		var country string
+		if err := rows.Scan(&country); err == nil {
+			countries = append(countries, country)
+		}
+	}
+	return countries
+}
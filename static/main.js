@@ -101,4 +101,41 @@ document.addEventListener('DOMContentLoaded', function() {
             performSearch();
         });
     }
-});
\ No newline at end of file
+});
+// Destination autocomplete for the search box
+document.addEventListener('DOMContentLoaded', function() {
+    const destinationInput = document.querySelector('input[name="destination"]');
+    if (!destinationInput) {
+        return;
+    }
+
+    const suggestions = document.createElement('datalist');
+    suggestions.id = 'destination-suggestions';
+    document.body.appendChild(suggestions);
+    destinationInput.setAttribute('list', suggestions.id);
+    destinationInput.setAttribute('autocomplete', 'off');
+
+    let timer = null;
+    function loadSuggestions() {
+        const query = destinationInput.value.trim();
+        fetch('/api/destinations?q=' + encodeURIComponent(query))
+            .then(response => response.ok ? response.json() : [])
+            .then(destinations => {
+                suggestions.innerHTML = '';
+                destinations.forEach(destination => {
+                    const option = document.createElement('option');
+                    option.value = destination.name;
+                    option.label = destination.label + ' · ' + destination.listing_count +
+                        (destination.listing_count === 1 ? ' property' : ' properties');
+                    suggestions.appendChild(option);
+                });
+            })
+            .catch(error => console.error('Error loading destinations:', error));
+    }
+
+    destinationInput.addEventListener('focus', loadSuggestions);
+    destinationInput.addEventListener('input', function() {
+        clearTimeout(timer);
+        timer = setTimeout(loadSuggestions, 150);
+    });
+});
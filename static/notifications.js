@@ -0,0 +1,82 @@
+// Notification bell: loads the feed and listens for live updates over SSE
+(function() {
+    const bell = document.getElementById('notification-bell');
+    if (!bell) {
+        return;
+    }
+
+    const badge = document.getElementById('bell-badge');
+    const dropdown = document.getElementById('notification-dropdown');
+
+    function setUnread(count) {
+        badge.textContent = count;
+        badge.style.display = count > 0 ? '' : 'none';
+    }
+
+    function renderItem(notification) {
+        const item = document.createElement('a');
+        item.className = 'notification-item' + (notification.read ? '' : ' unread');
+        item.href = notification.link || '#';
+        item.addEventListener('click', function() {
+            navigator.sendBeacon('/api/notifications', new URLSearchParams({ id: notification.id }));
+        });
+
+        const title = document.createElement('strong');
+        title.textContent = notification.title;
+        const body = document.createElement('p');
+        body.textContent = notification.body;
+        const time = document.createElement('small');
+        time.textContent = notification.created_at;
+
+        item.append(title, body, time);
+        return item;
+    }
+
+    function loadFeed() {
+        fetch('/api/notifications')
+            .then(response => response.json())
+            .then(data => {
+                setUnread(data.unread);
+                dropdown.innerHTML = '';
+                if (data.notifications.length === 0) {
+                    dropdown.innerHTML = '<p class="notification-empty">No notifications yet</p>';
+                    return;
+                }
+                data.notifications.forEach(n => dropdown.appendChild(renderItem(n)));
+            })
+            .catch(error => console.error('Error loading notifications:', error));
+    }
+
+    window.toggleNotifications = function() {
+        const open = dropdown.classList.toggle('open');
+        if (open && badge.textContent !== '0') {
+            fetch('/api/notifications', { method: 'POST' })
+                .then(response => response.json())
+                .then(data => setUnread(data.unread));
+        }
+    };
+
+    document.addEventListener('click', function(event) {
+        if (!bell.contains(event.target)) {
+            dropdown.classList.remove('open');
+        }
+    });
+
+    loadFeed();
+
+    if (window.EventSource) {
+        const stream = new EventSource('/notifications/stream');
+        stream.addEventListener('unread', function(event) {
+            setUnread(parseInt(event.data, 10));
+        });
+        stream.addEventListener('notification', function(event) {
+            const notification = JSON.parse(event.data);
+            const empty = dropdown.querySelector('.notification-empty');
+            if (empty) {
+                empty.remove();
+            }
+            dropdown.insertBefore(renderItem(notification), dropdown.firstChild);
+            setUnread(parseInt(badge.textContent || '0', 10) + 1);
+        });
+    }
+})();
@@ -0,0 +1,161 @@
+// Wishlist hearts. Buttons with data-listing-id are filled in for listings the
+// user saved; clicking one opens a picker of their wishlists.
+
+let wishlistPicker = null;
+const savedListings = new Set();
+
+function closeWishlistPicker() {
+    if (wishlistPicker) {
+        wishlistPicker.remove();
+        wishlistPicker = null;
+    }
+}
+
+function markSavedListing(listingId, saved) {
+    if (saved) {
+        savedListings.add(String(listingId));
+    } else {
+        savedListings.delete(String(listingId));
+    }
+    document.querySelectorAll('[data-listing-id="' + listingId + '"]').forEach(button => {
+        button.classList.toggle('saved', saved);
+    });
+}
+
+async function saveToWishlist(listingId, fields) {
+    const body = new URLSearchParams(Object.assign({ listing_id: listingId }, fields));
+    const response = await fetch('/api/wishlists', { method: 'POST', body: body });
+    if (response.status === 401) {
+        window.location.href = '/login';
+        return null;
+    }
+    const data = await response.json();
+    if (!response.ok) {
+        alert(data.error || 'Could not update your wishlist');
+        return null;
+    }
+    markSavedListing(listingId, data.saved_anywhere);
+    return data;
+}
+
+async function toggleWishlist(listingId, button) {
+    if (wishlistPicker) {
+        closeWishlistPicker();
+        return;
+    }
+
+    const response = await fetch('/api/wishlists?listing_id=' + encodeURIComponent(listingId));
+    if (response.status === 401) {
+        window.location.href = '/login';
+        return;
+    }
+    if (!response.ok) {
+        return;
+    }
+    const data = await response.json();
+
+    // Without a wishlist yet, the first heart creates one
+    if (data.wishlists.length === 0) {
+        await saveToWishlist(listingId, {});
+        return;
+    }
+
+    wishlistPicker = document.createElement('div');
+    wishlistPicker.className = 'wishlist-picker';
+    wishlistPicker.addEventListener('click', event => event.stopPropagation());
+
+    const title = document.createElement('h4');
+    title.textContent = 'Save to a wishlist';
+    wishlistPicker.appendChild(title);
+
+    data.wishlists.forEach(wishlist => {
+        const label = document.createElement('label');
+        const checkbox = document.createElement('input');
+        checkbox.type = 'checkbox';
+        checkbox.checked = wishlist.contains;
+        checkbox.addEventListener('change', async () => {
+            const result = await saveToWishlist(listingId, { wishlist_id: wishlist.id });
+            if (result) {
+                checkbox.checked = result.saved;
+            }
+        });
+        label.appendChild(checkbox);
+        label.appendChild(document.createTextNode(' ' + wishlist.name + ' (' + wishlist.item_count + ')'));
+        wishlistPicker.appendChild(label);
+    });
+
+    const form = document.createElement('form');
+    const name = document.createElement('input');
+    name.type = 'text';
+    name.placeholder = 'New wishlist';
+    name.maxLength = 100;
+    const create = document.createElement('button');
+    create.type = 'submit';
+    create.textContent = 'Create';
+    form.appendChild(name);
+    form.appendChild(create);
+    form.addEventListener('submit', async event => {
+        event.preventDefault();
+        if (name.value.trim() && await saveToWishlist(listingId, { name: name.value.trim() })) {
+            closeWishlistPicker();
+        }
+    });
+    wishlistPicker.appendChild(form);
+
+    const rect = button.getBoundingClientRect();
+    wishlistPicker.style.top = (window.scrollY + rect.bottom + 8) + 'px';
+    wishlistPicker.style.left = Math.max(8, window.scrollX + rect.right - 260) + 'px';
+    document.body.appendChild(wishlistPicker);
+}
+
+// voteOnWishlistItem records the user's vote; clicking the same vote again takes it back
+async function voteOnWishlistItem(wishlistId, listingId, vote, button) {
+    const item = button.closest('.wishlist-item');
+    const current = parseInt(item.dataset.vote, 10);
+    if (current === vote) {
+        vote = 0;
+    }
+
+    const body = new URLSearchParams({ wishlist_id: wishlistId, listing_id: listingId, vote: vote });
+    const response = await fetch('/wishlists/vote', { method: 'POST', body: body });
+    if (response.status === 401) {
+        window.location.href = '/login';
+        return;
+    }
+    if (!response.ok) {
+        return;
+    }
+    const data = await response.json();
+
+    item.dataset.vote = data.vote;
+    item.querySelector('.upvotes').textContent = data.upvotes;
+    item.querySelector('.downvotes').textContent = data.downvotes;
+    item.querySelector('.vote-up').classList.toggle('voted', data.vote > 0);
+    item.querySelector('.vote-down').classList.toggle('voted', data.vote < 0);
+}
+
+async function removeFromWishlist(wishlistId, listingId, button) {
+    const result = await saveToWishlist(listingId, { wishlist_id: wishlistId });
+    if (result && !result.saved) {
+        button.closest('.wishlist-item').remove();
+    }
+}
+
+function copyShareLink(input) {
+    input.select();
+    navigator.clipboard.writeText(input.value);
+}
+
+document.addEventListener('click', closeWishlistPicker);
+
+document.addEventListener('DOMContentLoaded', async function() {
+    if (!document.querySelector('[data-listing-id]')) {
+        return;
+    }
+    const response = await fetch('/api/wishlists');
+    if (!response.ok) {
+        return;
+    }
+    const data = await response.json();
+    data.saved_listing_ids.forEach(id => markSavedListing(id, true));
+});
@@ -17,33 +17,25 @@ func get_user_listings(userID int, isAdmin bool) []Listing {
 		// If user is admin, show all listings
 		query = `
 			SELECT p.id, p.user_id, p.title, p.country, p.city, p.address, 
-			       p.description, p.price, p.type, p.created_at,
+			       p.description, p.price, p.currency, p.type, p.created_at,
 			       COALESCE(MIN(i.image_url), '') as image_url,
-			       COALESCE(MAX(a.wifi), false) as has_wifi,
-			       COALESCE(MAX(a.kitchen), false) as has_kitchen,
-			       COALESCE(MAX(a.air_conditioning), false) as has_ac,
-			       COALESCE(MAX(a.parking), false) as has_parking
+			       ` + listing_amenity_ids_sql + ` as amenity_ids
 			FROM Posts p
 			LEFT JOIN Images i ON p.id = i.post_id
-			LEFT JOIN Amenities a ON p.id = a.post_id
-			GROUP BY p.id, p.user_id, p.title, p.country, p.city, p.address, p.description, p.price, p.type, p.created_at
+			GROUP BY p.id, p.user_id, p.title, p.country, p.city, p.address, p.description, p.price, p.currency, p.type, p.created_at
 			ORDER BY p.created_at DESC`
 		args = []interface{}{}
 	} else {
 		// For regular users, show only their listings
 		query = `
 			SELECT p.id, p.user_id, p.title, p.country, p.city, p.address, 
-			       p.description, p.price, p.type, p.created_at,
+			       p.description, p.price, p.currency, p.type, p.created_at,
 			       COALESCE(MIN(i.image_url), '') as image_url,
-			       COALESCE(MAX(a.wifi), false) as has_wifi,
-			       COALESCE(MAX(a.kitchen), false) as has_kitchen,
-			       COALESCE(MAX(a.air_conditioning), false) as has_ac,
-			       COALESCE(MAX(a.parking), false) as has_parking
+			       ` + listing_amenity_ids_sql + ` as amenity_ids
 			FROM Posts p
 			LEFT JOIN Images i ON p.id = i.post_id
-			LEFT JOIN Amenities a ON p.id = a.post_id
 			WHERE p.user_id = ?
-			GROUP BY p.id, p.user_id, p.title, p.country, p.city, p.address, p.description, p.price, p.type, p.created_at
+			GROUP BY p.id, p.user_id, p.title, p.country, p.city, p.address, p.description, p.price, p.currency, p.type, p.created_at
 			ORDER BY p.created_at DESC`
 		args = []interface{}{userID}
 	}
@@ -57,17 +49,18 @@ func get_user_listings(userID int, isAdmin bool) []Listing {
 
 	for rows.Next() {
 		var listing Listing
+		var amenityIDs string
 		err := rows.Scan(
 			&listing.ID, &listing.UserID, &listing.Title, &listing.Country,
 			&listing.City, &listing.Address, &listing.Description,
-			&listing.Price, &listing.Type, &listing.CreatedAt,
-			&listing.ImageURL, &listing.HasWifi, &listing.HasKitchen,
-			&listing.HasAC, &listing.HasParking,
+			&listing.Price, &listing.Currency, &listing.Type, &listing.CreatedAt,
+			&listing.ImageURL, &amenityIDs,
 		)
 		if err != nil {
 			log.Printf("Error scanning listing: %v", err)
 			continue
 		}
+		listing.Amenities = amenities_from_ids(amenityIDs)
 		listings = append(listings, listing)
 	}
 
@@ -112,11 +105,15 @@ func user_profile_handler(w http.ResponseWriter, r *http.Request) {
 	// Get user's listings (or all listings if admin)
 	isAdmin := user_data.Role == "admin" || user_data.Role == "moderator"
 	userListings := get_user_listings(intID, isAdmin)
+	apply_display_currency(userListings, get_display_currency(r))
 
 	// Get user's bookings and review-related data (only for own profile)
 	var userBookings []Booking
 	var hostBookings []Booking
 	var reviewableBookings []Booking
+	var invoices []Invoice
+	var savedSearches []SavedSearch
+	var unreadMessages int
 
 	if is_own_profile {
 		userBookings, err = get_user_bookings(intID)
@@ -135,8 +132,22 @@ func user_profile_handler(w http.ResponseWriter, r *http.Request) {
 		if err != nil {
 			log.Printf("Error fetching reviewable bookings: %v", err)
 		}
+
+		invoices, err = get_user_invoices(intID)
+		if err != nil {
+			log.Printf("Error fetching invoices: %v", err)
+		}
+
+		savedSearches, err = get_user_saved_searches(intID)
+		if err != nil {
+			log.Printf("Error fetching saved searches: %v", err)
+		}
+
+		unreadMessages = get_unread_message_count(intID)
 	}
 
+	guestReviews := get_guest_review_summary(intID)
+
 	authCtx := get_auth(r)
 
 	template_data := struct {
@@ -148,6 +159,11 @@ func user_profile_handler(w http.ResponseWriter, r *http.Request) {
 		UserBookings       []Booking
 		HostBookings       []Booking
 		ReviewableBookings []Booking
+		Invoices           []Invoice
+		SavedSearches      []SavedSearch
+		UnreadMessages     int
+		GuestReviews       GuestReviewSummary
+		ReviewCategories   []ReviewCategory
 		Auth               AuthContext
 	}{
 		User:               user_data,
@@ -158,6 +174,11 @@ func user_profile_handler(w http.ResponseWriter, r *http.Request) {
 		UserBookings:       userBookings,
 		HostBookings:       hostBookings,
 		ReviewableBookings: reviewableBookings,
+		Invoices:           invoices,
+		SavedSearches:      savedSearches,
+		UnreadMessages:     unreadMessages,
+		GuestReviews:       guestReviews,
+		ReviewCategories:   review_categories,
 		Auth:               authCtx,
 	}
 
@@ -172,6 +193,11 @@ func user_profile_handler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func is_admin_user(userID int) bool {
+	userData := get_user_data(userID)
+	return userData != nil && (userData.Role == "admin" || userData.Role == "moderator")
+}
+
 func my_profile_handler(w http.ResponseWriter, r *http.Request) {
 	user_id := get_current_user_id(r)
 	if user_id == 0 {
@@ -0,0 +1,656 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const MAX_WISHLISTS = 50
+
+const DEFAULT_WISHLIST_NAME = "Favourites"
+
+type Wishlist struct {
+	ID         int    `json:"id"`
+	UserID     int    `json:"-"`
+	OwnerName  string `json:"-"`
+	Name       string `json:"name"`
+	ShareToken string `json:"-"`
+	ItemCount  int    `json:"item_count"`
+	ImageURL   string `json:"-"`
+	Contains   bool   `json:"contains"`
+
+	// "owner" or "collaborator", the role of the user viewing it
+	Role string `json:"-"`
+}
+
+// ShareURL is the read-only link collaborators join the wishlist with
+func (w Wishlist) ShareURL() string {
+	return get_base_url() + "/wishlists/shared/" + w.ShareToken
+}
+
+// WishlistItem is a listing of a wishlist with its current price, its
+// availability for the dates being looked at and the collaborators' votes
+type WishlistItem struct {
+	Listing    Listing
+	AddedAt    string
+	SavedPrice float64
+
+	// SavedPrice is the listing's price when it was added
+	PriceChanged bool
+	PriceDropped bool
+
+	// Set when dates are chosen
+	Available bool
+	Nights    int
+	StayTotal float64
+	Upvotes   int
+	Downvotes int
+	MyVote    int
+	VoteScore int
+}
+
+// get_wishlist_role returns "owner" or "collaborator" when the user can see
+// the wishlist, or "" when they can't
+func get_wishlist_role(wishlistID, userID int) string {
+	var ownerID int
+	err := db.QueryRow(`SELECT user_id FROM Wishlists WHERE id = ?`, wishlistID).Scan(&ownerID)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("Error fetching wishlist: %v", err)
+		}
+		return ""
+	}
+	if ownerID == userID {
+		return "owner"
+	}
+
+	var exists int
+	err = db.QueryRow(`SELECT COUNT(*) FROM WishlistCollaborators WHERE wishlist_id = ? AND user_id = ?`, wishlistID, userID).Scan(&exists)
+	if err == nil && exists > 0 {
+		return "collaborator"
+	}
+	return ""
+}
+
+// get_user_wishlists returns the wishlists a user owns, then those shared
+// with them. Contains tells whether listingID is in each of them.
+func get_user_wishlists(userID, listingID int) ([]Wishlist, error) {
+	query := `SELECT w.id, w.user_id, u.username, w.name, w.share_token,
+		       (SELECT COUNT(*) FROM WishlistItems wi WHERE wi.wishlist_id = w.id),
+		       COALESCE((SELECT MIN(i.image_url) FROM WishlistItems wi JOIN Images i ON i.post_id = wi.post_id
+		                 WHERE wi.wishlist_id = w.id), ''),
+		       EXISTS (SELECT 1 FROM WishlistItems wi WHERE wi.wishlist_id = w.id AND wi.post_id = ?),
+		       CASE WHEN w.user_id = ? THEN 'owner' ELSE 'collaborator' END AS role
+		FROM Wishlists w
+		JOIN Users u ON u.id = w.user_id
+		LEFT JOIN WishlistCollaborators c ON c.wishlist_id = w.id AND c.user_id = ?
+		WHERE w.user_id = ? OR c.user_id IS NOT NULL
+		ORDER BY role DESC, w.created_at`
+	rows, err := db.Query(query, listingID, userID, userID, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var wishlists []Wishlist
+	for rows.Next() {
+		var wl Wishlist
+		err := rows.Scan(&wl.ID, &wl.UserID, &wl.OwnerName, &wl.Name, &wl.ShareToken, &wl.ItemCount, &wl.ImageURL,
+			&wl.Contains, &wl.Role)
+		if err != nil {
+			log.Printf("Error scanning wishlist: %v", err)
+			continue
+		}
+		wishlists = append(wishlists, wl)
+	}
+	return wishlists, nil
+}
+
+func get_wishlist(wishlistID int) (*Wishlist, error) {
+	var wl Wishlist
+	err := db.QueryRow(`SELECT w.id, w.user_id, u.username, w.name, w.share_token
+		FROM Wishlists w JOIN Users u ON u.id = w.user_id WHERE w.id = ?`, wishlistID).
+		Scan(&wl.ID, &wl.UserID, &wl.OwnerName, &wl.Name, &wl.ShareToken)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &wl, nil
+}
+
+func create_wishlist(userID int, name string) (int, error) {
+	var count int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM Wishlists WHERE user_id = ?`, userID).Scan(&count); err != nil {
+		return 0, err
+	}
+	if count >= MAX_WISHLISTS {
+		return 0, fmt.Errorf("you can have up to %d wishlists", MAX_WISHLISTS)
+	}
+
+	result, err := db.Exec(`INSERT INTO Wishlists (user_id, name, share_token) VALUES (?, ?, ?)`,
+		userID, name, new_random_token())
+	if err != nil {
+		return 0, err
+	}
+	id, err := result.LastInsertId()
+	return int(id), err
+}
+
+func valid_wishlist_name(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || utf8.RuneCountInString(name) > 100 {
+		return "", fmt.Errorf("wishlist names must be 1 to 100 characters")
+	}
+	return name, nil
+}
+
+// toggle_wishlist_item adds the listing to the wishlist, or removes it if it
+// was already there. It reports whether the listing is now in the wishlist.
+func toggle_wishlist_item(wishlistID, listingID int) (bool, error) {
+	result, err := db.Exec(`DELETE FROM WishlistItems WHERE wishlist_id = ? AND post_id = ?`, wishlistID, listingID)
+	if err != nil {
+		return false, err
+	}
+	if n, _ := result.RowsAffected(); n > 0 {
+		return false, nil
+	}
+
+	// The price is remembered so the wishlist can show when it changes
+	_, err = db.Exec(`INSERT INTO WishlistItems (wishlist_id, post_id, saved_price, saved_currency)
+		SELECT ?, id, price, currency FROM Posts WHERE id = ?`, wishlistID, listingID)
+	return err == nil, err
+}
+
+// get_saved_listing_ids returns the listings in any of the user's own
+// wishlists, to fill in their hearts
+func get_saved_listing_ids(userID int) []int {
+	rows, err := db.Query(`SELECT DISTINCT wi.post_id FROM WishlistItems wi
+		JOIN Wishlists w ON w.id = wi.wishlist_id WHERE w.user_id = ?`, userID)
+	if err != nil {
+		log.Printf("Error fetching saved listings: %v", err)
+		return nil
+	}
+	defer rows.Close()
+
+	ids := []int{}
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// get_wishlist_items returns the listings of a wishlist, most voted first.
+// Prices are converted to currency, and availability is checked when both
+// dates are given.
+func get_wishlist_items(wishlistID, viewerID int, currency, checkIn, checkOut string) ([]WishlistItem, error) {
+	query := `SELECT p.id, p.user_id, p.title, p.country, COALESCE(p.city, ''), p.description, p.price, p.currency, p.type,
+		       COALESCE((SELECT MIN(i.image_url) FROM Images i WHERE i.post_id = p.id), ''),
+		       p.instant_book, COALESCE(lr.rating_avg, 0), COALESCE(lr.review_count, 0),
+		       DATE_FORMAT(wi.added_at, '%Y-%m-%d'), wi.saved_price, wi.saved_currency,
+		       (SELECT COUNT(*) FROM WishlistVotes v WHERE v.wishlist_id = wi.wishlist_id AND v.post_id = wi.post_id AND v.vote > 0),
+		       (SELECT COUNT(*) FROM WishlistVotes v WHERE v.wishlist_id = wi.wishlist_id AND v.post_id = wi.post_id AND v.vote < 0),
+		       COALESCE((SELECT v.vote FROM WishlistVotes v WHERE v.wishlist_id = wi.wishlist_id AND v.post_id = wi.post_id AND v.user_id = ?), 0)
+		FROM WishlistItems wi
+		JOIN Posts p ON p.id = wi.post_id
+		LEFT JOIN ListingRatings lr ON lr.post_id = p.id
+		WHERE wi.wishlist_id = ?
+		ORDER BY wi.added_at DESC`
+	rows, err := db.Query(query, viewerID, wishlistID)
+	if err != nil {
+		return nil, err
+	}
+
+	var items []WishlistItem
+	for rows.Next() {
+		var item WishlistItem
+		var savedCurrency string
+		l := &item.Listing
+		err := rows.Scan(&l.ID, &l.UserID, &l.Title, &l.Country, &l.City, &l.Description, &l.Price, &l.Currency, &l.Type,
+			&l.ImageURL, &l.InstantBook, &l.RatingAvg, &l.ReviewCount,
+			&item.AddedAt, &item.SavedPrice, &savedCurrency, &item.Upvotes, &item.Downvotes, &item.MyVote)
+		if err != nil {
+			log.Printf("Error scanning wishlist item: %v", err)
+			continue
+		}
+		set_listing_display_price(l, currency)
+		item.PriceChanged = savedCurrency == l.Currency && item.SavedPrice != l.Price
+		item.PriceDropped = item.PriceChanged && l.Price < item.SavedPrice
+		item.VoteScore = item.Upvotes - item.Downvotes
+		items = append(items, item)
+	}
+	rows.Close()
+
+	if checkIn != "" && checkOut != "" {
+		start, startErr := time.Parse("2006-01-02", checkIn)
+		end, endErr := time.Parse("2006-01-02", checkOut)
+		if startErr == nil && endErr == nil && end.After(start) {
+			nights := int(end.Sub(start).Hours() / 24)
+			postIDs := make([]int, len(items))
+			for i, item := range items {
+				postIDs[i] = item.Listing.ID
+			}
+			if booked, err := get_booked_listings(postIDs, checkIn, checkOut); err == nil {
+				for i := range items {
+					items[i].Available = !booked[items[i].Listing.ID]
+					items[i].Nights = nights
+					items[i].StayTotal = float64(nights) * items[i].Listing.DisplayPrice
+				}
+			}
+		}
+	}
+
+	// Most liked first, keeping the newest first among equals
+	sort.SliceStable(items, func(i, j int) bool {
+		return items[i].VoteScore > items[j].VoteScore
+	})
+
+	return items, nil
+}
+
+func render_wishlist(w http.ResponseWriter, r *http.Request, wishlist *Wishlist, role string) {
+	_, userID := is_authenticated(r)
+	currency := get_display_currency(r)
+	checkIn, checkOut := r.URL.Query().Get("checkin"), r.URL.Query().Get("checkout")
+
+	items, err := get_wishlist_items(wishlist.ID, userID, currency, checkIn, checkOut)
+	if err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		log.Println("Error fetching wishlist items:", err)
+		return
+	}
+
+	templateData := struct {
+		Wishlist *Wishlist
+		Items    []WishlistItem
+		IsOwner  bool
+		CanVote  bool
+		CheckIn  string
+		CheckOut string
+		Currency string
+		Auth     AuthContext
+	}{
+		Wishlist: wishlist,
+		Items:    items,
+		IsOwner:  role == "owner",
+		CanVote:  role != "",
+		CheckIn:  checkIn,
+		CheckOut: checkOut,
+		Currency: currency,
+		Auth:     get_auth(r),
+	}
+
+	tmpl := template.Must(template.ParseFiles("template/wishlist.html"))
+	if err := tmpl.Execute(w, templateData); err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		log.Println("Error executing template:", err)
+	}
+}
+
+// wishlists_handler serves:
+//
+//	GET  /wishlists                 the user's wishlists
+//	POST /wishlists                 create a wishlist named name
+//	GET  /wishlists/{id}            a wishlist, for its owner and collaborators
+//	GET  /wishlists/shared/{token}  a shared wishlist, read-only until the visitor joins it
+//	POST /wishlists/shared/{token}  join a shared wishlist as a collaborator
+func wishlists_handler(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/wishlists"), "/")
+
+	if token, ok := strings.CutPrefix(path, "shared/"); ok {
+		if r.Method != http.MethodGet && r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var wishlistID int
+		err := db.QueryRow(`SELECT id FROM Wishlists WHERE share_token = ?`, token).Scan(&wishlistID)
+		if err != nil {
+			http.Error(w, "This wishlist link is no longer valid", http.StatusNotFound)
+			return
+		}
+		wishlist, err := get_wishlist(wishlistID)
+		if err != nil || wishlist == nil {
+			http.Error(w, "This wishlist link is no longer valid", http.StatusNotFound)
+			return
+		}
+
+		authenticated, userID := is_authenticated(r)
+		if r.Method == http.MethodPost {
+			if !authenticated {
+				http.Redirect(w, r, "/login", http.StatusSeeOther)
+				return
+			}
+			if userID != wishlist.UserID {
+				_, err := db.Exec(`INSERT IGNORE INTO WishlistCollaborators (wishlist_id, user_id) VALUES (?, ?)`, wishlistID, userID)
+				if err != nil {
+					http.Error(w, "Internal server error", http.StatusInternalServerError)
+					log.Printf("Error joining wishlist: %v", err)
+					return
+				}
+			}
+			http.Redirect(w, r, fmt.Sprintf("/wishlists/%d", wishlistID), http.StatusSeeOther)
+			return
+		}
+
+		role := ""
+		if authenticated {
+			role = get_wishlist_role(wishlistID, userID)
+		}
+		render_wishlist(w, r, wishlist, role)
+		return
+	}
+
+	authenticated, userID := is_authenticated(r)
+	if !authenticated {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	if path != "" {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		wishlistID, err := strconv.Atoi(path)
+		if err != nil {
+			http.Error(w, "Invalid wishlist ID", http.StatusBadRequest)
+			return
+		}
+		role := get_wishlist_role(wishlistID, userID)
+		wishlist, err := get_wishlist(wishlistID)
+		if err != nil || wishlist == nil || role == "" {
+			http.Error(w, "Wishlist not found", http.StatusNotFound)
+			return
+		}
+		render_wishlist(w, r, wishlist, role)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		wishlists, err := get_user_wishlists(userID, 0)
+		if err != nil {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			log.Println("Error fetching wishlists:", err)
+			return
+		}
+
+		templateData := struct {
+			Wishlists []Wishlist
+			Auth      AuthContext
+		}{
+			Wishlists: wishlists,
+			Auth:      get_auth(r),
+		}
+		tmpl := template.Must(template.ParseFiles("template/wishlists.html"))
+		if err := tmpl.Execute(w, templateData); err != nil {
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			log.Println("Error executing template:", err)
+		}
+
+	case http.MethodPost:
+		name, err := valid_wishlist_name(r.FormValue("name"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		id, err := create_wishlist(userID, name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		http.Redirect(w, r, fmt.Sprintf("/wishlists/%d", id), http.StatusSeeOther)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// manage_wishlist_handler lets the owner rename or delete a wishlist, or
+// reset its share link so collaborators who have it can't open it anymore
+func manage_wishlist_handler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	authenticated, userID := is_authenticated(r)
+	if !authenticated {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	wishlistID, err := strconv.Atoi(r.FormValue("id"))
+	if err != nil || get_wishlist_role(wishlistID, userID) != "owner" {
+		http.Error(w, "Wishlist not found", http.StatusNotFound)
+		return
+	}
+
+	redirect := fmt.Sprintf("/wishlists/%d", wishlistID)
+	switch r.FormValue("action") {
+	case "rename":
+		name, err := valid_wishlist_name(r.FormValue("name"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		_, err = db.Exec(`UPDATE Wishlists SET name = ? WHERE id = ?`, name, wishlistID)
+	case "reset_link":
+		_, err = db.Exec(`UPDATE Wishlists SET share_token = ? WHERE id = ?`, new_random_token(), wishlistID)
+		if err == nil {
+			_, err = db.Exec(`DELETE FROM WishlistCollaborators WHERE wishlist_id = ?`, wishlistID)
+		}
+	case "delete":
+		_, err = db.Exec(`DELETE FROM Wishlists WHERE id = ?`, wishlistID)
+		redirect = "/wishlists"
+	default:
+		http.Error(w, "Unknown action", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error updating wishlist", http.StatusInternalServerError)
+		log.Println("Error updating wishlist:", err)
+		return
+	}
+	http.Redirect(w, r, redirect, http.StatusSeeOther)
+}
+
+// api_wishlists_handler backs the heart buttons:
+//
+//	GET  /api/wishlists?listing_id=  the user's wishlists, whether each contains
+//	                                 the listing, and every listing they saved
+//	POST /api/wishlists              toggle listing_id in wishlist_id, or in a new
+//	                                 wishlist called name, or in their first one
+func api_wishlists_handler(w http.ResponseWriter, r *http.Request) {
+	authenticated, userID := is_authenticated(r)
+	if !authenticated {
+		write_json_error(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	listingID, _ := strconv.Atoi(r.FormValue("listing_id"))
+
+	switch r.Method {
+	case http.MethodGet:
+		wishlists, err := get_user_wishlists(userID, listingID)
+		if err != nil {
+			log.Println("Error fetching wishlists:", err)
+			write_json_error(w, http.StatusInternalServerError, "internal server error")
+			return
+		}
+		owned := []Wishlist{}
+		for _, wl := range wishlists {
+			if wl.Role == "owner" {
+				owned = append(owned, wl)
+			}
+		}
+		write_json(w, http.StatusOK, map[string]interface{}{
+			"wishlists":         owned,
+			"saved_listing_ids": get_saved_listing_ids(userID),
+		})
+
+	case http.MethodPost:
+		if listing, err := get_listing_by_id(listingID); err != nil || listing == nil {
+			write_json_error(w, http.StatusNotFound, "listing not found")
+			return
+		}
+
+		wishlistID, _ := strconv.Atoi(r.FormValue("wishlist_id"))
+		if wishlistID != 0 {
+			if get_wishlist_role(wishlistID, userID) != "owner" {
+				write_json_error(w, http.StatusNotFound, "wishlist not found")
+				return
+			}
+		} else {
+			name := r.FormValue("name")
+			if name == "" {
+				// The first heart goes to the oldest wishlist, created if needed
+				err := db.QueryRow(`SELECT id FROM Wishlists WHERE user_id = ? ORDER BY created_at LIMIT 1`, userID).Scan(&wishlistID)
+				if err != nil && err != sql.ErrNoRows {
+					log.Println("Error fetching wishlist:", err)
+					write_json_error(w, http.StatusInternalServerError, "internal server error")
+					return
+				}
+				name = DEFAULT_WISHLIST_NAME
+			}
+			if wishlistID == 0 {
+				name, err := valid_wishlist_name(name)
+				if err != nil {
+					write_json_error(w, http.StatusBadRequest, err.Error())
+					return
+				}
+				if wishlistID, err = create_wishlist(userID, name); err != nil {
+					write_json_error(w, http.StatusBadRequest, err.Error())
+					return
+				}
+			}
+		}
+
+		saved, err := toggle_wishlist_item(wishlistID, listingID)
+		if err != nil {
+			log.Println("Error updating wishlist:", err)
+			write_json_error(w, http.StatusInternalServerError, "internal server error")
+			return
+		}
+
+		savedAnywhere := false
+		for _, id := range get_saved_listing_ids(userID) {
+			savedAnywhere = savedAnywhere || id == listingID
+		}
+		write_json(w, http.StatusOK, map[string]interface{}{
+			"wishlist_id":    wishlistID,
+			"saved":          saved,
+			"saved_anywhere": savedAnywhere,
+		})
+
+	default:
+		write_json_error(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// wishlist_vote_handler records a collaborator's vote on a listing of a
+// wishlist: 1 for, -1 against, 0 to take the vote back
+func wishlist_vote_handler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		write_json_error(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	authenticated, userID := is_authenticated(r)
+	if !authenticated {
+		write_json_error(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+
+	wishlistID, _ := strconv.Atoi(r.FormValue("wishlist_id"))
+	listingID, _ := strconv.Atoi(r.FormValue("listing_id"))
+	vote, err := strconv.Atoi(r.FormValue("vote"))
+	if err != nil || vote < -1 || vote > 1 {
+		write_json_error(w, http.StatusBadRequest, "vote must be 1, 0 or -1")
+		return
+	}
+	if get_wishlist_role(wishlistID, userID) == "" {
+		write_json_error(w, http.StatusNotFound, "wishlist not found")
+		return
+	}
+
+	if vote == 0 {
+		_, err = db.Exec(`DELETE FROM WishlistVotes WHERE wishlist_id = ? AND post_id = ? AND user_id = ?`, wishlistID, listingID, userID)
+	} else {
+		_, err = db.Exec(`INSERT INTO WishlistVotes (wishlist_id, post_id, user_id, vote)
+			SELECT wishlist_id, post_id, ?, ? FROM WishlistItems WHERE wishlist_id = ? AND post_id = ?
+			ON DUPLICATE KEY UPDATE vote = VALUES(vote)`, userID, vote, wishlistID, listingID)
+	}
+	if err != nil {
+		log.Println("Error saving wishlist vote:", err)
+		write_json_error(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	var upvotes, downvotes int
+	err = db.QueryRow(`SELECT COALESCE(SUM(vote > 0), 0), COALESCE(SUM(vote < 0), 0) FROM WishlistVotes
+		WHERE wishlist_id = ? AND post_id = ?`, wishlistID, listingID).Scan(&upvotes, &downvotes)
+	if err != nil {
+		log.Println("Error counting wishlist votes:", err)
+	}
+	write_json(w, http.StatusOK, map[string]int{"upvotes": upvotes, "downvotes": downvotes, "vote": vote})
+}
+
+func update_tables_for_wishlists() {
+	createQueries := []string{
+		`CREATE TABLE IF NOT EXISTS Wishlists (
+			id INT AUTO_INCREMENT PRIMARY KEY,
+			user_id INT NOT NULL,
+			name VARCHAR(100) NOT NULL,
+			share_token CHAR(32) NOT NULL UNIQUE,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (user_id) REFERENCES Users(id) ON DELETE CASCADE ON UPDATE CASCADE
+		)`,
+		`CREATE TABLE IF NOT EXISTS WishlistItems (
+			wishlist_id INT NOT NULL,
+			post_id INT NOT NULL,
+			saved_price DECIMAL(10, 2) NOT NULL,
+			saved_currency VARCHAR(3) NOT NULL,
+			added_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (wishlist_id, post_id),
+			INDEX idx_wishlist_items_post (post_id),
+			FOREIGN KEY (wishlist_id) REFERENCES Wishlists(id) ON DELETE CASCADE,
+			FOREIGN KEY (post_id) REFERENCES Posts(id) ON DELETE CASCADE
+		)`,
+		`CREATE TABLE IF NOT EXISTS WishlistCollaborators (
+			wishlist_id INT NOT NULL,
+			user_id INT NOT NULL,
+			joined_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (wishlist_id, user_id),
+			FOREIGN KEY (wishlist_id) REFERENCES Wishlists(id) ON DELETE CASCADE,
+			FOREIGN KEY (user_id) REFERENCES Users(id) ON DELETE CASCADE
+		)`,
+		`CREATE TABLE IF NOT EXISTS WishlistVotes (
+			wishlist_id INT NOT NULL,
+			post_id INT NOT NULL,
+			user_id INT NOT NULL,
+			vote TINYINT NOT NULL,
+			PRIMARY KEY (wishlist_id, post_id, user_id),
+			FOREIGN KEY (wishlist_id, post_id) REFERENCES WishlistItems(wishlist_id, post_id) ON DELETE CASCADE,
+			FOREIGN KEY (user_id) REFERENCES Users(id) ON DELETE CASCADE
+		)`,
+	}
+
+	for _, query := range createQueries {
+		_, err := db.Exec(query)
+		if err != nil {
+			log.Printf("Error creating wishlist tables: %v", err)
+		}
+	}
+
+	log.Println("Tables updated for wishlists")
+}